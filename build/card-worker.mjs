@@ -0,0 +1,28 @@
+// Renders cards for render.mjs when CARD_TIMEOUT_MS is set, so a card that
+// runs over can be stopped by terminating this thread (see renderCardWithin).
+import { parentPort, workerData } from "worker_threads";
+
+import { renderCardImage } from "./render.mjs";
+
+// Buffers arrive as plain Uint8Arrays.
+const fonts = workerData.fonts.map((font) => ({
+  ...font,
+  data: Buffer.from(font.data),
+}));
+
+parentPort.on("message", async ({ quote, layout, scale }) => {
+  try {
+    const result = await renderCardImage(
+      quote,
+      fonts,
+      layout,
+      workerData.images,
+      scale,
+    );
+    parentPort.postMessage({ result });
+  } catch (error) {
+    parentPort.postMessage({ error: error.message });
+  }
+});
+
+parentPort.postMessage({ ready: true });
@@ -0,0 +1,384 @@
+// Minimal QR Code encoder for the permalinks printed on cards: byte mode,
+// error correction level M, versions 1–40, automatic mask selection
+// (ISO/IEC 18004). Returns a square grid of booleans, true for dark modules.
+
+// Indexed by version; entry 0 is unused.
+const ECC_CODEWORDS_PER_BLOCK = [
+  -1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26,
+  26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+  28, 28, 28,
+];
+const ERROR_CORRECTION_BLOCKS = [
+  -1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17,
+  17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49,
+];
+// Format-information bits for level M.
+const ECC_FORMAT_BITS = 0;
+
+const MASKS = [
+  (x, y) => (x + y) % 2 === 0,
+  (x, y) => y % 2 === 0,
+  (x) => x % 3 === 0,
+  (x, y) => (x + y) % 3 === 0,
+  (x, y) => (Math.floor(x / 3) + Math.floor(y / 2)) % 2 === 0,
+  (x, y) => ((x * y) % 2) + ((x * y) % 3) === 0,
+  (x, y) => (((x * y) % 2) + ((x * y) % 3)) % 2 === 0,
+  (x, y) => (((x + y) % 2) + ((x * y) % 3)) % 2 === 0,
+];
+
+export function encodeQr(text) {
+  const bytes = [...Buffer.from(String(text), "utf8")];
+  const version = pickVersion(bytes.length);
+  const codewords = addErrorCorrection(encodeData(bytes, version), version);
+
+  const size = version * 4 + 17;
+  const grid = {
+    size,
+    modules: Array.from({ length: size }, () => Array(size).fill(false)),
+    reserved: Array.from({ length: size }, () => Array(size).fill(false)),
+  };
+
+  drawFunctionPatterns(grid, version);
+  drawCodewords(grid, codewords);
+
+  let bestMask = 0;
+  let bestPenalty = Infinity;
+  for (let mask = 0; mask < MASKS.length; mask += 1) {
+    applyMask(grid, mask);
+    drawFormatBits(grid, mask);
+    const penalty = scorePenalty(grid);
+    if (penalty < bestPenalty) {
+      bestMask = mask;
+      bestPenalty = penalty;
+    }
+    applyMask(grid, mask);
+  }
+  applyMask(grid, bestMask);
+  drawFormatBits(grid, bestMask);
+
+  return { size, modules: grid.modules };
+}
+
+// Draws the code as a single-path SVG with a light quiet zone around it.
+export function qrToSvg(qr, { quietZone = 4, dark = "#000", light = "#fff" }) {
+  const side = qr.size + quietZone * 2;
+  const commands = [];
+  qr.modules.forEach((row, y) => {
+    row.forEach((isDark, x) => {
+      if (isDark) commands.push(`M${x + quietZone} ${y + quietZone}h1v1h-1z`);
+    });
+  });
+
+  return `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 ${side} ${side}" shape-rendering="crispEdges"><rect width="${side}" height="${side}" fill="${light}"/><path d="${commands.join("")}" fill="${dark}"/></svg>`;
+}
+
+function pickVersion(length) {
+  for (let version = 1; version <= 40; version += 1) {
+    const countBits = version <= 9 ? 8 : 16;
+    if (4 + countBits + length * 8 <= dataCodewordCount(version) * 8) {
+      return version;
+    }
+  }
+  throw new Error(`Text is too long for a QR code (${length} bytes).`);
+}
+
+function encodeData(bytes, version) {
+  const bits = [];
+  const push = (value, length) => {
+    for (let i = length - 1; i >= 0; i -= 1) bits.push((value >>> i) & 1);
+  };
+
+  push(0b0100, 4);
+  push(bytes.length, version <= 9 ? 8 : 16);
+  bytes.forEach((byte) => push(byte, 8));
+
+  const capacity = dataCodewordCount(version) * 8;
+  push(0, Math.min(4, capacity - bits.length));
+  push(0, (8 - (bits.length % 8)) % 8);
+  for (let pad = 0xec; bits.length < capacity; pad ^= 0xec ^ 0x11) {
+    push(pad, 8);
+  }
+
+  const codewords = [];
+  for (let i = 0; i < bits.length; i += 8) {
+    const byte = bits.slice(i, i + 8);
+    codewords.push(byte.reduce((acc, bit) => (acc << 1) | bit, 0));
+  }
+  return codewords;
+}
+
+// Splits the data into blocks, appends each block's Reed–Solomon codewords,
+// and interleaves the result column by column.
+function addErrorCorrection(data, version) {
+  const blockCount = ERROR_CORRECTION_BLOCKS[version];
+  const eccLength = ECC_CODEWORDS_PER_BLOCK[version];
+  const rawCodewords = Math.floor(rawDataModules(version) / 8);
+  const shortBlocks = blockCount - (rawCodewords % blockCount);
+  const shortBlockLength = Math.floor(rawCodewords / blockCount);
+  const divisor = reedSolomonDivisor(eccLength);
+
+  const blocks = [];
+  let offset = 0;
+  for (let i = 0; i < blockCount; i += 1) {
+    const length = shortBlockLength - eccLength + (i < shortBlocks ? 0 : 1);
+    const block = data.slice(offset, offset + length);
+    offset += length;
+    const ecc = reedSolomonRemainder(block, divisor);
+    if (i < shortBlocks) block.push(0);
+    blocks.push([...block, ...ecc]);
+  }
+
+  const result = [];
+  for (let i = 0; i < blocks[0].length; i += 1) {
+    blocks.forEach((block, j) => {
+      // Short blocks carry a placeholder where long blocks have extra data.
+      if (i !== shortBlockLength - eccLength || j >= shortBlocks) {
+        result.push(block[i]);
+      }
+    });
+  }
+  return result;
+}
+
+function reedSolomonDivisor(degree) {
+  const result = Array(degree).fill(0);
+  result[degree - 1] = 1;
+  let root = 1;
+  for (let i = 0; i < degree; i += 1) {
+    for (let j = 0; j < result.length; j += 1) {
+      result[j] = gfMultiply(result[j], root);
+      if (j + 1 < result.length) result[j] ^= result[j + 1];
+    }
+    root = gfMultiply(root, 0x02);
+  }
+  return result;
+}
+
+function reedSolomonRemainder(data, divisor) {
+  const result = Array(divisor.length).fill(0);
+  for (const byte of data) {
+    const factor = byte ^ result.shift();
+    result.push(0);
+    divisor.forEach((coefficient, i) => {
+      result[i] ^= gfMultiply(coefficient, factor);
+    });
+  }
+  return result;
+}
+
+// Multiplication in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+function gfMultiply(x, y) {
+  let z = 0;
+  for (let i = 7; i >= 0; i -= 1) {
+    z = (z << 1) ^ ((z >>> 7) * 0x11d);
+    z ^= ((y >>> i) & 1) * x;
+  }
+  return z;
+}
+
+function rawDataModules(version) {
+  let result = (16 * version + 128) * version + 64;
+  if (version >= 2) {
+    const alignCount = Math.floor(version / 7) + 2;
+    result -= (25 * alignCount - 10) * alignCount - 55;
+    if (version >= 7) result -= 36;
+  }
+  return result;
+}
+
+function dataCodewordCount(version) {
+  return (
+    Math.floor(rawDataModules(version) / 8) -
+    ECC_CODEWORDS_PER_BLOCK[version] * ERROR_CORRECTION_BLOCKS[version]
+  );
+}
+
+function setFunctionModule(grid, x, y, isDark) {
+  grid.modules[y][x] = isDark;
+  grid.reserved[y][x] = true;
+}
+
+function drawFunctionPatterns(grid, version) {
+  const { size } = grid;
+  for (let i = 0; i < size; i += 1) {
+    setFunctionModule(grid, 6, i, i % 2 === 0);
+    setFunctionModule(grid, i, 6, i % 2 === 0);
+  }
+
+  // Finder patterns with their light separators.
+  for (const [cx, cy] of [
+    [3, 3],
+    [size - 4, 3],
+    [3, size - 4],
+  ]) {
+    for (let dy = -4; dy <= 4; dy += 1) {
+      for (let dx = -4; dx <= 4; dx += 1) {
+        const x = cx + dx;
+        const y = cy + dy;
+        if (x < 0 || x >= size || y < 0 || y >= size) continue;
+        const distance = Math.max(Math.abs(dx), Math.abs(dy));
+        setFunctionModule(grid, x, y, distance !== 2 && distance !== 4);
+      }
+    }
+  }
+
+  const positions = alignmentPositions(version, size);
+  const last = positions.length - 1;
+  positions.forEach((cy, i) => {
+    positions.forEach((cx, j) => {
+      // Skip the three corners already taken by finder patterns.
+      if ((i === 0 && j === 0) || (i === 0 && j === last)) return;
+      if (i === last && j === 0) return;
+      for (let dy = -2; dy <= 2; dy += 1) {
+        for (let dx = -2; dx <= 2; dx += 1) {
+          const distance = Math.max(Math.abs(dx), Math.abs(dy));
+          setFunctionModule(grid, cx + dx, cy + dy, distance !== 1);
+        }
+      }
+    });
+  });
+
+  // Reserve the format area now; the real bits depend on the chosen mask.
+  drawFormatBits(grid, 0);
+
+  if (version >= 7) {
+    let remainder = version;
+    for (let i = 0; i < 12; i += 1) {
+      remainder = (remainder << 1) ^ ((remainder >>> 11) * 0x1f25);
+    }
+    const bits = (version << 12) | remainder;
+    for (let i = 0; i < 18; i += 1) {
+      const isDark = ((bits >>> i) & 1) === 1;
+      const a = size - 11 + (i % 3);
+      const b = Math.floor(i / 3);
+      setFunctionModule(grid, a, b, isDark);
+      setFunctionModule(grid, b, a, isDark);
+    }
+  }
+}
+
+function alignmentPositions(version, size) {
+  if (version === 1) return [];
+  const count = Math.floor(version / 7) + 2;
+  const step =
+    version === 32 ? 26 : Math.ceil((version * 4 + 4) / (count * 2 - 2)) * 2;
+  const result = [6];
+  for (let position = size - 7; result.length < count; position -= step) {
+    result.splice(1, 0, position);
+  }
+  return result;
+}
+
+function drawFormatBits(grid, mask) {
+  const { size } = grid;
+  const data = (ECC_FORMAT_BITS << 3) | mask;
+  let remainder = data;
+  for (let i = 0; i < 10; i += 1) {
+    remainder = (remainder << 1) ^ ((remainder >>> 9) * 0x537);
+  }
+  const bits = ((data << 10) | remainder) ^ 0x5412;
+  const bit = (i) => ((bits >>> i) & 1) === 1;
+
+  for (let i = 0; i <= 5; i += 1) setFunctionModule(grid, 8, i, bit(i));
+  setFunctionModule(grid, 8, 7, bit(6));
+  setFunctionModule(grid, 8, 8, bit(7));
+  setFunctionModule(grid, 7, 8, bit(8));
+  for (let i = 9; i < 15; i += 1) setFunctionModule(grid, 14 - i, 8, bit(i));
+
+  for (let i = 0; i < 8; i += 1) {
+    setFunctionModule(grid, size - 1 - i, 8, bit(i));
+  }
+  for (let i = 8; i < 15; i += 1) {
+    setFunctionModule(grid, 8, size - 15 + i, bit(i));
+  }
+  setFunctionModule(grid, 8, size - 8, true);
+}
+
+// Places codeword bits in the two-column zigzag from the bottom-right corner,
+// skipping function modules and the vertical timing column.
+function drawCodewords(grid, codewords) {
+  const { size } = grid;
+  let index = 0;
+  for (let right = size - 1; right >= 1; right -= 2) {
+    if (right === 6) right = 5;
+    for (let vertical = 0; vertical < size; vertical += 1) {
+      for (let j = 0; j < 2; j += 1) {
+        const x = right - j;
+        const upward = ((right + 1) & 2) === 0;
+        const y = upward ? size - 1 - vertical : vertical;
+        if (grid.reserved[y][x] || index >= codewords.length * 8) continue;
+        const byte = codewords[index >>> 3];
+        grid.modules[y][x] = ((byte >>> (7 - (index & 7))) & 1) === 1;
+        index += 1;
+      }
+    }
+  }
+}
+
+// XORs the mask over the data area; applying it twice restores the grid.
+function applyMask(grid, mask) {
+  const test = MASKS[mask];
+  for (let y = 0; y < grid.size; y += 1) {
+    for (let x = 0; x < grid.size; x += 1) {
+      if (!grid.reserved[y][x] && test(x, y)) {
+        grid.modules[y][x] = !grid.modules[y][x];
+      }
+    }
+  }
+}
+
+// The four penalty rules from the spec: long runs, 2×2 blocks, finder-like
+// sequences, and dark/light imbalance. Lower is easier to scan.
+function scorePenalty(grid) {
+  const { size, modules } = grid;
+  const lines = [];
+  for (let i = 0; i < size; i += 1) {
+    lines.push(modules[i]);
+    lines.push(modules.map((row) => row[i]));
+  }
+
+  let penalty = 0;
+  for (const line of lines) {
+    let run = 1;
+    for (let i = 1; i <= line.length; i += 1) {
+      if (i < line.length && line[i] === line[i - 1]) {
+        run += 1;
+        continue;
+      }
+      if (run >= 5) penalty += run - 2;
+      run = 1;
+    }
+
+    const pattern = `0000${line.map(Number).join("")}0000`;
+    for (const finder of ["10111010000", "00001011101"]) {
+      for (
+        let at = pattern.indexOf(finder);
+        at !== -1;
+        at = pattern.indexOf(finder, at + 1)
+      ) {
+        penalty += 40;
+      }
+    }
+  }
+
+  let dark = 0;
+  for (let y = 0; y < size; y += 1) {
+    for (let x = 0; x < size; x += 1) {
+      if (modules[y][x]) dark += 1;
+      if (x + 1 < size && y + 1 < size) {
+        const color = modules[y][x];
+        if (
+          modules[y][x + 1] === color &&
+          modules[y + 1][x] === color &&
+          modules[y + 1][x + 1] === color
+        ) {
+          penalty += 3;
+        }
+      }
+    }
+  }
+
+  const percent = (dark * 100) / (size * size);
+  penalty += Math.floor(Math.abs(percent - 50) / 5) * 10;
+  return penalty;
+}
@@ -1,8 +1,10 @@
 import fs from "fs/promises";
 import path from "path";
 import process from "process";
-import { fileURLToPath } from "url";
+import { fileURLToPath, pathToFileURL } from "url";
+import { Worker, isMainThread } from "worker_threads";
 import crypto from "crypto";
+import { once } from "events";
 
 import matter from "gray-matter";
 import fg from "fast-glob";
@@ -13,6 +15,9 @@ import { html as parseHtml } from "satori-html";
 import { marked } from "marked";
 import { encode as encodeJpeg } from "jpeg-js";
 
+import { encodeQr, qrToSvg } from "./qr.mjs";
+import { encodeWebp } from "./webp.mjs";
+
 const __filename = fileURLToPath(import.meta.url);
 const __dirname = path.dirname(__filename);
 const ROOT_DIR = path.resolve(__dirname, "..");
@@ -22,26 +27,344 @@ const OUTPUT_WRAPPER_DIR = path.join(ROOT_DIR, "q");
 const OUTPUT_SOURCES_DIR = path.join(ROOT_DIR, "sources");
 const TEMPLATE_DIR = path.join(__dirname, "templates");
 const FONT_DIR = path.join(ROOT_DIR, "assets", "fonts");
-const MANIFEST_PATH = path.join(ROOT_DIR, "build-manifest.json");
-
-const CARD_WIDTH = 1200;
-const CARD_HEIGHT = 628;
+// Family of the optional Mono-Regular.ttf face below.
+const MONO_FONT = "Mono";
+// QUOTE_STYLE names, as the marks wrapped around a quote on cards and pages.
+const QUOTE_STYLES = {
+  curly: ["“", "”"],
+  straight: ['"', '"'],
+  guillemets: ["«", "»"],
+  none: ["", ""],
+};
+// Regular and Bold are required; the italic faces are used when present.
+const FONT_FACES = [
+  { file: "AtkinsonHyperlegible-Regular.ttf", weight: 400, style: "normal" },
+  { file: "AtkinsonHyperlegible-Bold.ttf", weight: 700, style: "normal" },
+  {
+    file: "AtkinsonHyperlegible-Italic.ttf",
+    weight: 400,
+    style: "italic",
+    optional: true,
+  },
+  {
+    file: "AtkinsonHyperlegible-BoldItalic.ttf",
+    weight: 700,
+    style: "italic",
+    optional: true,
+  },
+  // Drawn for `raw: true` quotes when present.
+  {
+    file: "Mono-Regular.ttf",
+    family: MONO_FONT,
+    weight: 400,
+    style: "normal",
+    optional: true,
+  },
+];
+const MANIFEST_PATH = resolveManifestPath(process.env.MANIFEST_NAME);
+// Grouping fallback for quotes whose url has no hostname (e.g. "mailto:").
+const UNKNOWN_SOURCE_DOMAIN = "unknown-source";
+// Manifest fields describing cards, covers, and wrappers, which PAGES_ONLY
+// builds carry over untouched.
+const CARD_MANIFEST_KEYS = [
+  "cardVersion",
+  "cardRenderVersion",
+  "cardRenderHash",
+  "fontsHash",
+  "cardsOnly",
+  "wrapperRenderVersion",
+  "wrapperTemplateHash",
+  "cardScales",
+  "cardSharding",
+  "cardExtension",
+  "cardJpegFallback",
+  "cardFormats",
+  "coverHashes",
+];
+const OUTPUT_ALL_PATH = path.join(ROOT_DIR, "all.html");
+const OUTPUT_HEADERS_PATH = path.join(ROOT_DIR, "_headers");
+const OUTPUT_LLMS_PATH = path.join(ROOT_DIR, "llms.txt");
+const OUTPUT_SEARCH_INDEX_PATH = path.join(ROOT_DIR, "search-index.json");
+const OUTPUT_GRAPH_PATH = path.join(ROOT_DIR, "graph.dot");
+const OUTPUT_DEPLOY_PLAN_PATH = path.join(ROOT_DIR, "deploy-plan.json");
+const IMAGE_EXTENSIONS = {
+  jpeg: "jpg",
+  png: "png",
+  webp: "webp",
+  svg: "svg",
+};
+const LLMS_EXCERPT_MAX_CHARS = 160;
+
+// Card geometry and the quote's auto-fit range; each can be overridden from
+// the environment and is checked by validateCardSettings.
+const CARD_WIDTH = envToInteger(process.env.CARD_WIDTH, 1200);
+const CARD_HEIGHT = envToInteger(process.env.CARD_HEIGHT, 628);
+// When set, a quote that does not fit at QUOTE_FONT_TARGET makes its card
+// taller, up to this many pixels, before its text shrinks.
+const CARD_MAX_HEIGHT = envToInteger(process.env.CARD_MAX_HEIGHT, null);
 const CARD_PADDING_X = 150;
 const CARD_PADDING_Y = 120;
-const QUOTE_FONT_MAX = 72;
-const QUOTE_FONT_MIN = 36;
-const QUOTE_LINE_HEIGHT = 1.32;
+const QUOTE_FONT_MAX = envToNumber(process.env.QUOTE_FONT_MAX, 72);
+const QUOTE_FONT_MIN = envToNumber(process.env.QUOTE_FONT_MIN, 36);
+// The size CARD_MAX_HEIGHT grows a card to keep the quote at.
+const QUOTE_FONT_TARGET = envToNumber(
+  process.env.QUOTE_FONT_TARGET,
+  QUOTE_FONT_MAX,
+);
+const QUOTE_LINE_HEIGHT = envToNumber(process.env.QUOTE_LINE_HEIGHT, 1.32);
+// Extra pixels after every character of the quote; 0 leaves the font's own
+// spacing.
+const QUOTE_LETTER_SPACING = envToNumber(process.env.QUOTE_LETTER_SPACING, 0);
+const FONT_SIZE_STEP = envToNumber(process.env.FONT_SIZE_STEP, 0.5);
+// CARD_MAXIMIZE_SHORT: one-line quotes up to this many characters may grow
+// past QUOTE_FONT_MAX, up to this multiple of it.
+const SHORT_QUOTE_MAX_CHARS = 24;
+const SHORT_QUOTE_GROWTH_LIMIT = 2;
 const SPACE_WIDTH_RATIO = 0.35;
 const CHAR_WIDTH_RATIO = 0.6;
+// Han, kana, and Hangul are drawn full width.
+const CJK_WIDTH_RATIO = 1;
 const WIDE_CHAR_BONUS_RATIO = 0.08;
-
-const CARD_RENDER_VERSION = "20240505";
-const WRAPPER_RENDER_VERSION = "20240505";
+const BOLD_WIDTH_RATIO = 1.06;
+const EMPHASIS_WORD_GAP_RATIO = 0.25;
+const STRONG_PATTERN = /\*\*([\s\S]+?)\*\*/g;
+// `**strong**` or `*italic*`; single asterisks must hug their text so
+// arithmetic like "2 * 3 * 4" is left alone.
+const STRONG_OR_ITALIC_PATTERN =
+  /\*\*([\s\S]+?)\*\*|\*([^\s*](?:[^*]*?[^\s*])?)\*/g;
+// Widest digit ("0") in both bundled weights, so every cell fits its glyph.
+const TABULAR_DIGIT_RATIO = 0.66;
+// Sits inside the bottom-right padding, clear of the quote text.
+const CARD_QR_SIZE = 120;
+const CARD_QR_MARGIN = 24;
+// The watermark spans this share of the card's diagonal, up to a third of its
+// height in type size.
+const CARD_WATERMARK_SPAN = 0.7;
+const CARD_WATERMARK_OPACITY = 0.18;
+// CARD_LOGO is scaled down to fit this box, never up.
+const CARD_LOGO_MAX_SIZE = 120;
+// Corners CARD_LOGO_POSITION and CARD_QR_POSITION can name.
+const CARD_CORNERS = [
+  "top-left",
+  "top-right",
+  "bottom-left",
+  "bottom-right",
+];
+// Background and text colors selectable with CARD_THEME.
+const CARD_THEMES = {
+  light: { background: "#f7f4ec", text: "#26211a" },
+  dark: { background: "#161513", text: "#ede8dc" },
+  sepia: { background: "#f1e4c8", text: "#4a3621" },
+};
+// WCAG AA for body text; CARD_AUTO_CONTRAST fixes anything below it.
+const MIN_TEXT_CONTRAST = 4.5;
+// Named CARD_GRADIENT directions, as CSS angles.
+const GRADIENT_DIRECTIONS = { vertical: 180, horizontal: 90, diagonal: 135 };
+const TEXT_DIRECTIONS = ["ltr", "rtl", "auto"];
+// CARD_VERTICAL_ALIGN names, as the card's align-items.
+const VERTICAL_ALIGNS = {
+  top: "flex-start",
+  center: "center",
+  bottom: "flex-end",
+};
+// CARD_TEXT_ALIGN names, as flex alignment along a left-to-right row.
+const TEXT_ALIGNS = {
+  left: "flex-start",
+  center: "center",
+  right: "flex-end",
+};
+// Hebrew, Arabic, Syriac, Thaana, NKo, and their presentation forms.
+const RTL_CHARACTER = /[\u0590-\u08ff\ufb1d-\ufdff\ufe70-\ufefc]/gu;
+// Hangul Jamo, CJK punctuation, kana, Han, Hangul syllables, and full-width
+// forms. Text in these scripts may break between any two characters.
+const CJK_CHARACTER =
+  /[\u1100-\u11ff\u2e80-\u9fff\uac00-\ud7af\uf900-\ufaff\uff00-\uffef]/gu;
+// Closing punctuation and small kana that must not start a line.
+const CJK_NO_BREAK_BEFORE =
+  /^[、。，．！？：；）」』】〕〉》ゝゞー々ぁぃぅぇぉっゃゅょァィゥェォッャュョ]$/u;
+// The attribution line fits its own width, independent of the quote size.
+const CARD_AUTHOR_FONT_MAX = 36;
+const CARD_AUTHOR_FONT_MIN = 22;
+const CARD_AUTHOR_LINE_HEIGHT = 1.2;
+const CARD_AUTHOR_GAP = 28;
+const CARD_AUTHOR_MAX_LINES = 2;
+// The source domain under CARD_SOURCE_FOOTER, centred in the bottom padding.
+const CARD_FOOTER_SIZE = 22;
+const CARD_FOOTER_OPACITY = 0.7;
+const COVER_TITLE_SIZE = 60;
+const COVER_SAMPLE_SIZE = 32;
+const COVER_FOOTER_SIZE = 26;
+const COVER_TITLE_MAX_CHARS = 80;
+const COVER_SAMPLE_MAX_CHARS = 140;
+
+const CARD_RENDER_VERSION = "20261017.4";
+const WRAPPER_RENDER_VERSION = "20261017";
 const SOURCE_RENDER_VERSION = "20240505";
 
 const BASE_PATH = normalizeBasePath(process.env.BASE_PATH || "");
 const SITE_ORIGIN = normalizeOrigin(process.env.SITE_ORIGIN || "");
 const ENV_CARD_VERSION = normalizeCardVersion(process.env.CARD_VERSION || "");
+const CARD_UNDER_WRAPPER = envToBoolean(process.env.CARD_UNDER_WRAPPER);
+const PARSE_EMPHASIS = envToBoolean(process.env.PARSE_EMPHASIS);
+const PARSE_ITALIC = envToBoolean(process.env.PARSE_ITALIC);
+const EMPHASIS_PATTERN = PARSE_ITALIC
+  ? STRONG_OR_ITALIC_PATTERN
+  : STRONG_PATTERN;
+const MANIFEST_BACKUPS = envToInteger(process.env.MANIFEST_BACKUPS, 0);
+const WRAPPER_STYLE = normalizeWrapperStyle(process.env.WRAPPER_STYLE || "");
+const AUTO_ID = envToBoolean(process.env.AUTO_ID);
+const ALLOW_ANONYMOUS = envToBoolean(process.env.ALLOW_ANONYMOUS);
+const CAPTURE_FRONT_MATTER = envToBoolean(process.env.CAPTURE_FRONT_MATTER);
+const EMIT_ALL = envToBoolean(process.env.EMIT_ALL);
+const CARD_TRANSPARENT = envToBoolean(process.env.CARD_TRANSPARENT);
+const DESCRIPTION_PATTERN = stringOrNull(process.env.DESCRIPTION_PATTERN);
+const CARD_WHITESPACE = normalizeWhitespacePolicy(
+  process.env.CARD_WHITESPACE || "",
+);
+const CARD_TABULAR_FIGURES = envToBoolean(process.env.CARD_TABULAR_FIGURES);
+const TAG_CASE = normalizeTagCase(process.env.TAG_CASE || "");
+const CARDS_ONLY = envToBoolean(process.env.CARDS_ONLY);
+const PAGES_ONLY = envToBoolean(process.env.PAGES_ONLY);
+const REDIRECT_ON_RENAME = envToBoolean(process.env.REDIRECT_ON_RENAME);
+const EMIT_HEADERS = envToBoolean(process.env.EMIT_HEADERS);
+const EMIT_LLMS_TXT = envToBoolean(process.env.EMIT_LLMS_TXT);
+const EMIT_SEARCH_INDEX = envToBoolean(process.env.EMIT_SEARCH_INDEX);
+const EMIT_GRAPH_DOT = envToBoolean(process.env.EMIT_GRAPH_DOT);
+const EMIT_DEPLOY_PLAN = envToBoolean(process.env.EMIT_DEPLOY_PLAN);
+// Output files this build changed on disk, for EMIT_DEPLOY_PLAN; null when
+// the plan is off so writes skip the bookkeeping.
+const deployChanges = EMIT_DEPLOY_PLAN
+  ? { upload: new Set(), delete: new Set() }
+  : null;
+const EMIT_BASE_HREF = envToBoolean(process.env.EMIT_BASE_HREF);
+const CARD_GRADIENT = parseGradient(process.env.CARD_GRADIENT);
+const CARD_BACKGROUND_IMAGE = stringOrNull(process.env.CARD_BACKGROUND_IMAGE);
+const CARD_BACKGROUND_OVERLAY = parseOverlay(
+  process.env.CARD_BACKGROUND_OVERLAY,
+);
+const CARD_TEXT_STROKE = parseTextStroke(process.env.CARD_TEXT_STROKE);
+const CARD_QR = envToBoolean(process.env.CARD_QR);
+const CARD_QR_POSITION = normalizeCorner(
+  "CARD_QR_POSITION",
+  process.env.CARD_QR_POSITION || "",
+);
+const CARD_QR_TARGET = normalizeQrTarget(process.env.CARD_QR_TARGET || "");
+const CARD_AUTHOR = envToBoolean(process.env.CARD_AUTHOR);
+const CARD_SOURCE_FOOTER = envToBoolean(process.env.CARD_SOURCE_FOOTER);
+const CARD_MAXIMIZE_SHORT = envToBoolean(process.env.CARD_MAXIMIZE_SHORT);
+const CARD_WATERMARK = stringOrNull(process.env.CARD_WATERMARK);
+const CARD_LOGO = stringOrNull(process.env.CARD_LOGO);
+const CARD_LOGO_POSITION = normalizeCorner(
+  "CARD_LOGO_POSITION",
+  process.env.CARD_LOGO_POSITION || "",
+);
+const CARD_LOGO_MARGIN = envToInteger(process.env.CARD_LOGO_MARGIN, 24);
+const CARD_LOGO_OPACITY = envToNumber(process.env.CARD_LOGO_OPACITY, 1);
+const CARD_THEME = normalizeCardTheme(process.env.CARD_THEME || "");
+const CARD_DOMAIN_TINT = envToBoolean(process.env.CARD_DOMAIN_TINT);
+const CARD_AUTO_CONTRAST = envToBoolean(process.env.CARD_AUTO_CONTRAST);
+const CARD_OVERFLOW = normalizeOverflow(process.env.CARD_OVERFLOW || "");
+const CARD_VERTICAL_ALIGN = normalizeVerticalAlign(
+  process.env.CARD_VERTICAL_ALIGN || "",
+);
+const CARD_TEXT_ALIGN = normalizeTextAlign(process.env.CARD_TEXT_ALIGN || "");
+const QUOTE_STYLE = normalizeQuoteStyle(process.env.QUOTE_STYLE || "");
+// Wrapped around every quote except `raw: true` ones.
+const QUOTE_MARKS = QUOTE_STYLES[QUOTE_STYLE];
+const CARD_BREAK_HYPHEN = envToBoolean(process.env.CARD_BREAK_HYPHEN);
+// Set but empty means a hard cut with no marker.
+const CARD_TRUNCATION_MARKER = process.env.CARD_TRUNCATION_MARKER ?? "…";
+const TEXT_DIRECTION = normalizeTextDirection(
+  process.env.TEXT_DIRECTION || "",
+);
+const EXCLUDE_IDS = parseIdList(process.env.EXCLUDE_IDS);
+const SOURCE_COVERS = envToBoolean(process.env.SOURCE_COVERS);
+const MERGE_SOURCE_ITEMS = envToBoolean(process.env.MERGE_SOURCE_ITEMS);
+const EMIT_QUOTE_JSON = envToBoolean(process.env.EMIT_QUOTE_JSON);
+const VERIFY_OUTPUT = envToBoolean(process.env.VERIFY_OUTPUT);
+// Per-card render budget in milliseconds; 0 means no limit.
+const CARD_TIMEOUT_MS = Math.max(
+  0,
+  envToInteger(process.env.CARD_TIMEOUT_MS, 0),
+);
+const CARD_SCALE = parseCardScale(process.env.CARD_SCALE);
+const CARD_SCALES = parseCardScales(process.env.CARD_SCALES);
+const CARD_SHARDING = parseCardSharding(process.env.CARD_SHARDING);
+const CARD_IMAGE_FORMAT = normalizeImageFormat(
+  process.env.CARD_IMAGE_FORMAT || "",
+);
+const CARD_JPEG_QUALITY_INPUT = envToInteger(process.env.CARD_JPEG_QUALITY, 88);
+// The encoder only accepts 1–100, so anything outside is clamped.
+const CARD_JPEG_QUALITY = Math.min(100, Math.max(1, CARD_JPEG_QUALITY_INPUT));
+// Link-preview scrapers never read SVG, so SVG cards always get the JPEG copy.
+const CARD_JPEG_FALLBACK =
+  envToBoolean(process.env.CARD_JPEG_FALLBACK) || CARD_IMAGE_FORMAT === "svg";
+// Where card files go: the shard depth, the file extension, and whether a JPEG
+// copy sits beside each card. Stored in the manifest so files from an earlier
+// layout can be found and removed.
+const CARD_FILES = {
+  sharding: CARD_SHARDING,
+  extension: IMAGE_EXTENSIONS[CARD_IMAGE_FORMAT],
+  jpegFallback: CARD_JPEG_FALLBACK,
+};
+const SLUG_TRANSLITERATOR = stringOrNull(process.env.SLUG_TRANSLITERATOR);
+const INLINE_CSS = stringOrNull(process.env.INLINE_CSS);
+const FILE_MODE = parseFileMode("FILE_MODE", process.env.FILE_MODE);
+const DIR_MODE = parseFileMode("DIR_MODE", process.env.DIR_MODE);
+const CARD_PADDING = {
+  top: envToInteger(process.env.CARD_PADDING_TOP, CARD_PADDING_Y),
+  right: envToInteger(process.env.CARD_PADDING_RIGHT, CARD_PADDING_X),
+  bottom: envToInteger(process.env.CARD_PADDING_BOTTOM, CARD_PADDING_Y),
+  left: envToInteger(process.env.CARD_PADDING_LEFT, CARD_PADDING_X),
+};
+// The box a card is laid out in. Extra formats bring their own.
+const CARD_LAYOUT = {
+  width: CARD_WIDTH,
+  height: CARD_HEIGHT,
+  padding: CARD_PADDING,
+};
+// Extra card formats, each rendered next to the main card as
+// cards/<id>-<name>.jpg with its own size and padding.
+const KNOWN_CARD_FORMATS = {
+  square: {
+    label: "square",
+    width: 1080,
+    height: 1080,
+    padding: { top: 120, right: 120, bottom: 120, left: 120 },
+  },
+  // Stories and reels overlay the top and bottom with app chrome, so the
+  // text stays inside a generous safe area.
+  story: {
+    label: "story",
+    width: 1080,
+    height: 1920,
+    padding: { top: 280, right: 100, bottom: 380, left: 100 },
+  },
+};
+const CARD_FORMATS = [
+  envToBoolean(process.env.SQUARE_CARDS) && "square",
+  envToBoolean(process.env.STORY_CARDS) && "story",
+]
+  .filter(Boolean)
+  .map((name) => ({ name, ...KNOWN_CARD_FORMATS[name] }));
+// A poster-sized copy, PRINT_CARD_SIZE inches at PRINT_CARD_DPI, rendered as
+// one more format.
+const PRINT_CARD_SIZE = parsePrintSize(process.env.PRINT_CARD_SIZE);
+const PRINT_CARD_DPI = envToInteger(process.env.PRINT_CARD_DPI, 300);
+// Largest side, in pixels, a print card may reach; 40×60 inches at 1200 DPI
+// would otherwise ask for a 48000×72000 image.
+const PRINT_MAX_PIXELS = 20000;
+if (PRINT_CARD_SIZE) {
+  CARD_FORMATS.push({
+    name: "print",
+    label: "print",
+    ...printLayout(
+      PRINT_CARD_SIZE.width,
+      PRINT_CARD_SIZE.height,
+      PRINT_CARD_DPI,
+    ),
+  });
+}
 
 marked.setOptions({ mangle: false, headerIds: false });
 
@@ -49,10 +372,54 @@ async function main() {
   const args = parseArgs(process.argv.slice(2));
   const cardVersion = args.cardVersion ?? ENV_CARD_VERSION;
   const forceRebuild = args.force || envToBoolean(process.env.FORCE_REBUILD);
+  const outcomePath = args.outcome ?? stringOrNull(process.env.OUTCOME_PATH);
+  const explain = args.explain || envToBoolean(process.env.EXPLAIN);
+
+  validateCardSettings();
+  if (CARDS_ONLY && PAGES_ONLY) {
+    throw new Error("CARDS_ONLY and PAGES_ONLY cannot be combined.");
+  }
+
+  // Pages-only builds carry the card and wrapper state over even when forced.
+  const manifest =
+    forceRebuild && !PAGES_ONLY ? null : await loadManifest();
+
+  const transliterate = await loadTransliterator(SLUG_TRANSLITERATOR);
+  const { quotes, warnings, errors } = await loadQuotes(transliterate);
+
+  if (CARD_QR && CARD_QR_TARGET === "wrapper" && !SITE_ORIGIN) {
+    warnings.push(
+      "CARD_QR needs SITE_ORIGIN to build absolute URLs; rendering cards without QR codes.",
+    );
+  }
+
+  // --check renders nothing, so it sizes every quote up front. Builds warn as
+  // they render instead, which covers only the cards that changed. Sizes are
+  // estimated, so a quote right at the limit may still squeeze in.
+  if (args.check) {
+    for (const quote of quotes) {
+      const author = buildCardAuthor(quote);
+      const fit = fitCardText(
+        cardText(quote),
+        author?.height ?? 0,
+        cardLayout(quote),
+      );
+      const warning = describeCardOverflow(fit);
+      if (warning) warnings.push(`${quote.location}: ${warning}`);
+    }
+  }
 
-  const manifest = forceRebuild ? null : await loadManifest();
+  if (CARD_JPEG_QUALITY !== CARD_JPEG_QUALITY_INPUT) {
+    warnings.push(
+      `CARD_JPEG_QUALITY ${CARD_JPEG_QUALITY_INPUT} is outside 1–100; using ${CARD_JPEG_QUALITY}.`,
+    );
+  }
 
-  const { quotes, warnings, errors } = await loadQuotes();
+  if (EMIT_LLMS_TXT && !SITE_ORIGIN) {
+    warnings.push(
+      "EMIT_LLMS_TXT works best with SITE_ORIGIN; llms.txt will list site-relative links.",
+    );
+  }
 
   if (warnings.length) {
     warnings.forEach((msg) => console.warn(`⚠️  ${msg}`));
@@ -72,23 +439,134 @@ async function main() {
     return;
   }
 
+  if (args.plan) {
+    const planned = await planOutputs(quotes, outcomePath);
+    planned.forEach((file) => console.log(file));
+    return;
+  }
+
+  if (args.stdout) {
+    const quote = quotes.find((candidate) => candidate.id === args.stdout);
+    if (!quote) {
+      throw new Error(`--stdout: no quote has the id "${args.stdout}".`);
+    }
+    if (process.stdout.isTTY) {
+      throw new Error(
+        "--stdout writes the card's image data; pipe or redirect it to a file.",
+      );
+    }
+    const [fonts, cardImages] = await Promise.all([
+      loadFonts(),
+      loadCardImages(),
+    ]);
+    await writeCardTo(process.stdout, quote, fonts, cardImages);
+    return;
+  }
+
   if (!quotes.length) {
     await cleanOutputs();
     await removeManifestFile();
+    await saveDeployPlan();
+    if (outcomePath) {
+      await saveOutcome(
+        outcomePath,
+        buildOutcome({ quotes, sourceGroups: [] }),
+      );
+    }
     console.log("No quotes found. Exiting without generating assets.");
     return;
   }
 
-  const [wrapperTemplate, sourceTemplate, fonts] = await Promise.all([
+  const [
+    wrapperTemplate,
+    sourceTemplate,
+    allTemplate,
+    fonts,
+    inlineCss,
+    cardImages,
+  ] = await Promise.all([
     fs.readFile(path.join(TEMPLATE_DIR, "wrapper.html"), "utf8"),
     fs.readFile(path.join(TEMPLATE_DIR, "source.html"), "utf8"),
+    fs.readFile(path.join(TEMPLATE_DIR, "all.html"), "utf8"),
     loadFonts(),
+    loadInlineCss(INLINE_CSS),
+    loadCardImages(),
   ]);
 
+  // A placeholder no payload fills renders as nothing, so likely typos are
+  // flagged. The payloads are built from sample data just for their keys.
+  const sampleGroup = { domain: "", slug: "", sourceUrl: "", quotes: [] };
+  const templateWarnings = [
+    [
+      "wrapper.html",
+      wrapperTemplate,
+      [
+        ...Object.keys(buildWrapperPayload(quotes[0], cardVersion)),
+        "inline_css",
+        "base_href",
+      ],
+    ],
+    [
+      "source.html",
+      sourceTemplate,
+      Object.keys(buildSourcePayload(sampleGroup)),
+    ],
+    ["all.html", allTemplate, Object.keys(buildAllPagePayload([]))],
+  ].flatMap(([name, template, keys]) =>
+    findUnknownTemplateKeys(template, keys).map(
+      (key) =>
+        `${name}: {{${key}}} is not a field the build fills, so it renders empty.`,
+    ),
+  );
+  templateWarnings.forEach((msg) => console.warn(`⚠️  ${msg}`));
+
   const fontsHash = hashFonts(fonts);
-  const cardRenderHash = hashArray([CARD_RENDER_VERSION, fontsHash]);
-  const wrapperTemplateHash = hashString(wrapperTemplate);
-  const sourceTemplateHash = hashString(sourceTemplate);
+  const cardRenderHash = hashArray([
+    CARD_RENDER_VERSION,
+    fontsHash,
+    PARSE_EMPHASIS ? EMPHASIS_PATTERN.source : null,
+    CARD_WIDTH,
+    CARD_HEIGHT,
+    CARD_MAX_HEIGHT === null ? null : [CARD_MAX_HEIGHT, QUOTE_FONT_TARGET],
+    CARD_PADDING,
+    [QUOTE_FONT_MIN, QUOTE_FONT_MAX, FONT_SIZE_STEP, QUOTE_LINE_HEIGHT],
+    QUOTE_LETTER_SPACING,
+    CARD_TRANSPARENT,
+    CARD_WHITESPACE,
+    CARD_TABULAR_FIGURES,
+    CARD_GRADIENT,
+    cardImages.background ? hashString(cardImages.background.uri) : null,
+    CARD_BACKGROUND_OVERLAY,
+    CARD_AUTO_CONTRAST,
+    CARD_TEXT_STROKE,
+    cardImages.logo
+      ? [
+          hashString(cardImages.logo.uri),
+          CARD_LOGO_POSITION,
+          CARD_LOGO_MARGIN,
+          CARD_LOGO_OPACITY,
+        ]
+      : null,
+    CARD_QR ? [CARD_QR_POSITION, CARD_QR_TARGET] : null,
+    CARD_AUTHOR,
+    CARD_MAXIMIZE_SHORT,
+    CARD_OVERFLOW,
+    CARD_OVERFLOW === "truncate" ? CARD_TRUNCATION_MARKER : null,
+    CARD_VERTICAL_ALIGN,
+    CARD_TEXT_ALIGN,
+    CARD_BREAK_HYPHEN,
+    QUOTE_STYLE,
+    CARD_SCALE,
+    CARD_SHARDING,
+    CARD_IMAGE_FORMAT,
+    CARD_JPEG_FALLBACK,
+    CARD_JPEG_QUALITY,
+    CARD_WATERMARK,
+    CARD_THEME,
+  ]);
+  // Inlined CSS lands in every page, so it counts as part of each template.
+  const wrapperTemplateHash = hashArray([wrapperTemplate, inlineCss]);
+  const sourceTemplateHash = hashArray([sourceTemplate, inlineCss]);
   const manifestQuotes = manifest?.quotes ?? {};
   const cardVersionKey = cardVersion ?? null;
 
@@ -114,12 +592,34 @@ async function main() {
     forceRebuild || (manifest?.cardVersion ?? null) !== cardVersionKey;
 
   const dirtyCards = new Set();
+  // Extra formats are tracked per format, so enabling one renders only it.
+  const dirtyFormatCards = new Map(
+    CARD_FORMATS.map((format) => [format.name, new Set()]),
+  );
+  // Scaled copies too, so adding a scale leaves the main cards alone.
+  const dirtyScaleCards = new Map(
+    CARD_SCALES.map((scale) => [scale, new Set()]),
+  );
   const dirtyWrappers = new Set();
   const dirtyGroups = new Set();
   const nextManifestQuotes = {};
   const removedQuotes = [];
   const sourceGroups = new Map();
   const groupMeta = new Map();
+  const explanations = {};
+  const changeFlags = {
+    buildReason: forceRebuild
+      ? "forced rebuild"
+      : !manifest
+        ? "no previous manifest"
+        : null,
+    cardRenderChanged,
+    wrapperRenderChanged,
+    wrapperTemplateChanged,
+    cardVersionChanged,
+    sourceRenderChanged,
+    sourceTemplateChanged,
+  };
 
   for (const quote of quotes) {
     const groupKey = buildGroupKey(quote);
@@ -128,47 +628,105 @@ async function main() {
       slug: quote.articleSlug,
     });
 
-    let group = sourceGroups.get(groupKey);
-    if (!group) {
-      group = {
-        domain: quote.sourceDomain,
-        slug: quote.articleSlug,
-        sourceUrl: quote.normalizedUrl,
-        articleTitle: quote.articleTitle,
-        quotes: [],
-      };
-      sourceGroups.set(groupKey, group);
-    }
-    if (!group.articleTitle && quote.articleTitle) {
-      group.articleTitle = quote.articleTitle;
+    // Hidden quotes keep their card and wrapper but never join a group, so a
+    // source whose quotes are all hidden has its page removed.
+    if (!quote.hideFromSource) {
+      let group = sourceGroups.get(groupKey);
+      if (!group) {
+        group = {
+          domain: quote.sourceDomain,
+          slug: quote.articleSlug,
+          sourceUrl: quote.displayUrl,
+          articleTitle: quote.articleTitle,
+          sourceName: quote.sourceName,
+          quotes: [],
+        };
+        sourceGroups.set(groupKey, group);
+      }
+      if (!group.articleTitle && quote.articleTitle) {
+        group.articleTitle = quote.articleTitle;
+      }
+      if (!group.sourceName && quote.sourceName) {
+        group.sourceName = quote.sourceName;
+      }
+      group.quotes.push(quote);
     }
-    group.quotes.push(quote);
 
-    const manifestEntry = buildQuoteManifestEntry(quote, groupKey, cardVersion);
+    // Cards-only builds track card hashes alone, so the next full build
+    // regenerates every wrapper and source page.
+    const manifestEntry = CARDS_ONLY
+      ? {
+          cardHash: buildCardHash(quote),
+          formatHashes: buildFormatHashes(quote),
+          scaleHashes: buildScaleHashes(quote),
+        }
+      : buildQuoteManifestEntry(quote, groupKey, cardVersion);
     nextManifestQuotes[quote.id] = manifestEntry;
 
     const previous = manifestQuotes[quote.id];
+    // Pages-only builds keep the card and wrapper hashes as last built, so the
+    // next full build still renders whatever changed in the meantime.
+    if (PAGES_ONLY) {
+      manifestEntry.cardHash = previous?.cardHash ?? null;
+      manifestEntry.formatHashes = previous?.formatHashes ?? null;
+      manifestEntry.scaleHashes = previous?.scaleHashes ?? null;
+      manifestEntry.wrapperHash = previous?.wrapperHash ?? null;
+    }
 
     const cardDirty =
-      cardRenderChanged ||
-      !previous ||
-      previous.cardHash !== manifestEntry.cardHash;
+      !PAGES_ONLY &&
+      (cardRenderChanged ||
+        !previous ||
+        previous.cardHash !== manifestEntry.cardHash);
+    for (const [name, dirtyIds] of dirtyFormatCards) {
+      if (
+        !PAGES_ONLY &&
+        (cardRenderChanged ||
+          previous?.formatHashes?.[name] !== manifestEntry.formatHashes[name])
+      ) {
+        dirtyIds.add(quote.id);
+      }
+    }
+    for (const [scale, dirtyIds] of dirtyScaleCards) {
+      if (
+        !PAGES_ONLY &&
+        (cardRenderChanged ||
+          previous?.scaleHashes?.[scale] !== manifestEntry.scaleHashes[scale])
+      ) {
+        dirtyIds.add(quote.id);
+      }
+    }
     const wrapperDirty =
-      wrapperRenderChanged ||
-      wrapperTemplateChanged ||
-      cardVersionChanged ||
-      !previous ||
-      previous.wrapperHash !== manifestEntry.wrapperHash;
+      !CARDS_ONLY &&
+      !PAGES_ONLY &&
+      (wrapperRenderChanged ||
+        wrapperTemplateChanged ||
+        cardVersionChanged ||
+        !previous ||
+        previous.wrapperHash !== manifestEntry.wrapperHash);
     const groupDirty =
-      sourceRenderChanged ||
-      sourceTemplateChanged ||
-      !previous ||
-      previous.groupItemHash !== manifestEntry.groupItemHash ||
-      previous.sourceKey !== groupKey;
+      !CARDS_ONLY &&
+      (sourceRenderChanged ||
+        sourceTemplateChanged ||
+        !previous ||
+        previous.groupItemHash !== manifestEntry.groupItemHash ||
+        previous.sourceKey !== groupKey);
 
     if (cardDirty) dirtyCards.add(quote.id);
     if (wrapperDirty) dirtyWrappers.add(quote.id);
     if (groupDirty) dirtyGroups.add(groupKey);
+
+    if (explain && (cardDirty || wrapperDirty || groupDirty)) {
+      explanations[quote.id] = explainDirtyQuote({
+        flags: changeFlags,
+        previous,
+        entry: manifestEntry,
+        groupKey,
+        cardDirty,
+        wrapperDirty,
+        groupDirty,
+      });
+    }
   }
 
   for (const [id, previous] of Object.entries(manifestQuotes)) {
@@ -179,9 +737,10 @@ async function main() {
       sourceKey: previous.sourceKey,
       sourceDomain: previous.sourceDomain,
       articleSlug: previous.articleSlug,
+      remaining: previous.remaining ?? ["card", "wrapper"],
     });
 
-    if (previous.sourceKey) {
+    if (previous.sourceKey && !CARDS_ONLY) {
       groupMeta.set(previous.sourceKey, {
         domain: previous.sourceDomain,
         slug: previous.articleSlug,
@@ -190,70 +749,376 @@ async function main() {
     }
   }
 
-  if (forceRebuild) {
+  const renames = CARDS_ONLY
+    ? []
+    : detectRenames(removedQuotes, manifestQuotes, nextManifestQuotes);
+  for (const { from, to } of renames) {
+    console.warn(
+      REDIRECT_ON_RENAME
+        ? `⚠️  Quote "${from}" looks renamed to "${to}"; redirecting its old page.`
+        : `⚠️  Quote "${from}" looks renamed to "${to}"; set REDIRECT_ON_RENAME to keep its old URL working.`,
+    );
+  }
+  // A forced build starts without a manifest but still owes earlier redirects.
+  const previousRedirects =
+    (manifest ?? (forceRebuild ? await loadManifest() : null))?.redirects ??
+    {};
+  // Redirect stubs are wrapper pages, which pages-only builds leave alone.
+  const redirects =
+    CARDS_ONLY || PAGES_ONLY
+      ? (manifest?.redirects ?? null)
+      : planRedirects(previousRedirects, renames, nextManifestQuotes);
+  // Stubs only link to their target, so one the last build already wrote
+  // with the same target and links is left as it is.
+  const redirectStubHash = hashArray([BASE_PATH, SITE_ORIGIN, WRAPPER_STYLE]);
+  const stubUnchanged = (previous, hash, key, target) =>
+    !forceRebuild && hash === redirectStubHash && previous?.[key] === target;
+
+  if (forceRebuild && !PAGES_ONLY) {
     await cleanOutputs();
   }
 
-  await Promise.all([
-    fs.mkdir(OUTPUT_CARD_DIR, { recursive: true }),
-    fs.mkdir(OUTPUT_WRAPPER_DIR, { recursive: true }),
-    fs.mkdir(OUTPUT_SOURCES_DIR, { recursive: true }),
-  ]);
+  await Promise.all(
+    CARDS_ONLY
+      ? [ensureDir(OUTPUT_CARD_DIR)]
+      : [
+          ensureDir(OUTPUT_CARD_DIR),
+          ensureDir(OUTPUT_WRAPPER_DIR),
+          ensureDir(OUTPUT_SOURCES_DIR),
+        ],
+  );
+
+  // Scaled copies from the previous build that the current CARD_SCALES no
+  // longer produces; every quote drops them, as with stale formats below.
+  const previousScales = manifest?.cardScales ?? [];
+  const staleScales = previousScales.filter(
+    (scale) => !CARD_SCALES.includes(scale),
+  );
+  // Likewise for a changed CARD_SHARDING, CARD_IMAGE_FORMAT, or
+  // CARD_JPEG_FALLBACK: cards written under the old layout are removed just
+  // before their replacements are rendered, which may reuse the same paths.
+  const previousFiles = {
+    sharding: manifest?.cardSharding ?? 0,
+    extension: manifest?.cardExtension ?? "jpg",
+    jpegFallback: manifest?.cardJpegFallback ?? false,
+  };
+  const filesChanged =
+    previousFiles.sharding !== CARD_FILES.sharding ||
+    previousFiles.extension !== CARD_FILES.extension ||
+    previousFiles.jpegFallback !== CARD_FILES.jpegFallback;
+  // Extra formats switched off since the last build lose their files.
+  const formatNames = CARD_FORMATS.map((format) => format.name);
+  const previousFormats = manifest?.cardFormats ?? [];
+  const staleFormats = previousFormats.filter(
+    (name) => !formatNames.includes(name),
+  );
 
-  const removalStats = await removeDeletedQuoteOutputs(removedQuotes);
+  const removalStats = await removeDeletedQuoteOutputs(
+    removedQuotes,
+    [...new Set([...previousScales, ...CARD_SCALES])],
+    [...new Set([...previousFormats, ...formatNames])],
+    previousFiles,
+  );
+  if (staleFormats.length && !PAGES_ONLY) {
+    for (const quote of quotes) {
+      await Promise.all(
+        staleFormats.map((name) =>
+          rmIfExists(cardFormatOutputPath(quote.id, name, previousFiles)),
+        ),
+      );
+    }
+  }
+  if (staleScales.length && !PAGES_ONLY) {
+    for (const quote of quotes) {
+      await Promise.all(
+        staleScales.map((scale) =>
+          rmIfExists(cardScalePath(quote.id, scale, previousFiles)),
+        ),
+      );
+    }
+  }
 
   let cardsRendered = 0;
   let wrappersRendered = 0;
   let sourcePagesRendered = 0;
   let sourcePagesRemoved = 0;
 
+  // Cards that blow CARD_TIMEOUT_MS keep their previous hash, so the next
+  // build tries them again.
+  let cardsTimedOut = 0;
+  let formatCardsTimedOut = 0;
+  const warnTimedOut = (quote, error, label) =>
+    console.warn(
+      `⚠️  ${quote.location}: the ${label} ${error.message}; skipped.`,
+    );
+  const keepScaleHashes = (quote, scales) => {
+    const entry = nextManifestQuotes[quote.id];
+    for (const scale of scales) {
+      entry.scaleHashes[scale] =
+        manifestQuotes[quote.id]?.scaleHashes?.[scale] ?? null;
+    }
+  };
+
+  const verifyFailures = [];
+  const writeScaledCards = async (quote, svg, layout, scales) => {
+    for (const scale of scales) {
+      const scaledPath = cardScalePath(quote.id, scale);
+      await writeOutputFile(scaledPath, rasterizeCard(svg, scale));
+      if (VERIFY_OUTPUT) {
+        const problem = await verifyCardFile(scaledPath, scale, layout);
+        if (problem) verifyFailures.push(`${quote.id}@${scale}x: ${problem}`);
+      }
+      dirtyScaleCards.get(scale).delete(quote.id);
+    }
+  };
+
+  // How each card rendered this build was laid out, for the outcome file.
+  const cardMetrics = {};
   for (const quote of quotes) {
     if (!dirtyCards.has(quote.id)) continue;
 
-    const svg = await renderQuoteSvg(quote, fonts);
-    const resvg = new Resvg(svg, {
-      fitTo: {
-        mode: "width",
-        value: CARD_WIDTH,
-      },
-    });
-    const renderResult = resvg.render();
-    const jpeg = encodeJpeg(
-      {
-        data: renderResult.pixels,
-        width: renderResult.width,
-        height: renderResult.height,
-      },
-      88,
-    );
-
-    const cardPath = path.join(OUTPUT_CARD_DIR, `${quote.id}.jpg`);
-    await fs.writeFile(cardPath, jpeg.data);
+    if (filesChanged) {
+      await removeCardFiles(
+        quote.id,
+        previousScales,
+        previousFormats,
+        previousFiles,
+      );
+    }
+
+    const layout = cardLayout(quote);
+    let svg;
+    let image;
+    try {
+      let details;
+      ({ image, ...details } = await renderCardWithin(
+        quote,
+        layout,
+        CARD_SCALE,
+        fonts,
+        cardImages,
+      ));
+      svg = details.svg;
+      cardMetrics[quote.id] = {
+        fontSize: details.fontSize,
+        lines: details.lines,
+        width: CARD_WIDTH * CARD_SCALE,
+        height: details.height * CARD_SCALE,
+        truncated: details.overflow === "truncated",
+      };
+      if (details.overflow) {
+        console.warn(
+          `⚠️  ${quote.location}: ${describeCardOverflow(details)}`,
+        );
+      } else if (details.fontSize <= QUOTE_FONT_MIN) {
+        console.warn(
+          `⚠️  ${quote.location}: the quote only just fits, at QUOTE_FONT_MIN (${QUOTE_FONT_MIN}px).`,
+        );
+      }
+    } catch (error) {
+      if (!(error instanceof CardTimeoutError)) throw error;
+      warnTimedOut(quote, error, "card");
+      cardsTimedOut += 1;
+      nextManifestQuotes[quote.id].cardHash =
+        manifestQuotes[quote.id]?.cardHash ?? null;
+      keepScaleHashes(quote, CARD_SCALES);
+      CARD_SCALES.forEach((scale) =>
+        dirtyScaleCards.get(scale).delete(quote.id),
+      );
+      continue;
+    }
+
+    await writeOutputFile(cardOutputPath(quote.id), image);
+    // Scrapers that skip WebP or SVG get this copy through og:image instead.
+    const fallbackImage = CARD_JPEG_FALLBACK
+      ? rasterizeCard(svg, CARD_SCALE, CARD_WIDTH, "jpeg")
+      : null;
+    if (fallbackImage) {
+      await writeOutputFile(cardFallbackOutputPath(quote.id), fallbackImage);
+    }
+    if (VERIFY_OUTPUT) {
+      const problem = await verifyCardFile(
+        cardOutputPath(quote.id),
+        CARD_SCALE,
+        layout,
+      );
+      if (problem) verifyFailures.push(`${quote.id}: ${problem}`);
+    }
+
+    await writeScaledCards(quote, svg, layout, CARD_SCALES);
+
+    // A fresh card refreshes its copy under q/; dirty wrappers sync theirs
+    // in the wrapper pass. Cards-only builds never touch q/.
+    if (CARD_UNDER_WRAPPER && !CARDS_ONLY && !dirtyWrappers.has(quote.id)) {
+      await writeOutputFile(
+        toOutputPath(wrapperCardPagePath(quote.id)),
+        fallbackImage ?? image,
+      );
+    }
     cardsRendered += 1;
   }
 
+  // Scales added since the last build, for cards that are otherwise clean:
+  // the SVG is laid out again, but the main card is not rewritten.
+  let scaledCardsRendered = 0;
   for (const quote of quotes) {
-    if (!dirtyWrappers.has(quote.id)) continue;
-
-    const wrapperHtml = applyTemplate(
-      wrapperTemplate,
-      buildWrapperPayload(quote, cardVersion),
+    const scales = CARD_SCALES.filter((scale) =>
+      dirtyScaleCards.get(scale).has(quote.id),
     );
-    const wrapperDir = path.join(OUTPUT_WRAPPER_DIR, quote.id);
-    await fs.mkdir(wrapperDir, { recursive: true });
-    await fs.writeFile(
-      path.join(wrapperDir, "index.html"),
-      wrapperHtml,
-      "utf8",
+    if (!scales.length) continue;
+
+    const layout = cardLayout(quote);
+    let svg;
+    try {
+      ({ svg } = await renderCardWithin(
+        quote,
+        layout,
+        CARD_SCALE,
+        fonts,
+        cardImages,
+      ));
+    } catch (error) {
+      if (!(error instanceof CardTimeoutError)) throw error;
+      warnTimedOut(quote, error, "scaled card");
+      cardsTimedOut += 1;
+      keepScaleHashes(quote, scales);
+      continue;
+    }
+    await writeScaledCards(quote, svg, layout, scales);
+    scaledCardsRendered += 1;
+  }
+
+  let formatCardsRendered = 0;
+  for (const format of CARD_FORMATS) {
+    const dirtyIds = dirtyFormatCards.get(format.name);
+    for (const quote of quotes) {
+      if (!dirtyIds.has(quote.id)) continue;
+
+      const target = cardFormatOutputPath(quote.id, format.name);
+      try {
+        const { image } = await renderCardWithin(
+          quote,
+          format,
+          formatScale(format),
+          fonts,
+          cardImages,
+        );
+        await writeOutputFile(target, image);
+      } catch (error) {
+        if (error instanceof CardTimeoutError) {
+          warnTimedOut(quote, error, `${format.name} card`);
+          formatCardsTimedOut += 1;
+          nextManifestQuotes[quote.id].formatHashes[format.name] =
+            manifestQuotes[quote.id]?.formatHashes?.[format.name] ?? null;
+          continue;
+        }
+        throw new Error(
+          `Failed to render the ${format.name} card for ${quote.id}: ${error.message}`,
+          { cause: error },
+        );
+      }
+      if (VERIFY_OUTPUT) {
+        const problem = await verifyCardFile(
+          target,
+          formatScale(format),
+          format,
+        );
+        if (problem) {
+          verifyFailures.push(`${quote.id} (${format.name}): ${problem}`);
+        }
+      }
+      formatCardsRendered += 1;
+    }
+  }
+
+  // Failing before the manifest is saved means the next build retries them.
+  if (verifyFailures.length) {
+    verifyFailures.forEach((msg) => console.error(`❌ ${msg}`));
+    throw new Error(
+      `${verifyFailures.length} card(s) failed verification after writing.`,
     );
+  }
+
+  for (const quote of quotes) {
+    if (!dirtyWrappers.has(quote.id)) continue;
+
+    const wrapperHtml = applyTemplate(wrapperTemplate, {
+      ...buildWrapperPayload(quote, cardVersion),
+      inline_css: inlineCss,
+      base_href: baseHref(),
+    });
+    const wrapperPath = toOutputPath(wrapperPagePath(quote.id));
+    await removeStaleWrapperForms(quote.id);
+    await writeOutputFile(wrapperPath, wrapperHtml);
+    await syncWrapperCard(quote.id, previousFiles);
+
+    const dataPath = toOutputPath(wrapperDataPath(quote.id));
+    if (EMIT_QUOTE_JSON) {
+      await writeOutputFile(dataPath, buildQuoteJson(quote, cardVersion));
+    } else {
+      await rmIfExists(dataPath);
+    }
     wrappersRendered += 1;
   }
 
+  // Stubs whose redirect was dropped go, unless the old id is a quote again
+  // and its real wrapper now lives there.
+  if (!CARDS_ONLY && !PAGES_ONLY) {
+    for (const id of Object.keys(previousRedirects)) {
+      if (redirects?.[id] || nextManifestQuotes[id]) continue;
+      await Promise.all(wrapperOutputPaths(id).map(rmIfExists));
+    }
+    for (const [from, to] of Object.entries(redirects ?? {})) {
+      if (
+        stubUnchanged(manifest?.redirects, manifest?.redirectsHash, from, to)
+      ) {
+        continue;
+      }
+      await removeStaleWrapperForms(from);
+      await writeOutputFile(
+        toOutputPath(wrapperPagePath(from)),
+        buildRedirectHtml(wrapperPagePath(to)),
+      );
+    }
+  }
+
   for (const group of sourceGroups.values()) {
     const getTime = (item) => (item.createdAt ? item.createdAt.getTime() : 0);
     group.quotes.sort((a, b) => getTime(b) - getTime(a));
   }
 
+  // Covers are tracked per source against exactly what they show, so only
+  // sources whose title, count, or newest quote changed are re-rendered.
+  const coverHashes = {};
+  let coversRendered = 0;
+  // Covers are images, so pages-only builds leave them for the next full one.
+  if (SOURCE_COVERS && !CARDS_ONLY && !PAGES_ONLY) {
+    for (const [groupKey, group] of sourceGroups) {
+      const cover = buildCoverContent(group);
+      const coverHash = hashArray([
+        cardRenderHash,
+        cover.title,
+        cover.count,
+        cover.sample,
+      ]);
+      coverHashes[groupKey] = coverHash;
+      if (!forceRebuild && manifest?.coverHashes?.[groupKey] === coverHash) {
+        continue;
+      }
+
+      const svg = await renderCoverSvg(cover, fonts, cardImages);
+      await writeOutputFile(
+        coverOutputPath(group.domain, group.slug),
+        rasterizeCard(svg, 1, CARD_WIDTH, "jpeg"),
+      );
+      coversRendered += 1;
+    }
+  } else if (!CARDS_ONLY && !PAGES_ONLY && manifest?.coverHashes) {
+    for (const group of sourceGroups.values()) {
+      await rmIfExists(coverOutputPath(group.domain, group.slug));
+    }
+  }
+
   for (const groupKey of dirtyGroups) {
     const meta = groupMeta.get(groupKey);
     if (!meta) continue;
@@ -265,25 +1130,125 @@ async function main() {
       continue;
     }
 
-    const quoteItems = group.quotes
-      .map((quote) => buildSourceQuoteHtml(quote))
-      .join("\n\n");
+    const sourceHtml = applyTemplate(
+      sourceTemplate,
+      buildSourcePayload(group, inlineCss),
+    );
 
-    const pageTitle = group.articleTitle
-      ? `${group.articleTitle} — ${group.domain}`
-      : `Quotes from ${group.domain}`;
+    await writeOutputFile(
+      path.join(sourceOutputDir(group.domain, group.slug), "index.html"),
+      sourceHtml,
+    );
+    sourcePagesRendered += 1;
+  }
 
-    const sourceHtml = applyTemplate(sourceTemplate, {
-      page_title: escapeHtml(pageTitle),
-      source_domain: escapeHtml(group.domain),
-      source_url: group.sourceUrl,
-      quote_items: quoteItems,
-    });
+  // Stubs at old source slugs go after the pages, since the page that used to
+  // live at an old slug is removed above. Dropped stubs are removed unless a
+  // real page has taken their place.
+  const sourceRedirects = CARDS_ONLY
+    ? (manifest?.sourceRedirects ?? null)
+    : planSourceRedirects(sourceGroups);
+  if (!CARDS_ONLY) {
+    for (const key of Object.keys(manifest?.sourceRedirects ?? {})) {
+      const [domain, slug] = key.split("/");
+      const groupKey = buildGroupKey({
+        sourceDomain: domain,
+        articleSlug: slug,
+      });
+      if (sourceRedirects[key] || sourceGroups.has(groupKey)) continue;
+      await removeSourceGroup({ domain, slug });
+    }
+    for (const [key, target] of Object.entries(sourceRedirects)) {
+      if (
+        stubUnchanged(
+          manifest?.sourceRedirects,
+          manifest?.sourceRedirectsHash,
+          key,
+          target,
+        )
+      ) {
+        continue;
+      }
+      const [domain, slug] = key.split("/");
+      const [targetDomain, targetSlug] = target.split("/");
+      await writeOutputFile(
+        path.join(sourceOutputDir(domain, slug), "index.html"),
+        buildRedirectHtml(sourcePagePath(targetDomain, targetSlug)),
+      );
+    }
+  }
 
-    const outputDir = path.join(OUTPUT_SOURCES_DIR, group.domain, group.slug);
-    await fs.mkdir(outputDir, { recursive: true });
-    await fs.writeFile(path.join(outputDir, "index.html"), sourceHtml, "utf8");
-    sourcePagesRendered += 1;
+  // The all-quotes page aggregates everything, so a single hash over every
+  // source item decides whether it needs rewriting.
+  let allPageHash = null;
+  let allPageRendered = false;
+  if (EMIT_ALL && !CARDS_ONLY) {
+    const orderedGroups = orderGroupsByDate(sourceGroups.values());
+    allPageHash = hashArray([
+      SOURCE_RENDER_VERSION,
+      hashString(allTemplate),
+      inlineCss,
+      orderedGroups.map((group) =>
+        group.quotes.map((quote) => nextManifestQuotes[quote.id].groupItemHash),
+      ),
+    ]);
+    if (forceRebuild || manifest?.allPageHash !== allPageHash) {
+      await writeOutputFile(
+        OUTPUT_ALL_PATH,
+        buildAllPageHtml(allTemplate, orderedGroups, inlineCss),
+      );
+      allPageRendered = true;
+    }
+  } else if (!CARDS_ONLY) {
+    await rmIfExists(OUTPUT_ALL_PATH);
+  }
+
+  if (EMIT_HEADERS && !CARDS_ONLY) {
+    await writeOutputFile(OUTPUT_HEADERS_PATH, buildHeadersFile());
+  } else if (!CARDS_ONLY) {
+    await rmIfExists(OUTPUT_HEADERS_PATH);
+  }
+
+  if (EMIT_LLMS_TXT && !CARDS_ONLY) {
+    await writeOutputFile(OUTPUT_LLMS_PATH, buildLlmsTxt(quotes));
+  } else if (!CARDS_ONLY) {
+    await rmIfExists(OUTPUT_LLMS_PATH);
+  }
+
+  if (EMIT_SEARCH_INDEX && !CARDS_ONLY) {
+    await writeOutputFile(OUTPUT_SEARCH_INDEX_PATH, buildSearchIndex(quotes));
+  } else if (!CARDS_ONLY) {
+    await rmIfExists(OUTPUT_SEARCH_INDEX_PATH);
+  }
+
+  if (EMIT_GRAPH_DOT && !CARDS_ONLY) {
+    await writeOutputFile(
+      OUTPUT_GRAPH_PATH,
+      buildGraphDot(sourceGroups.values()),
+    );
+  } else if (!CARDS_ONLY) {
+    await rmIfExists(OUTPUT_GRAPH_PATH);
+  }
+
+  // A deleted quote whose card or wrapper this build left in place keeps its
+  // entry, listing what is left, so the next build that owns those files
+  // still removes them. Hashes of files already gone are dropped, so the
+  // quote renders again if it comes back.
+  for (const item of removedQuotes) {
+    const remaining = PAGES_ONLY
+      ? item.remaining
+      : CARDS_ONLY
+        ? item.remaining.filter((output) => output !== "card")
+        : [];
+    if (!remaining.length) continue;
+    nextManifestQuotes[item.id] = {
+      ...manifestQuotes[item.id],
+      ...(remaining.includes("card")
+        ? {}
+        : { cardHash: null, formatHashes: null, scaleHashes: null }),
+      ...(remaining.includes("wrapper") ? {} : { wrapperHash: null }),
+      remaining,
+    };
   }
 
   const nextManifest = {
@@ -293,21 +1258,100 @@ async function main() {
     cardRenderVersion: CARD_RENDER_VERSION,
     cardRenderHash,
     fontsHash,
-    wrapperRenderVersion: WRAPPER_RENDER_VERSION,
-    wrapperTemplateHash,
-    sourceRenderVersion: SOURCE_RENDER_VERSION,
-    sourceTemplateHash,
+    cardsOnly: CARDS_ONLY,
+    wrapperRenderVersion: CARDS_ONLY ? null : WRAPPER_RENDER_VERSION,
+    wrapperTemplateHash: CARDS_ONLY ? null : wrapperTemplateHash,
+    sourceRenderVersion: CARDS_ONLY ? null : SOURCE_RENDER_VERSION,
+    sourceTemplateHash: CARDS_ONLY ? null : sourceTemplateHash,
+    allPageHash,
+    cardScales: CARD_SCALES,
+    cardSharding: CARD_SHARDING,
+    cardExtension: CARD_FILES.extension,
+    cardJpegFallback: CARD_FILES.jpegFallback,
+    cardFormats: formatNames,
+    coverHashes: SOURCE_COVERS && !CARDS_ONLY ? coverHashes : null,
+    redirects,
+    redirectsHash:
+      CARDS_ONLY || PAGES_ONLY
+        ? (manifest?.redirectsHash ?? null)
+        : redirectStubHash,
+    sourceRedirects,
+    sourceRedirectsHash: CARDS_ONLY
+      ? (manifest?.sourceRedirectsHash ?? null)
+      : redirectStubHash,
     quotes: nextManifestQuotes,
   };
+  if (PAGES_ONLY) {
+    for (const key of CARD_MANIFEST_KEYS) {
+      nextManifest[key] = manifest?.[key] ?? null;
+    }
+  }
 
+  await saveDeployPlan();
   await saveManifest(nextManifest);
 
-  const summaryParts = [
-    `✨ Processed ${quotes.length} quote(s).`,
-    `${cardsRendered} card(s) rendered`,
-    `${wrappersRendered} wrapper(s) updated`,
-    `${sourcePagesRendered} source page(s) updated`,
-  ];
+  if (explain) {
+    for (const [id, reasons] of Object.entries(explanations)) {
+      console.log(`🔍 ${id}: ${reasons.join("; ")}`);
+    }
+  }
+
+  if (outcomePath) {
+    await saveOutcome(
+      outcomePath,
+      buildOutcome({
+        quotes,
+        sourceGroups: CARDS_ONLY ? [] : sourceGroups.values(),
+        explanations: explain ? explanations : null,
+        cardMetrics,
+        cardsRendered,
+        wrappersRendered,
+        sourcePagesRendered,
+        cardsRemoved: removalStats.cardsRemoved,
+        wrappersRemoved: removalStats.wrappersRemoved,
+        sourcePagesRemoved,
+      }),
+    );
+  }
+
+  const summaryParts = [`✨ Processed ${quotes.length} quote(s).`];
+
+  if (PAGES_ONLY) {
+    summaryParts.push(`${sourcePagesRendered} source page(s) updated`);
+  } else if (CARDS_ONLY) {
+    summaryParts.push(`${cardsRendered} card(s) rendered`);
+  } else {
+    summaryParts.push(
+      `${cardsRendered} card(s) rendered`,
+      `${wrappersRendered} wrapper(s) updated`,
+      `${sourcePagesRendered} source page(s) updated`,
+    );
+  }
+
+  if (scaledCardsRendered) {
+    summaryParts.push(`${scaledCardsRendered} card(s) rendered at new scales`);
+  }
+  if (formatCardsRendered) {
+    summaryParts.push(`${formatCardsRendered} extra-format card(s) rendered`);
+  }
+
+  if (cardsTimedOut || formatCardsTimedOut) {
+    summaryParts.push(
+      `${cardsTimedOut + formatCardsTimedOut} card(s) timed out`,
+    );
+  }
+
+  if (coversRendered) {
+    summaryParts.push(`${coversRendered} cover(s) rendered`);
+  }
+
+  if (allPageRendered) {
+    summaryParts.push("all-quotes page updated");
+  }
+
+  if (REDIRECT_ON_RENAME && renames.length) {
+    summaryParts.push(`${renames.length} redirect(s) added`);
+  }
 
   if (
     removalStats.cardsRemoved ||
@@ -327,11 +1371,22 @@ async function main() {
     summaryParts.push(removals.join(", "));
   }
 
-  const skippedCards = quotes.length - cardsRendered;
-  if (skippedCards > 0) {
+  const skippedCards = quotes.length - cardsRendered - cardsTimedOut;
+  if (skippedCards > 0 && !PAGES_ONLY) {
     summaryParts.push(`${skippedCards} card(s) unchanged`);
   }
 
+  if (!CARDS_ONLY) {
+    const skippedWrappers = quotes.length - wrappersRendered;
+    const skippedSourcePages = sourceGroups.size - sourcePagesRendered;
+    if (skippedWrappers > 0 && !PAGES_ONLY) {
+      summaryParts.push(`${skippedWrappers} wrapper(s) unchanged`);
+    }
+    if (skippedSourcePages > 0) {
+      summaryParts.push(`${skippedSourcePages} source page(s) unchanged`);
+    }
+  }
+
   console.log(summaryParts.join(" "));
 }
 
@@ -339,6 +1394,10 @@ function parseArgs(argv) {
   let check = false;
   let cardVersion = null;
   let force = false;
+  let outcome = null;
+  let explain = false;
+  let plan = false;
+  let stdout = null;
 
   for (let i = 0; i < argv.length; i += 1) {
     const arg = argv[i];
@@ -354,6 +1413,16 @@ function parseArgs(argv) {
       continue;
     }
 
+    if (arg === "--explain") {
+      explain = true;
+      continue;
+    }
+
+    if (arg === "--plan") {
+      plan = true;
+      continue;
+    }
+
     if (arg.startsWith("--card-version=")) {
       const [, value] = arg.split("=", 2);
       cardVersion = normalizeCardVersion(value);
@@ -376,9 +1445,122 @@ function parseArgs(argv) {
       cardVersion = normalizeCardVersion(value);
       continue;
     }
+
+    if (arg.startsWith("--stdout=")) {
+      const [, value] = arg.split("=", 2);
+      stdout = stringOrNull(value);
+      continue;
+    }
+
+    if (arg.startsWith("--outcome=")) {
+      const [, value] = arg.split("=", 2);
+      outcome = stringOrNull(value);
+      continue;
+    }
+
+    if (arg === "--outcome") {
+      const value = argv[i + 1];
+      if (value && !value.startsWith("--")) {
+        outcome = stringOrNull(value);
+        i += 1;
+      }
+      continue;
+    }
   }
 
-  return { check, cardVersion, force };
+  return { check, cardVersion, force, outcome, explain, plan, stdout };
+}
+
+function validateCardSettings() {
+  if (CARD_WIDTH < 200 || CARD_HEIGHT < 200) {
+    throw new Error(
+      `CARD_WIDTH and CARD_HEIGHT must be at least 200px, got ${CARD_WIDTH}×${CARD_HEIGHT}.`,
+    );
+  }
+  if (
+    CARD_PADDING.left + CARD_PADDING.right >= CARD_WIDTH ||
+    CARD_PADDING.top + CARD_PADDING.bottom >= CARD_HEIGHT
+  ) {
+    throw new Error("Card padding leaves no room for the quote.");
+  }
+  if (QUOTE_FONT_MIN <= 0 || QUOTE_FONT_MAX < QUOTE_FONT_MIN) {
+    throw new Error(
+      `QUOTE_FONT_MIN must be positive and no larger than QUOTE_FONT_MAX (got ${QUOTE_FONT_MIN} and ${QUOTE_FONT_MAX}).`,
+    );
+  }
+  if (FONT_SIZE_STEP <= 0 || QUOTE_LINE_HEIGHT <= 0) {
+    throw new Error("FONT_SIZE_STEP and QUOTE_LINE_HEIGHT must be positive.");
+  }
+  if (
+    CARD_LOGO_MARGIN < 0 ||
+    !(CARD_LOGO_OPACITY > 0 && CARD_LOGO_OPACITY <= 1)
+  ) {
+    throw new Error(
+      "CARD_LOGO_MARGIN must be non-negative and CARD_LOGO_OPACITY between 0 and 1.",
+    );
+  }
+  if (CARD_LOGO && CARD_QR && CARD_LOGO_POSITION === CARD_QR_POSITION) {
+    throw new Error(
+      `CARD_LOGO cannot share the ${CARD_QR_POSITION} corner with CARD_QR; set CARD_LOGO_POSITION or CARD_QR_POSITION.`,
+    );
+  }
+  if (CARD_MAX_HEIGHT !== null && CARD_MAX_HEIGHT < CARD_HEIGHT) {
+    throw new Error(
+      `CARD_MAX_HEIGHT must be at least CARD_HEIGHT (${CARD_HEIGHT}px), got ${CARD_MAX_HEIGHT}.`,
+    );
+  }
+  if (
+    QUOTE_FONT_TARGET < QUOTE_FONT_MIN ||
+    QUOTE_FONT_TARGET > QUOTE_FONT_MAX
+  ) {
+    throw new Error(
+      `QUOTE_FONT_TARGET must be between QUOTE_FONT_MIN and QUOTE_FONT_MAX (got ${QUOTE_FONT_TARGET}).`,
+    );
+  }
+  if (CARD_BACKGROUND_OVERLAY && !CARD_BACKGROUND_IMAGE) {
+    throw new Error("CARD_BACKGROUND_OVERLAY needs CARD_BACKGROUND_IMAGE.");
+  }
+  if (CARD_TRANSPARENT && CARD_GRADIENT) {
+    throw new Error("CARD_TRANSPARENT and CARD_GRADIENT cannot be combined.");
+  }
+  if (
+    CARD_TRANSPARENT &&
+    (CARD_IMAGE_FORMAT === "jpeg" || CARD_JPEG_FALLBACK)
+  ) {
+    throw new Error(
+      "CARD_TRANSPARENT needs CARD_IMAGE_FORMAT=png, or webp without CARD_JPEG_FALLBACK; JPEG cards and copies cannot be transparent.",
+    );
+  }
+  if (CARD_JPEG_FALLBACK && !["webp", "svg"].includes(CARD_IMAGE_FORMAT)) {
+    throw new Error(
+      "CARD_JPEG_FALLBACK only applies to CARD_IMAGE_FORMAT=webp.",
+    );
+  }
+  if (CARD_IMAGE_FORMAT === "svg" && (CARD_SCALES.length || CARD_SCALE > 1)) {
+    throw new Error(
+      "CARD_SCALE and CARD_SCALES have no use with CARD_IMAGE_FORMAT=svg.",
+    );
+  }
+  if (CARD_SCALES.some((scale) => scale <= CARD_SCALE)) {
+    throw new Error(
+      `CARD_SCALES entries must be larger than CARD_SCALE (${CARD_SCALE}); a copy at or below it is no sharper than the card itself.`,
+    );
+  }
+  if (PRINT_CARD_SIZE && (PRINT_CARD_DPI < 1 || PRINT_CARD_DPI > 1200)) {
+    throw new Error(
+      `Invalid PRINT_CARD_DPI "${PRINT_CARD_DPI}". Use a whole number from 1 to 1200.`,
+    );
+  }
+  if (PRINT_CARD_SIZE) {
+    const pixelWidth = Math.round(PRINT_CARD_SIZE.width * PRINT_CARD_DPI);
+    const pixelHeight = Math.round(PRINT_CARD_SIZE.height * PRINT_CARD_DPI);
+    const largest = Math.max(pixelWidth, pixelHeight);
+    if (Math.min(pixelWidth, pixelHeight) < 1 || largest > PRINT_MAX_PIXELS) {
+      throw new Error(
+        `PRINT_CARD_SIZE "${process.env.PRINT_CARD_SIZE}" at ${PRINT_CARD_DPI} DPI is ${pixelWidth}×${pixelHeight} pixels; each side must be from 1 to ${PRINT_MAX_PIXELS}. Adjust the size or PRINT_CARD_DPI.`,
+      );
+    }
+  }
 }
 
 function envToBoolean(value) {
@@ -392,58 +1574,172 @@ function envToBoolean(value) {
   );
 }
 
-function buildGroupKey(quote) {
-  return `${quote.sourceDomain}__${quote.articleSlug}`;
+function envToInteger(value, fallback) {
+  if (value === undefined || value === null) return fallback;
+  const trimmed = String(value).trim();
+  if (!trimmed) return fallback;
+  const parsed = Number.parseInt(trimmed, 10);
+  return Number.isFinite(parsed) ? parsed : fallback;
 }
 
-function buildQuoteManifestEntry(quote, groupKey, cardVersion) {
-  return {
-    cardHash: buildCardHash(quote),
+function envToNumber(value, fallback) {
+  if (value === undefined || value === null) return fallback;
+  const trimmed = String(value).trim();
+  if (!trimmed) return fallback;
+  const parsed = Number(trimmed);
+  return Number.isFinite(parsed) ? parsed : fallback;
+}
+
+function parseFileMode(name, value) {
+  if (value === undefined || value === null) return null;
+  const trimmed = String(value).trim();
+  if (!trimmed) return null;
+  if (!/^0?o?[0-7]{3,4}$/i.test(trimmed)) {
+    throw new Error(
+      `${name} must be an octal mode such as 0644, got "${value}".`,
+    );
+  }
+  return Number.parseInt(trimmed.replace(/^0?o/i, ""), 8);
+}
+
+function buildGroupKey(quote) {
+  return `${quote.sourceDomain}__${quote.articleSlug}`;
+}
+
+function buildQuoteManifestEntry(quote, groupKey, cardVersion) {
+  return {
+    cardHash: buildCardHash(quote),
+    formatHashes: buildFormatHashes(quote),
+    scaleHashes: buildScaleHashes(quote),
     wrapperHash: buildWrapperHash(quote, cardVersion),
     groupItemHash: buildGroupItemHash(quote),
     sourceKey: groupKey,
     sourceDomain: quote.sourceDomain,
     articleSlug: quote.articleSlug,
+    contentHash: buildContentHash(quote),
   };
 }
 
+// What a reader would recognise a quote by, without its id; a removed id whose
+// content reappears under a new id is treated as a rename.
+function buildContentHash(quote) {
+  return hashArray([quote.quote, quote.name || "", quote.displayUrl || ""]);
+}
+
+// Only what renderQuoteSvg draws for this quote; the title and tags (and the
+// author, unless CARD_AUTHOR) appear on pages, not cards, so they live in the
+// wrapper and group hashes. Card-wide settings are covered by cardRenderHash.
 function buildCardHash(quote) {
   return hashArray([
     CARD_RENDER_VERSION,
-    quote.quote,
-    quote.name || "",
-    quote.tags ? [...quote.tags].sort().join("|") : "",
+    cardText(quote),
+    cardQrUrl(quote) ?? "",
+    cardAuthorLine(quote) ?? "",
+    cardFooterText(quote) ?? "",
+    quote.theme ?? "",
+    cardBackground(quote) ?? "",
+    quote.raw,
+    quoteDirection(quote),
   ]);
 }
 
+// One hash per enabled extra format: the card's own hash plus the format's
+// geometry. Card-wide settings still dirty every format via cardRenderHash.
+function buildFormatHashes(quote) {
+  if (!CARD_FORMATS.length) return null;
+  const cardHash = buildCardHash(quote);
+  return Object.fromEntries(
+    CARD_FORMATS.map((format) => [
+      format.name,
+      hashArray([
+        cardHash,
+        format.width,
+        format.height,
+        format.padding,
+        // Only the print card has a scale; the others keep their old hashes.
+        ...(format.scale ? [format.scale] : []),
+      ]),
+    ]),
+  );
+}
+
+// One hash per CARD_SCALES entry, so a new scale renders only its copies.
+// A scaled copy is redrawn whenever the card it comes from is.
+function buildScaleHashes(quote) {
+  if (!CARD_SCALES.length) return null;
+  const cardHash = buildCardHash(quote);
+  return Object.fromEntries(
+    CARD_SCALES.map((scale) => [scale, hashArray([cardHash, scale])]),
+  );
+}
+
 function buildWrapperHash(quote, cardVersion) {
   return hashArray([
     WRAPPER_RENDER_VERSION,
     BASE_PATH,
+    EMIT_BASE_HREF,
     SITE_ORIGIN,
+    CARD_UNDER_WRAPPER,
+    PARSE_EMPHASIS ? EMPHASIS_PATTERN.source : null,
+    WRAPPER_STYLE,
+    CARD_WIDTH,
+    CARD_HEIGHT,
+    CARD_MAX_HEIGHT === null ? null : [CARD_MAX_HEIGHT, QUOTE_FONT_TARGET],
+    DESCRIPTION_PATTERN ?? "",
+    quote.seriesNav ? JSON.stringify(quote.seriesNav) : "",
+    quote.ogImage || "",
+    EMIT_QUOTE_JSON,
+    // Only the data.json sidecar shows these.
+    EMIT_QUOTE_JSON
+      ? [
+          quote.articleSlug || "",
+          quote.createdAt ? quote.createdAt.toISOString() : "",
+          quote.tags,
+        ]
+      : null,
+    CARD_SCALE,
+    CARD_SCALES,
+    CARD_FILES,
     cardVersion ?? "",
     quote.quote,
     quote.name || "",
     quote.articleTitle || "",
-    quote.url || "",
+    quote.displayUrl || "",
     quote.sourceDomain || "",
+    quote.sourceName || "",
+    quote.frontMatter,
+    QUOTE_STYLE,
+    quote.raw,
+    quoteDirection(quote),
   ]);
 }
 
 function buildGroupItemHash(quote) {
   return hashArray([
     SOURCE_RENDER_VERSION,
+    MERGE_SOURCE_ITEMS,
     BASE_PATH,
+    EMIT_BASE_HREF,
+    SOURCE_COVERS ? [SITE_ORIGIN, CARD_WIDTH, CARD_HEIGHT] : null,
+    PARSE_EMPHASIS ? EMPHASIS_PATTERN.source : null,
+    CARD_FILES,
+    CARD_FORMATS.map((format) => format.name),
+    WRAPPER_STYLE,
+    QUOTE_STYLE,
     quote.id,
     quote.quote,
     quote.name || "",
     quote.bodyHtml || "",
-    quote.url || "",
+    quote.displayUrl || "",
     quote.articleTitle || "",
     quote.sourceDomain || "",
+    quote.sourceName || "",
     quote.articleSlug || "",
     quote.createdAt ? quote.createdAt.toISOString() : "",
-    quote.tags ? [...quote.tags].sort().join("|") : "",
+    quote.tags,
+    quote.hideFromSource,
+    quote.raw,
+    quoteDirection(quote),
   ]);
 }
 
@@ -476,36 +1772,586 @@ async function loadManifest() {
   }
 }
 
+// Leaves the file untouched when only `generatedAt` would change, so tools
+// diffing the manifest (including the CI commit step) see no change.
 async function saveManifest(manifest) {
+  const previous = await loadManifest().catch(() => null);
+  if (manifestsEqual(previous, manifest)) return;
+
   const payload = `${JSON.stringify(manifest, null, 2)}\n`;
-  await fs.writeFile(MANIFEST_PATH, payload, "utf8");
+  try {
+    await rotateManifestBackups(MANIFEST_BACKUPS);
+    await writeOutputFile(MANIFEST_PATH, payload);
+  } catch (error) {
+    if (error && MANIFEST_WRITE_ERRORS[error.code]) {
+      throw new ManifestSaveError(MANIFEST_PATH, error);
+    }
+    throw error;
+  }
+}
+
+// Compares two manifests ignoring `generatedAt` and key order.
+function manifestsEqual(a, b) {
+  if (!a || !b) return a === b;
+  const strip = ({ generatedAt, ...rest }) => rest;
+  return canonicalJson(strip(a)) === canonicalJson(strip(b));
+}
+
+function canonicalJson(value) {
+  if (Array.isArray(value)) {
+    return `[${value.map(canonicalJson).join(",")}]`;
+  }
+  if (value && typeof value === "object") {
+    const entries = Object.keys(value)
+      .filter((key) => value[key] !== undefined)
+      .sort()
+      .map((key) => `${JSON.stringify(key)}:${canonicalJson(value[key])}`);
+    return `{${entries.join(",")}}`;
+  }
+  return JSON.stringify(value ?? null);
+}
+
+const MANIFEST_WRITE_ERRORS = {
+  EACCES: "permission denied",
+  EPERM: "operation not permitted",
+  EROFS: "read-only file system",
+  ENOSPC: "no space left on device",
+  EDQUOT: "disk quota exceeded",
+};
+
+// Raised when the manifest cannot be written for environmental reasons, so
+// the message names the file instead of a bare errno from deep in fs.
+class ManifestSaveError extends Error {
+  constructor(target, cause) {
+    const relative = path.relative(ROOT_DIR, target) || target;
+    super(
+      `Cannot write build manifest ${relative}: ${MANIFEST_WRITE_ERRORS[cause.code]} (${cause.code}).`,
+      { cause },
+    );
+    this.name = "ManifestSaveError";
+    this.path = target;
+    this.code = cause.code;
+  }
+}
+
+// A card that took longer than CARD_TIMEOUT_MS to render.
+class CardTimeoutError extends Error {
+  constructor() {
+    super(`took longer than CARD_TIMEOUT_MS (${CARD_TIMEOUT_MS}ms)`);
+    this.name = "CardTimeoutError";
+  }
+}
+
+// A card's SVG, layout details (see renderQuoteSvgDetailed), and image at
+// `scale`.
+async function renderCardImage(quote, fonts, layout, images, scale) {
+  const details = await renderQuoteSvgDetailed(quote, fonts, layout, images);
+  return {
+    ...details,
+    image: rasterizeCard(details.svg, scale, layout.width),
+  };
+}
+
+// The worker thread rendering cards under CARD_TIMEOUT_MS, started with the
+// first card and replaced after one is cut off.
+let cardWorker = null;
+
+// renderCardImage under CARD_TIMEOUT_MS. Satori and resvg work without
+// yielding, so a timer on this thread could only fire once a stuck render
+// had finished; the card is rendered in a worker instead, which is
+// terminated at the deadline.
+async function renderCardWithin(quote, layout, scale, fonts, images) {
+  if (!CARD_TIMEOUT_MS) {
+    return renderCardImage(quote, fonts, layout, images, scale);
+  }
+
+  cardWorker ??= startCardWorker(fonts, images);
+  const { worker, ready } = cardWorker;
+  await ready;
+  worker.ref();
+  let timer;
+  let onMessage;
+  let onError;
+  try {
+    return await new Promise((resolve, reject) => {
+      onMessage = ({ result, error }) => {
+        if (error) {
+          reject(new Error(error));
+          return;
+        }
+        resolve({ ...result, image: Buffer.from(result.image) });
+      };
+      onError = reject;
+      worker.on("message", onMessage);
+      worker.on("error", onError);
+      timer = setTimeout(() => {
+        cardWorker = null;
+        worker.terminate();
+        reject(new CardTimeoutError());
+      }, CARD_TIMEOUT_MS);
+      worker.postMessage({ quote, layout, scale });
+    });
+  } finally {
+    clearTimeout(timer);
+    worker.off("message", onMessage);
+    worker.off("error", onError);
+    // An idle worker must not keep the build running.
+    worker.unref();
+  }
+}
+
+function startCardWorker(fonts, images) {
+  const worker = new Worker(path.join(__dirname, "card-worker.mjs"), {
+    workerData: { fonts, images },
+  });
+  const ready = new Promise((resolve, reject) => {
+    worker.once("message", resolve);
+    worker.once("error", reject);
+  });
+  return { worker, ready };
+}
+
+// Shifts <manifest>.1 → .2 … up to `count`, then copies the current manifest
+// to .1 so a bad write can be recovered by hand. The primary file is copied
+// rather than moved so it stays readable if the build dies mid-write.
+async function rotateManifestBackups(count) {
+  if (count <= 0) return;
+
+  try {
+    await fs.access(MANIFEST_PATH);
+  } catch (error) {
+    if (error && error.code === "ENOENT") return;
+    throw error;
+  }
+
+  await rmIfExists(`${MANIFEST_PATH}.${count}`);
+  for (let index = count - 1; index >= 1; index -= 1) {
+    try {
+      await fs.rename(
+        `${MANIFEST_PATH}.${index}`,
+        `${MANIFEST_PATH}.${index + 1}`,
+      );
+    } catch (error) {
+      if (!error || error.code !== "ENOENT") throw error;
+    }
+  }
+  await fs.copyFile(MANIFEST_PATH, `${MANIFEST_PATH}.1`);
 }
 
 async function removeManifestFile() {
   await fs.rm(MANIFEST_PATH, { force: true }).catch(() => {});
 }
 
-async function removeDeletedQuoteOutputs(removedQuotes) {
+function buildOutcome({
+  quotes,
+  sourceGroups,
+  cardsRendered = 0,
+  wrappersRendered = 0,
+  sourcePagesRendered = 0,
+  cardsRemoved = 0,
+  wrappersRemoved = 0,
+  sourcePagesRemoved = 0,
+  explanations = null,
+  cardMetrics = {},
+}) {
+  const sources = summarizeSourceGroups(sourceGroups);
+  const wrapperCount = CARDS_ONLY ? 0 : quotes.length;
+  // Skipped counts are outputs left as-is, i.e. cache hits.
+  const outcome = {
+    quotes: quotes.length,
+    cardsRendered,
+    wrappersRendered,
+    sourcePagesRendered,
+    cardsSkipped: Math.max(0, quotes.length - cardsRendered),
+    wrappersSkipped: Math.max(0, wrapperCount - wrappersRendered),
+    sourcePagesSkipped: Math.max(0, sources.length - sourcePagesRendered),
+    cardsRemoved,
+    wrappersRemoved,
+    sourcePagesRemoved,
+    sources,
+    cardMetrics,
+  };
+  if (explanations) {
+    outcome.explain = explanations;
+  }
+  return outcome;
+}
+
+// Labels each output a quote rebuilds with the first condition that made it
+// dirty, mirroring the checks in main().
+function explainDirtyQuote({
+  flags,
+  previous,
+  entry,
+  groupKey,
+  cardDirty,
+  wrapperDirty,
+  groupDirty,
+}) {
+  const reasons = [];
+  const label = (kind, checks) => {
+    if (flags.buildReason) {
+      reasons.push(`${kind}: ${flags.buildReason}`);
+      return;
+    }
+    const match = checks.find(([condition]) => condition);
+    if (match) reasons.push(`${kind}: ${match[1]}`);
+  };
+
+  if (cardDirty) {
+    label("card", [
+      [flags.cardRenderChanged, "render settings changed"],
+      [!previous, "new quote"],
+      [previous?.cardHash !== entry.cardHash, "hash changed"],
+    ]);
+  }
+  if (wrapperDirty) {
+    label("wrapper", [
+      [flags.wrapperRenderChanged, "render version changed"],
+      [flags.wrapperTemplateChanged, "template changed"],
+      [flags.cardVersionChanged, "card version changed"],
+      [!previous, "new quote"],
+      [previous?.wrapperHash !== entry.wrapperHash, "hash changed"],
+    ]);
+  }
+  if (groupDirty) {
+    label("source", [
+      [flags.sourceRenderChanged, "render version changed"],
+      [flags.sourceTemplateChanged, "template changed"],
+      [!previous, "new quote"],
+      [previous?.sourceKey !== groupKey, "moved to another source"],
+      [previous?.groupItemHash !== entry.groupItemHash, "hash changed"],
+    ]);
+  }
+
+  return reasons;
+}
+
+function summarizeSourceGroups(groups) {
+  return [...groups]
+    .map((group) => ({
+      domain: group.domain,
+      slug: group.slug,
+      title: group.articleTitle || null,
+      sourceUrl: group.sourceUrl,
+      quoteIds: group.quotes.map((quote) => quote.id),
+      count: group.quotes.length,
+    }))
+    .sort(
+      (a, b) =>
+        compareStrings(a.domain, b.domain) || compareStrings(a.slug, b.slug),
+    );
+}
+
+function compareStrings(a, b) {
+  if (a === b) return 0;
+  return a < b ? -1 : 1;
+}
+
+async function saveOutcome(outcomePath, outcome) {
+  const target = path.resolve(ROOT_DIR, outcomePath);
+  await writeOutputFile(target, `${JSON.stringify(outcome, null, 2)}\n`);
+}
+
+async function removeDeletedQuoteOutputs(
+  removedQuotes,
+  scales,
+  formats,
+  files,
+) {
   if (!removedQuotes.length) {
     return { cardsRemoved: 0, wrappersRemoved: 0 };
   }
 
+  // Pages-only builds leave cards and wrappers to the next full build, and
+  // files an earlier partial build already removed are not counted again.
+  let cardsRemoved = 0;
+  let wrappersRemoved = 0;
   for (const item of removedQuotes) {
-    const cardPath = path.join(OUTPUT_CARD_DIR, `${item.id}.jpg`);
-    const wrapperDir = path.join(OUTPUT_WRAPPER_DIR, item.id);
-    await Promise.all([rmIfExists(cardPath), rmIfExists(wrapperDir)]);
+    if (!PAGES_ONLY && item.remaining.includes("card")) {
+      await removeCardFiles(item.id, scales, formats, files);
+      cardsRemoved += 1;
+    }
+    if (!CARDS_ONLY && !PAGES_ONLY && item.remaining.includes("wrapper")) {
+      await Promise.all(wrapperOutputPaths(item.id).map(rmIfExists));
+      wrappersRemoved += 1;
+    }
   }
 
-  return {
-    cardsRemoved: removedQuotes.length,
-    wrappersRemoved: removedQuotes.length,
-  };
+  return { cardsRemoved, wrappersRemoved };
+}
+
+// Pairs each removed id with the one new id carrying the same content. Entries
+// from manifests older than contentHash never match.
+function detectRenames(removedQuotes, previousQuotes, nextQuotes) {
+  const added = new Map();
+  for (const [id, entry] of Object.entries(nextQuotes)) {
+    if (previousQuotes[id] || !entry.contentHash) continue;
+    // Two new ids with the same content leave the match ambiguous.
+    added.set(entry.contentHash, added.has(entry.contentHash) ? null : id);
+  }
+
+  const renames = [];
+  for (const { id } of removedQuotes) {
+    const to = added.get(previousQuotes[id].contentHash);
+    if (to) renames.push({ from: id, to });
+  }
+  return renames;
+}
+
+// Old id -> current id for every redirect stub the build keeps. Earlier
+// redirects follow their target through a further rename and lapse once it is
+// removed or the old id is used again; without REDIRECT_ON_RENAME there are
+// none.
+function planRedirects(previousRedirects, renames, nextQuotes) {
+  if (!REDIRECT_ON_RENAME) return null;
+
+  const renamed = new Map(renames.map(({ from, to }) => [from, to]));
+  const redirects = {};
+  for (const [from, to] of Object.entries(previousRedirects)) {
+    const target = renamed.get(to) ?? to;
+    if (!nextQuotes[from] && nextQuotes[target]) redirects[from] = target;
+  }
+  for (const { from, to } of renames) {
+    redirects[from] = to;
+  }
+  return redirects;
+}
+
+// "<domain>/<old slug>" -> "<domain>/<slug>" for every old_slugs entry of a
+// listed quote. Slugs a current source page uses are skipped, and a slug
+// claimed by two pages goes to the first with a warning.
+function planSourceRedirects(sourceGroups) {
+  const redirects = {};
+  for (const [groupKey, group] of sourceGroups) {
+    for (const quote of group.quotes) {
+      for (const slug of quote.oldSlugs) {
+        const oldKey = buildGroupKey({
+          sourceDomain: group.domain,
+          articleSlug: slug,
+        });
+        if (oldKey === groupKey || sourceGroups.has(oldKey)) continue;
+
+        const key = `${group.domain}/${slug}`;
+        const target = `${group.domain}/${group.slug}`;
+        if (redirects[key] && redirects[key] !== target) {
+          console.warn(
+            `⚠️  ${quote.location}: old slug "${slug}" already redirects to ${redirects[key]}; ignoring it.`,
+          );
+          continue;
+        }
+        redirects[key] = target;
+      }
+    }
+  }
+  return redirects;
+}
+
+// Lists every file a full build of `quotes` writes, relative to the repo root
+// and sorted, without rendering anything. Shares the path helpers with the
+// build itself so the two cannot drift apart.
+async function planOutputs(quotes, outcomePath) {
+  const targets = new Set();
+
+  if (quotes.length) {
+    for (const quote of quotes) {
+      if (!PAGES_ONLY) planQuoteFiles(quote, targets);
+      if (CARDS_ONLY || quote.hideFromSource) continue;
+      targets.add(
+        path.join(
+          sourceOutputDir(quote.sourceDomain, quote.articleSlug),
+          "index.html",
+        ),
+      );
+      if (SOURCE_COVERS && !PAGES_ONLY) {
+        targets.add(coverOutputPath(quote.sourceDomain, quote.articleSlug));
+      }
+    }
+    if (EMIT_ALL && !CARDS_ONLY) {
+      targets.add(OUTPUT_ALL_PATH);
+    }
+    if (EMIT_HEADERS && !CARDS_ONLY) {
+      targets.add(OUTPUT_HEADERS_PATH);
+    }
+    if (EMIT_LLMS_TXT && !CARDS_ONLY) {
+      targets.add(OUTPUT_LLMS_PATH);
+    }
+    if (EMIT_SEARCH_INDEX && !CARDS_ONLY) {
+      targets.add(OUTPUT_SEARCH_INDEX_PATH);
+    }
+    if (EMIT_GRAPH_DOT && !CARDS_ONLY) {
+      targets.add(OUTPUT_GRAPH_PATH);
+    }
+    (await plannedManifestBackups()).forEach((file) => targets.add(file));
+    targets.add(MANIFEST_PATH);
+  }
+
+  if (EMIT_DEPLOY_PLAN) {
+    targets.add(OUTPUT_DEPLOY_PLAN_PATH);
+  }
+  if (outcomePath) {
+    targets.add(path.resolve(ROOT_DIR, outcomePath));
+  }
+
+  return [...targets]
+    .map((target) => path.relative(ROOT_DIR, target).split(path.sep).join("/"))
+    .sort(compareStrings);
+}
+
+// A quote's own files: its card with every copy, and unless CARDS_ONLY, its
+// wrapper page.
+function planQuoteFiles(quote, targets) {
+  targets.add(cardOutputPath(quote.id));
+  if (CARD_JPEG_FALLBACK) targets.add(cardFallbackOutputPath(quote.id));
+  CARD_SCALES.forEach((scale) => {
+    targets.add(cardScalePath(quote.id, scale));
+  });
+  CARD_FORMATS.forEach((format) => {
+    targets.add(cardFormatOutputPath(quote.id, format.name));
+  });
+  if (CARDS_ONLY) return;
+  if (CARD_UNDER_WRAPPER) {
+    targets.add(toOutputPath(wrapperCardPagePath(quote.id)));
+  }
+  targets.add(toOutputPath(wrapperPagePath(quote.id)));
+  if (EMIT_QUOTE_JSON) {
+    targets.add(toOutputPath(wrapperDataPath(quote.id)));
+  }
+}
+
+// Mirrors rotateManifestBackups: .1 is always written, and each later slot
+// only if the one below it currently exists.
+async function plannedManifestBackups() {
+  const backups = [];
+  if (MANIFEST_BACKUPS <= 0 || !(await pathExists(MANIFEST_PATH))) {
+    return backups;
+  }
+
+  for (let index = 1; index <= MANIFEST_BACKUPS; index += 1) {
+    if (index > 1 && !(await pathExists(`${MANIFEST_PATH}.${index - 1}`))) {
+      break;
+    }
+    backups.push(`${MANIFEST_PATH}.${index}`);
+  }
+  return backups;
+}
+
+// With CARD_SHARDING, cards live under the first N hex digits of the id's
+// hash (cards/3f/<id>.jpg) so no single directory grows too large.
+function cardSitePath(id, scale = 1, files = CARD_FILES) {
+  const suffix = scale > 1 ? `@${scale}x` : "";
+  return `/cards/${cardShard(id, files)}${id}${suffix}.${files.extension}`;
+}
+
+function cardFormatSitePath(id, name, files = CARD_FILES) {
+  return `/cards/${cardShard(id, files)}${id}-${name}.${files.extension}`;
+}
+
+function cardShard(id, { sharding }) {
+  return sharding ? `${hashString(id).slice(0, sharding)}/` : "";
+}
+
+// The JPEG copy CARD_JPEG_FALLBACK writes beside each card.
+function cardFallbackSitePath(id, files = CARD_FILES) {
+  return cardSitePath(id, 1, { ...files, extension: IMAGE_EXTENSIONS.jpeg });
+}
+
+function cardFallbackOutputPath(id, files = CARD_FILES) {
+  return toOutputPath(cardFallbackSitePath(id, files));
+}
+
+function cardFormatOutputPath(id, name, files = CARD_FILES) {
+  return toOutputPath(cardFormatSitePath(id, name, files));
+}
+
+function cardOutputPath(id, files = CARD_FILES) {
+  return toOutputPath(cardSitePath(id, 1, files));
+}
+
+function cardScalePath(id, scale, files = CARD_FILES) {
+  return toOutputPath(cardSitePath(id, scale, files));
+}
+
+// Removes a card with its scaled copies and extra formats as laid out under
+// `files`, then any shard directory left empty.
+async function removeCardFiles(id, scales, formats, files) {
+  const cardPath = cardOutputPath(id, files);
+  await Promise.all([
+    rmIfExists(cardPath),
+    ...scales.map((scale) => rmIfExists(cardScalePath(id, scale, files))),
+    ...formats.map((name) => rmIfExists(cardFormatOutputPath(id, name, files))),
+    ...(files.jpegFallback
+      ? [rmIfExists(cardFallbackOutputPath(id, files))]
+      : []),
+  ]);
+  if (files.sharding) {
+    await removeEmptyParents(path.dirname(cardPath), OUTPUT_CARD_DIR);
+  }
+}
+
+function sourceOutputDir(domain, slug) {
+  return path.join(OUTPUT_SOURCES_DIR, domain, slug);
+}
+
+function sourcePagePath(domain, slug) {
+  return `/sources/${domain}/${slug}/`;
+}
+
+function coverSitePath(domain, slug) {
+  return `/sources/${domain}/${slug}/cover.jpg`;
+}
+
+function coverOutputPath(domain, slug) {
+  return toOutputPath(coverSitePath(domain, slug));
+}
+
+// Every file or directory a wrapper may occupy under either WRAPPER_STYLE.
+function wrapperOutputPaths(id) {
+  return [
+    path.join(OUTPUT_WRAPPER_DIR, id),
+    path.join(OUTPUT_WRAPPER_DIR, `${id}.html`),
+    ...Object.values(IMAGE_EXTENSIONS).map((extension) =>
+      path.join(OUTPUT_WRAPPER_DIR, `${id}.${extension}`),
+    ),
+    path.join(OUTPUT_WRAPPER_DIR, `${id}.json`),
+  ];
+}
+
+// Puts the CARD_UNDER_WRAPPER copy of the card, as already written to cards/,
+// where the wrapper expects it, or removes it when the option is off. The
+// copy only duplicates the card's bytes, so toggling the option dirties the
+// wrappers rather than the cards. A card that timed out has nothing to copy.
+async function syncWrapperCard(id, previousFiles) {
+  const wrapperCardPath = toOutputPath(wrapperCardPagePath(id));
+  const previousCardPath = toOutputPath(
+    wrapperCardPagePath(id, previousFiles),
+  );
+  if (previousCardPath !== wrapperCardPath) {
+    await rmIfExists(previousCardPath);
+  }
+  if (!CARD_UNDER_WRAPPER) {
+    await rmIfExists(wrapperCardPath);
+    return;
+  }
+  const card = CARD_JPEG_FALLBACK
+    ? cardFallbackOutputPath(id)
+    : cardOutputPath(id);
+  if (await pathExists(card)) {
+    await writeOutputFile(wrapperCardPath, await fs.readFile(card));
+  }
+}
+
+// Clears whatever the other WRAPPER_STYLE left behind for this quote.
+async function removeStaleWrapperForms(id) {
+  const [directory, ...flatFiles] = wrapperOutputPaths(id);
+  const stale = WRAPPER_STYLE === "flat" ? [directory] : flatFiles;
+  await Promise.all(stale.map(rmIfExists));
 }
 
 async function removeSourceGroup(meta) {
   if (!meta) return 0;
 
-  const dir = path.join(OUTPUT_SOURCES_DIR, meta.domain, meta.slug);
+  const dir = sourceOutputDir(meta.domain, meta.slug);
   try {
     await fs.access(dir);
   } catch (error) {
@@ -516,14 +2362,40 @@ async function removeSourceGroup(meta) {
   }
 
   await rmIfExists(dir);
+  await removeEmptyParents(path.dirname(dir), OUTPUT_SOURCES_DIR);
   return 1;
 }
 
-async function loadQuotes() {
+// Deletes `dir` and its ancestors while they are empty, stopping at the first
+// non-empty one or at `stopAt`, which is never removed itself.
+async function removeEmptyParents(dir, stopAt) {
+  let current = path.resolve(dir);
+  const boundary = path.resolve(stopAt);
+
+  while (current.startsWith(`${boundary}${path.sep}`)) {
+    let entries;
+    try {
+      entries = await fs.readdir(current);
+    } catch (error) {
+      if (error && error.code === "ENOENT") {
+        current = path.dirname(current);
+        continue;
+      }
+      throw error;
+    }
+    if (entries.length) return;
+
+    await fs.rmdir(current);
+    current = path.dirname(current);
+  }
+}
+
+async function loadQuotes(transliterate = null) {
   const entries = await fg(["**/*.md"], {
     cwd: QUOTES_DIR,
     onlyFiles: true,
     dot: false,
+    ignore: ["**/*.body.md"],
   });
 
   const idSet = new Set();
@@ -531,31 +2403,117 @@ async function loadQuotes() {
   const warnings = [];
   const errors = [];
   const quotes = [];
+  const pendingIds = [];
 
   for (const relativePath of entries) {
     const filePath = path.join(QUOTES_DIR, relativePath);
     const raw = await fs.readFile(filePath, "utf8");
     const parsed = matter(raw.trim());
     const data = parsed.data ?? {};
-    const body = parsed.content?.trim() ?? "";
+    let body = parsed.content?.trim() ?? "";
 
     const id = stringOrNull(data.id);
     const quote = stringOrNull(data.quote);
+    const rawQuote = typeof data.quote === "string" ? data.quote : quote;
     const name = stringOrNull(data.name);
     const url = stringOrNull(data.url);
     const articleTitle = stringOrNull(data.article_title) || null;
-    const sourceDomain = stringOrNull(data.source_domain) || null;
+    const sourceDomain = normalizeSourceDomain(data.source_domain);
+    const sourceName = stringOrNull(data.source_name);
     const createdAt = parseDate(data.created_at);
-    const tags = Array.isArray(data.tags) ? data.tags.map(String) : [];
+    const series = stringOrNull(data.series);
+    const hideFromSource = envToBoolean(data.hide_from_source);
+    const isRaw = envToBoolean(data.raw);
+    // An empty `series_part:` is no part at all, not part 0.
+    const seriesPartInput = stringOrNull(data.series_part);
+    const seriesPart =
+      seriesPartInput !== null && Number.isFinite(Number(seriesPartInput))
+        ? Number(seriesPartInput)
+        : null;
 
     const location = path.relative(ROOT_DIR, filePath);
+    const tags = normalizeTags(data.tags, location, warnings);
+    // Earlier slugs of this quote's source page, each redirected to the
+    // current one.
+    const oldSlugs = (
+      Array.isArray(data.old_slugs) ? data.old_slugs : [data.old_slugs]
+    )
+      .map(stringOrNull)
+      .filter(Boolean);
     const fileErrors = [];
 
-    if (!id) fileErrors.push(`${location}: missing required field "id".`);
+    let theme = stringOrNull(data.theme)?.toLowerCase() ?? null;
+    if (theme && !Object.hasOwn(CARD_THEMES, theme)) {
+      warnings.push(
+        `${location}: unknown theme "${data.theme}"; using the default "${CARD_THEME}".`,
+      );
+      theme = null;
+    }
+
+    let dir = stringOrNull(data.dir)?.toLowerCase() ?? null;
+    if (dir && !TEXT_DIRECTIONS.includes(dir)) {
+      warnings.push(
+        `${location}: unknown dir "${data.dir}"; using TEXT_DIRECTION "${TEXT_DIRECTION}".`,
+      );
+      dir = null;
+    }
+
+    // YAML reads an unquoted "#…" as a comment, so this is usually quoted.
+    let cardBg = null;
+    const cardBgInput = stringOrNull(data.card_bg);
+    if (cardBgInput) {
+      const rgb = parseHexColor(cardBgInput);
+      if (rgb) {
+        cardBg = formatHexColor(rgb);
+      } else {
+        warnings.push(
+          `${location}: card_bg "${cardBgInput}" is not a hex color like "#102030"; using the theme background.`,
+        );
+      }
+    }
+
+    let ogImage = stringOrNull(data.og_image);
+    if (ogImage && !isPlausibleImageRef(ogImage)) {
+      warnings.push(
+        `${location}: og_image "${ogImage}" is not an http(s) URL or site path; using the generated card.`,
+      );
+      ogImage = null;
+    }
+
+    if (!id && !(AUTO_ID && quote)) {
+      fileErrors.push(`${location}: missing required field "id".`);
+    }
     if (!quote) fileErrors.push(`${location}: missing required field "quote".`);
-    if (!name) fileErrors.push(`${location}: missing required field "name".`);
+    if (!name && ALLOW_ANONYMOUS) {
+      warnings.push(`${location}: no "name"; building it as anonymous.`);
+    } else if (!name) {
+      fileErrors.push(`${location}: missing required field "name".`);
+    }
     if (!url) fileErrors.push(`${location}: missing required field "url".`);
 
+    const bodyFile = stringOrNull(data.body_file);
+    if (bodyFile) {
+      const bodyPath = path.resolve(path.dirname(filePath), bodyFile);
+      // The body is published as page HTML, so it must come from quotes/.
+      const fromQuotes = path.relative(QUOTES_DIR, bodyPath);
+      if (
+        fromQuotes === ".." ||
+        fromQuotes.startsWith(`..${path.sep}`) ||
+        path.isAbsolute(fromQuotes)
+      ) {
+        fileErrors.push(
+          `${location}: body_file "${bodyFile}" is outside the quotes directory.`,
+        );
+      } else {
+        try {
+          body = (await fs.readFile(bodyPath, "utf8")).trim();
+        } catch (error) {
+          if (!error || error.code !== "ENOENT") throw error;
+          fileErrors.push(`${location}: body_file "${bodyFile}" not found.`);
+        }
+      }
+    }
+
     if (id) {
       if (idSet.has(id)) {
         fileErrors.push(`${location}: duplicate id "${id}".`);
@@ -566,13 +2524,8 @@ async function loadQuotes() {
 
     let normalizedUrl = null;
     if (url) {
-      try {
-        const urlObj = new URL(url);
-        urlObj.hash = "";
-        normalizedUrl = urlObj.toString().replace(/\/$/, "");
-      } catch (err) {
-        fileErrors.push(`${location}: invalid url "${url}".`);
-      }
+      normalizedUrl = normalizeQuoteUrl(url);
+      if (!normalizedUrl) fileErrors.push(`${location}: invalid url "${url}".`);
     }
 
     const inferredDomain = (() => {
@@ -586,40 +2539,97 @@ async function loadQuotes() {
       warnings.push(`${location}: could not determine source domain.`);
     }
 
-    const articleSlug = normalizedUrl ? buildArticleSlug(normalizedUrl) : null;
+    const articleSlug = normalizedUrl
+      ? buildArticleSlug(normalizedUrl, transliterate)
+      : null;
     if (!articleSlug) {
       warnings.push(`${location}: could not determine article slug.`);
     }
 
+    // ids, domains, and slugs become path segments under the output dirs.
+    for (const [field, value] of [
+      ["id", id],
+      ["source domain", domain],
+      ["article slug", articleSlug],
+      ...oldSlugs.map((slug) => ["old slug", slug]),
+    ]) {
+      if (value && !isSafeSegment(value)) {
+        fileErrors.push(
+          `${location}: ${field} "${value}" is not a safe path segment.`,
+        );
+      }
+    }
+
     if (normalizedUrl) {
       const bucket = urlSet.get(normalizedUrl) || [];
       bucket.push(id || location);
       urlSet.set(normalizedUrl, bucket);
     }
 
-    const bodyHtml = body ? marked(body) : "";
-
     if (fileErrors.length) {
       errors.push(...fileErrors);
       continue;
     }
 
-    quotes.push({
+    const record = {
       id,
       quote,
+      rawQuote,
       name,
-      url,
+      displayUrl: url,
       normalizedUrl,
       articleTitle,
-      sourceDomain: domain || "unknown-source",
+      sourceDomain: domain || UNKNOWN_SOURCE_DOMAIN,
+      sourceName,
       articleSlug: articleSlug || "index",
+      oldSlugs,
       createdAt,
       tags,
-      bodyHtml,
+      series,
+      seriesPart,
+      seriesNav: null,
+      ogImage,
+      theme,
+      dir,
+      cardBg,
+      raw: isRaw,
+      hideFromSource,
+      // The whole front matter, custom keys included, with dates as ISO
+      // strings so it serializes the way it reads.
+      frontMatter: CAPTURE_FRONT_MATTER
+        ? JSON.parse(JSON.stringify(data))
+        : null,
+      bodyHtml: body ? marked(body) : "",
       location,
-    });
+    };
+    quotes.push(record);
+
+    if (!id) {
+      pendingIds.push({ record, base: deriveQuoteId(quote, url) });
+    }
+  }
+
+  // Derived ids are assigned after every explicit id is known so a derived id
+  // never steals one that a later file declares.
+  pendingIds.sort((a, b) =>
+    compareStrings(a.record.location, b.record.location),
+  );
+  for (const { record, base } of pendingIds) {
+    let candidate = base;
+    for (let suffix = 2; idSet.has(candidate); suffix += 1) {
+      candidate = `${base}-${suffix}`;
+    }
+    idSet.add(candidate);
+    record.id = candidate;
+    warnings.push(
+      `${record.location}: missing "id"; using derived id "${candidate}".`,
+    );
   }
 
+  const included = excludeQuotes(quotes, warnings);
+
+  linkSeries(included, warnings);
+
   for (const [pageUrl, ids] of urlSet.entries()) {
     if (ids.length > 1) {
       warnings.push(
@@ -628,72 +2638,340 @@ async function loadQuotes() {
     }
   }
 
-  return { quotes, warnings, errors };
-}
-
-async function cleanOutputs() {
-  await Promise.all([
-    rmIfExists(OUTPUT_CARD_DIR),
-    rmIfExists(OUTPUT_WRAPPER_DIR),
-    rmIfExists(OUTPUT_SOURCES_DIR),
-  ]);
-}
+  // Unrelated quotes without a domain all share sources/unknown-source/, which
+  // is almost always a bad url rather than intent.
+  const unknownSourceIds = included
+    .filter((quote) => quote.sourceDomain === UNKNOWN_SOURCE_DOMAIN)
+    .map((quote) => quote.id);
+  if (unknownSourceIds.length > 1) {
+    warnings.push(
+      `${unknownSourceIds.length} quotes have no source domain and are grouped under "${UNKNOWN_SOURCE_DOMAIN}": ${unknownSourceIds.join(", ")}. Give each an http(s) url or set source_domain.`,
+    );
+  }
 
-async function rmIfExists(targetPath) {
-  await fs.rm(targetPath, { recursive: true, force: true }).catch(() => {});
+  return { quotes: included, warnings, errors };
 }
 
-async function loadFonts() {
-  const requiredFonts = [
-    { file: "AtkinsonHyperlegible-Regular.ttf", weight: 400 },
-    { file: "AtkinsonHyperlegible-Bold.ttf", weight: 700 },
-  ];
+// Drops quotes listed in EXCLUDE_IDS so their outputs are removed like those
+// of deleted files. Done before series linking so neighbours skip them.
+function excludeQuotes(quotes, warnings) {
+  if (!EXCLUDE_IDS.size) return quotes;
 
-  const loaded = [];
+  const found = new Set();
+  const kept = quotes.filter((quote) => {
+    if (!EXCLUDE_IDS.has(quote.id)) return true;
+    found.add(quote.id);
+    return false;
+  });
 
-  for (const font of requiredFonts) {
-    const fullPath = path.join(FONT_DIR, font.file);
-    let fontData;
-    try {
-      fontData = await fs.readFile(fullPath);
-    } catch (err) {
-      throw new Error(
-        `Font file missing: ${font.file}. Add it to assets/fonts.`,
-      );
+  for (const id of EXCLUDE_IDS) {
+    if (!found.has(id)) {
+      warnings.push(`EXCLUDE_IDS: no quote has id "${id}".`);
     }
-
-    loaded.push({
-      name: "Atkinson Hyperlegible",
-      data: fontData,
-      weight: font.weight,
-      style: "normal",
-    });
+  }
+  if (found.size) {
+    warnings.push(`Excluding ${found.size} quote(s): ${[...found].join(", ")}`);
   }
 
-  return loaded;
+  return kept;
+}
+
+// Orders quotes sharing a `series` by `series_part` (then date) and records
+// each quote's neighbours for the wrapper page navigation.
+function linkSeries(quotes, warnings) {
+  const seriesMap = new Map();
+  for (const quote of quotes) {
+    if (!quote.series) continue;
+    const members = seriesMap.get(quote.series) || [];
+    members.push(quote);
+    seriesMap.set(quote.series, members);
+  }
+
+  const getTime = (item) => (item.createdAt ? item.createdAt.getTime() : 0);
+  for (const [series, members] of seriesMap) {
+    members.sort(
+      (a, b) =>
+        (a.seriesPart ?? Infinity) - (b.seriesPart ?? Infinity) ||
+        getTime(a) - getTime(b) ||
+        compareStrings(a.id, b.id),
+    );
+
+    const seenParts = new Map();
+    for (const quote of members) {
+      if (quote.seriesPart === null) continue;
+      const other = seenParts.get(quote.seriesPart);
+      if (other) {
+        warnings.push(
+          `Series "${series}" has more than one part ${quote.seriesPart}: ${other.id}, ${quote.id}`,
+        );
+      } else {
+        seenParts.set(quote.seriesPart, quote);
+      }
+    }
+
+    members.forEach((quote, index) => {
+      quote.seriesNav = {
+        name: series,
+        position: index + 1,
+        total: members.length,
+        prevId: index > 0 ? members[index - 1].id : null,
+        nextId: index < members.length - 1 ? members[index + 1].id : null,
+      };
+    });
+  }
+}
+
+async function cleanOutputs() {
+  if (CARDS_ONLY) {
+    await rmIfExists(OUTPUT_CARD_DIR);
+    return;
+  }
+
+  await Promise.all([
+    rmIfExists(OUTPUT_CARD_DIR),
+    rmIfExists(OUTPUT_WRAPPER_DIR),
+    rmIfExists(OUTPUT_SOURCES_DIR),
+    rmIfExists(OUTPUT_ALL_PATH),
+    rmIfExists(OUTPUT_HEADERS_PATH),
+    rmIfExists(OUTPUT_LLMS_PATH),
+    rmIfExists(OUTPUT_SEARCH_INDEX_PATH),
+    rmIfExists(OUTPUT_GRAPH_PATH),
+  ]);
+}
+
+// Writes a generated file, creating its directory first. FILE_MODE/DIR_MODE
+// are applied explicitly when set; otherwise the process umask decides.
+async function writeOutputFile(target, data) {
+  const unchanged = deployChanges && (await fileHasContents(target, data));
+  await ensureDir(path.dirname(target));
+  await fs.writeFile(target, data);
+  if (FILE_MODE !== null) {
+    await fs.chmod(target, FILE_MODE);
+  }
+  if (deployChanges && !unchanged) {
+    deployChanges.delete.delete(target);
+    deployChanges.upload.add(target);
+  }
+}
+
+async function fileHasContents(target, data) {
+  try {
+    return (await fs.readFile(target)).equals(Buffer.from(data));
+  } catch (error) {
+    if (error?.code === "ENOENT") return false;
+    throw error;
+  }
+}
+
+async function ensureDir(dir) {
+  const created = await fs.mkdir(dir, { recursive: true });
+  if (DIR_MODE === null || !created) return;
+
+  // mkdir reports the first directory it created; cover that one and every
+  // one under it, leaving directories that already existed alone.
+  let current = path.resolve(dir);
+  const first = path.resolve(created);
+  while (current.startsWith(`${first}${path.sep}`) || current === first) {
+    await fs.chmod(current, DIR_MODE);
+    current = path.dirname(current);
+  }
+}
+
+async function rmIfExists(targetPath) {
+  if (deployChanges) {
+    for (const file of await listExistingFiles(targetPath)) {
+      deployChanges.upload.delete(file);
+      deployChanges.delete.add(file);
+    }
+  }
+  await fs.rm(targetPath, { recursive: true, force: true }).catch(() => {});
+}
+
+// The files at or under `targetPath`, which may be a file, a directory, or
+// missing.
+async function listExistingFiles(targetPath) {
+  let stats;
+  try {
+    stats = await fs.stat(targetPath);
+  } catch (error) {
+    if (error?.code === "ENOENT") return [];
+    throw error;
+  }
+  if (!stats.isDirectory()) return [targetPath];
+  const files = await fg("**/*", { cwd: targetPath, dot: true });
+  return files.map((file) => path.join(targetPath, file));
+}
+
+// Writes what this build uploaded and deleted, as repo-relative paths, for
+// sync tooling that would otherwise compare the whole output tree. Without
+// EMIT_DEPLOY_PLAN a plan left from an earlier build is removed.
+async function saveDeployPlan() {
+  if (!deployChanges) {
+    await rmIfExists(OUTPUT_DEPLOY_PLAN_PATH);
+    return;
+  }
+  const toRelative = (files) =>
+    [...files]
+      .map((file) => path.relative(ROOT_DIR, file).split(path.sep).join("/"))
+      .sort(compareStrings);
+  const plan = {
+    upload: toRelative(deployChanges.upload),
+    delete: toRelative(deployChanges.delete),
+  };
+  await writeOutputFile(
+    OUTPUT_DEPLOY_PLAN_PATH,
+    `${JSON.stringify(plan, null, 2)}\n`,
+  );
+}
+
+async function pathExists(targetPath) {
+  try {
+    await fs.access(targetPath);
+    return true;
+  } catch (error) {
+    if (error && error.code === "ENOENT") return false;
+    throw error;
+  }
+}
+
+// Reads the INLINE_CSS stylesheet for the pages' <style> slot. A stray
+// "</style" would end the block early, so it is escaped.
+async function loadInlineCss(cssPath) {
+  if (!cssPath) return "";
+  let css;
+  try {
+    css = await fs.readFile(path.resolve(ROOT_DIR, cssPath), "utf8");
+  } catch (error) {
+    if (error?.code !== "ENOENT") throw error;
+    throw new Error(`INLINE_CSS file not found: ${cssPath}`);
+  }
+  return css.trim().replace(/<\/style/gi, "<\\/style");
+}
+
+// The images drawn on every card, read once per build.
+async function loadCardImages() {
+  const [background, logo] = await Promise.all([
+    loadCardImage("CARD_BACKGROUND_IMAGE", CARD_BACKGROUND_IMAGE),
+    loadCardImage("CARD_LOGO", CARD_LOGO),
+  ]);
+  return { background, logo };
+}
+
+// A PNG or JPEG as a data URI for Satori plus its pixel size, or null when the
+// setting is unset.
+async function loadCardImage(name, imagePath) {
+  if (!imagePath) return null;
+  let data;
+  try {
+    data = await fs.readFile(path.resolve(ROOT_DIR, imagePath));
+  } catch (error) {
+    if (error?.code !== "ENOENT") throw error;
+    throw new Error(`${name} file not found: ${imagePath}`);
+  }
+
+  const pngSize = readPngSize(data);
+  const size = pngSize ?? readJpegSize(data);
+  if (!size) {
+    throw new Error(`${name} must be a PNG or JPEG: ${imagePath}`);
+  }
+  const mimeType = pngSize ? "image/png" : "image/jpeg";
+  return {
+    uri: `data:${mimeType};base64,${data.toString("base64")}`,
+    ...size,
+  };
+}
+
+async function loadFonts() {
+  const loaded = [];
+
+  for (const font of FONT_FACES) {
+    const fullPath = path.join(FONT_DIR, font.file);
+    let fontData;
+    try {
+      fontData = await fs.readFile(fullPath);
+    } catch (err) {
+      if (err?.code !== "ENOENT") {
+        throw new Error(`Could not read font ${font.file}: ${err.message}`, {
+          cause: err,
+        });
+      }
+      if (font.optional) continue;
+      throw new Error(
+        `Font file missing: ${font.file}. Add it to assets/fonts.`,
+      );
+    }
+    // Satori only fails on a bad font once it lays text out, with an error
+    // that does not name the file, so the header is checked up front.
+    if (!isFontData(fontData)) {
+      throw new Error(
+        `Font file ${font.file} is not a TrueType, OpenType, or WOFF font.`,
+      );
+    }
+
+    loaded.push({
+      name: font.family ?? "Atkinson Hyperlegible",
+      data: fontData,
+      weight: font.weight,
+      style: font.style,
+    });
+  }
+
+  return loaded;
+}
+
+// TrueType, OpenType (CFF), Apple TrueType, and WOFF headers. WOFF2 is left
+// out because satori cannot read it.
+function isFontData(data) {
+  if (data.length < 12) return false;
+  const tag = data.readUInt32BE(0);
+  return [0x00010000, 0x4f54544f, 0x74727565, 0x774f4646].includes(tag);
 }
 
 function buildWrapperPayload(quote, cardVersion) {
   const sourceDomain = quote.sourceDomain || "original-source";
-  const articleTitle = quote.articleTitle || sourceDomain;
+  // The publication's name, when given, reads better than its hostname.
+  const sourceLabel = quote.sourceName || sourceDomain;
+  const articleTitle = quote.articleTitle || sourceLabel;
   const hasAuthor = Boolean(quote.name);
 
+  // "From Title. by Name" reads badly, so the title loses its closing
+  // punctuation inside descriptions (the page title keeps it).
+  const describedTitle = quote.articleTitle
+    ? stripClosingPunctuation(quote.articleTitle)
+    : "";
+
   let description;
-  if (quote.articleTitle) {
+  if (DESCRIPTION_PATTERN) {
+    description = formatDescription(DESCRIPTION_PATTERN, {
+      author: quote.name || "",
+      article: describedTitle,
+      domain: sourceDomain,
+      source: sourceLabel,
+    });
+  } else if (describedTitle) {
     description = hasAuthor
-      ? `From ${quote.articleTitle} by ${quote.name}`
-      : `From ${quote.articleTitle} on ${sourceDomain}`;
+      ? `From ${describedTitle} by ${quote.name}`
+      : `From ${describedTitle} on ${sourceLabel}`;
   } else {
     description = hasAuthor
-      ? `${quote.name} on ${sourceDomain}`
-      : `Collected from ${sourceDomain}`;
+      ? `${quote.name} on ${sourceLabel}`
+      : `Collected from ${sourceLabel}`;
   }
-
-  const cardPath = `/cards/${quote.id}.jpg`;
-  const versionSuffix = cardVersion
-    ? `?v=${encodeURIComponent(cardVersion)}`
-    : "";
-  const ogImage = absoluteUrl(`${cardPath}${versionSuffix}`);
+  description = description.replace(/\.+$/, "");
+
+  const cardPath = cardSitePath(quote.id);
+  const versionSuffix = cardVersionSuffix(cardVersion);
+  let ogImagePath = cardPath;
+  if (CARD_UNDER_WRAPPER) {
+    ogImagePath = wrapperCardPagePath(quote.id);
+  } else if (CARD_JPEG_FALLBACK) {
+    ogImagePath = cardFallbackSitePath(quote.id);
+  }
+  // A per-quote og_image only replaces the social preview; card_url still
+  // points at the generated card. Its size is unknown, so no dimensions.
+  const ogImage = quote.ogImage
+    ? resolveImageRef(quote.ogImage)
+    : absoluteUrl(`${ogImagePath}${versionSuffix}`);
 
   return {
     page_title: escapeHtml(articleTitle),
@@ -701,35 +2979,412 @@ function buildWrapperPayload(quote, cardVersion) {
     og_title: escapeHtml(articleTitle),
     og_description: escapeHtml(description),
     og_image: escapeHtml(ogImage),
-    canonical_url: quote.url,
-    source_url: quote.url,
-    quote_text: escapeHtml(quote.quote),
+    og_image_width: quote.ogImage ? "" : String(CARD_WIDTH * CARD_SCALE),
+    og_image_height: quote.ogImage
+      ? ""
+      : String(cardLayout(quote).height * CARD_SCALE),
+    canonical_url: quote.displayUrl,
+    source_url: quote.displayUrl,
+    quote_text: formatQuoteHtml(quote.quote),
+    quote_open: quoteMarks(quote)[0],
+    quote_close: quoteMarks(quote)[1],
+    quote_dir: quoteDirection(quote),
     quote_author: hasAuthor ? escapeHtml(quote.name) : "",
     article_title: quote.articleTitle ? escapeHtml(quote.articleTitle) : "",
     card_url: escapeHtml(publicPath(cardPath)),
+    card_srcset: escapeHtml(buildCardSrcset(quote.id, versionSuffix)),
+    card_width: String(CARD_WIDTH),
+    card_height: String(cardLayout(quote).height),
+    series_nav: buildSeriesNavHtml(quote.seriesNav),
+    ...frontMatterFields(quote.frontMatter),
+  };
+}
+
+// "fm_<key>" template fields for the scalar front-matter values captured with
+// CAPTURE_FRONT_MATTER, escaped like every other field. Lists, maps, and keys
+// a template placeholder cannot name are left out.
+function frontMatterFields(frontMatter) {
+  if (!frontMatter) return {};
+  const fields = {};
+  for (const [key, value] of Object.entries(frontMatter)) {
+    if (!/^\w+$/.test(key)) continue;
+    if (!["string", "number", "boolean"].includes(typeof value)) continue;
+    // false stays empty so a {{#fm_key}} section treats it as off.
+    fields[`fm_${key}`] = value === false ? "" : escapeHtml(String(value));
+  }
+  return fields;
+}
+
+function stripClosingPunctuation(text) {
+  return text.replace(/[\s.!?…]+$/u, "");
+}
+
+// "<card> 1x, <card@2x> 2x, …" for the wrapper's <img>, or "" when no extra
+// scales are rendered.
+function buildCardSrcset(id, versionSuffix) {
+  if (!CARD_SCALES.length) return "";
+  const entries = [
+    `${publicPath(cardSitePath(id))}${versionSuffix} ${CARD_SCALE}x`,
+  ];
+  for (const scale of CARD_SCALES) {
+    const scaled = publicPath(cardSitePath(id, scale));
+    entries.push(`${scaled}${versionSuffix} ${scale}x`);
+  }
+  return entries.join(", ");
+}
+
+function cardVersionSuffix(cardVersion) {
+  return cardVersion ? `?v=${encodeURIComponent(cardVersion)}` : "";
+}
+
+// Structured data for one quote, written next to its wrapper so a frontend
+// can fetch a single quote without an index.
+function buildQuoteJson(quote, cardVersion) {
+  const data = {
+    id: quote.id,
+    quote: quote.quote,
+    author: quote.name,
+    url: quote.displayUrl,
+    articleTitle: quote.articleTitle,
+    sourceDomain: quote.sourceDomain,
+    sourceName: quote.sourceName,
+    articleSlug: quote.articleSlug,
+    createdAt: quote.createdAt ? quote.createdAt.toISOString() : null,
+    tags: quote.tags,
+    series: quote.seriesNav
+      ? { name: quote.seriesNav.name, part: quote.seriesNav.position }
+      : null,
+    pageUrl: absoluteUrl(wrapperPagePath(quote.id)),
+    cardUrl: absoluteUrl(
+      `${cardSitePath(quote.id)}${cardVersionSuffix(cardVersion)}`,
+    ),
+    ...(quote.frontMatter ? { frontMatter: quote.frontMatter } : {}),
+  };
+  return `${JSON.stringify(data, null, 2)}\n`;
+}
+
+// Accepts absolute http(s) URLs and scheme-less site paths.
+function isPlausibleImageRef(value) {
+  if (/^https?:\/\//i.test(value)) {
+    try {
+      new URL(value);
+      return true;
+    } catch (error) {
+      return false;
+    }
+  }
+  return (
+    !/\s/.test(value) &&
+    !value.startsWith("//") &&
+    !/^[a-z][a-z0-9+.-]*:/i.test(value)
+  );
+}
+
+function resolveImageRef(value) {
+  if (/^https?:\/\//i.test(value)) return value;
+  return absoluteUrl(value.startsWith("/") ? value : `/${value}`);
+}
+
+// Netlify / Cloudflare Pages `_headers` rules. Card URLs keep their name when
+// a quote is edited (only CARD_VERSION busts them), so they get a moderate
+// lifetime; HTML is revalidated quickly so edits show up.
+function buildHeadersFile() {
+  const cards = "public, max-age=86400";
+  const html = "public, max-age=300, must-revalidate";
+  const rules = [
+    ["/cards/*", cards],
+    ["/q/*", html],
+    ["/sources/*", html],
+  ];
+  if (EMIT_ALL) {
+    rules.push(["/all.html", html]);
+  }
+
+  return `${rules
+    .map(([pattern, value]) => `${pattern}\n  Cache-Control: ${value}`)
+    .join("\n\n")}\n`;
+}
+
+// An llms.txt (https://llmstxt.org) index: every wrapper page, newest first,
+// as a Markdown link titled like the page with a short excerpt of the quote.
+function buildLlmsTxt(quotes) {
+  const ordered = orderQuotesByDate(quotes);
+  const sourceCount = new Set(ordered.map((quote) => quote.sourceDomain)).size;
+  const inline = (text) => String(text).replace(/\s+/g, " ").trim();
+  const linkText = (text) => inline(text).replace(/([[\]])/g, "\\$1");
+
+  const lines = [
+    "# Quotes",
+    "",
+    `> ${ordered.length} quote(s) from ${sourceCount} source(s), each with a share page and card image.`,
+    "",
+    "## Quotes",
+    "",
+  ];
+  for (const quote of ordered) {
+    const title = quote.articleTitle || quote.sourceName || quote.sourceDomain;
+    const excerpt = truncateText(inline(quote.quote), LLMS_EXCERPT_MAX_CHARS);
+    const byline = quote.name ? ` — ${inline(quote.name)}` : "";
+    const url = absoluteUrl(wrapperPagePath(quote.id));
+    const [open, close] = quoteMarks(quote);
+    lines.push(
+      `- [${linkText(title)}](${url}): ${open}${excerpt}${close}${byline}`,
+    );
+  }
+  return `${lines.join("\n")}\n`;
+}
+
+// search-index.json for client-side search libraries such as lunr or
+// MiniSearch: one flat document per quote, newest first, holding the fields
+// worth indexing and the site path of its wrapper page.
+function buildSearchIndex(quotes) {
+  const documents = orderQuotesByDate(quotes).map((quote) => ({
+    id: quote.id,
+    url: publicPath(wrapperPagePath(quote.id)),
+    quote: quote.quote,
+    author: quote.name,
+    title: quote.articleTitle,
+    source: quote.sourceName || quote.sourceDomain,
+    tags: quote.tags,
+  }));
+  return `${JSON.stringify({ version: 1, documents })}\n`;
+}
+
+// graph.dot for Graphviz: a node per source domain, one per article under it,
+// and an edge between them labelled with the article's quote count. Domains
+// and articles are sorted so an unchanged collection gives the same file.
+function buildGraphDot(groups) {
+  const quoted = (value) =>
+    `"${String(value).replace(/\s+/g, " ").replace(/["\\]/g, "\\$&")}"`;
+  const domains = new Map();
+  for (const group of groups) {
+    if (!domains.has(group.domain)) domains.set(group.domain, []);
+    domains.get(group.domain).push(group);
+  }
+
+  const lines = [
+    "digraph sources {",
+    "  rankdir=LR;",
+    '  node [fontname="Helvetica"];',
+  ];
+  for (const domain of [...domains.keys()].sort(compareStrings)) {
+    const articles = domains
+      .get(domain)
+      .sort((a, b) => compareStrings(a.slug, b.slug));
+    const domainNode = quoted(`domain:${domain}`);
+    const label = articles.find((group) => group.sourceName)?.sourceName;
+    lines.push(
+      `  ${domainNode} [label=${quoted(label || domain)}, shape=box];`,
+    );
+    for (const group of articles) {
+      const articleNode = quoted(`article:${domain}/${group.slug}`);
+      lines.push(
+        `  ${articleNode} [label=${quoted(group.articleTitle || group.slug)}];`,
+        `  ${domainNode} -> ${articleNode} [label="${group.quotes.length}"];`,
+      );
+    }
+  }
+  lines.push("}");
+  return `${lines.join("\n")}\n`;
+}
+
+// Newest first, with undated quotes last and ties broken by id.
+function orderQuotesByDate(quotes) {
+  const time = (quote) => (quote.createdAt ? quote.createdAt.getTime() : 0);
+  return [...quotes].sort(
+    (a, b) => time(b) - time(a) || compareStrings(a.id, b.id),
+  );
+}
+
+function orderGroupsByDate(groups) {
+  const newest = (group) =>
+    Math.max(
+      0,
+      ...group.quotes.map((quote) =>
+        quote.createdAt ? quote.createdAt.getTime() : 0,
+      ),
+    );
+  return [...groups].sort(
+    (a, b) =>
+      newest(b) - newest(a) ||
+      compareStrings(a.domain, b.domain) ||
+      compareStrings(a.slug, b.slug),
+  );
+}
+
+function buildAllPageHtml(template, groups, inlineCss = "") {
+  return applyTemplate(template, buildAllPagePayload(groups, inlineCss));
+}
+
+function buildAllPagePayload(groups, inlineCss = "") {
+  const sections = groups.map((group) => {
+    const sourceLabel = group.sourceName || group.domain;
+    const heading = group.articleTitle || sourceLabel;
+    const items = buildSourceItemsHtml(group.quotes);
+    return [
+      '<section class="source">',
+      `  <h2>${escapeHtml(heading)}</h2>`,
+      `  <p class="source-link"><a href="${escapeHtml(group.sourceUrl)}">${escapeHtml(sourceLabel)}</a></p>`,
+      items,
+      "</section>",
+    ].join("\n");
+  });
+
+  return {
+    page_title: "All quotes",
+    quote_count: String(
+      groups.reduce((total, group) => total + group.quotes.length, 0),
+    ),
+    source_count: String(groups.length),
+    source_sections: sections.join("\n\n"),
+    inline_css: inlineCss,
+    base_href: baseHref(),
+  };
+}
+
+function buildSourcePayload(group, inlineCss = "") {
+  const quoteItems = buildSourceItemsHtml(group.quotes);
+
+  const sourceLabel = group.sourceName || group.domain;
+  const pageTitle = group.articleTitle
+    ? `${group.articleTitle} — ${sourceLabel}`
+    : `Quotes from ${sourceLabel}`;
+
+  return {
+    page_title: escapeHtml(pageTitle),
+    source_domain: escapeHtml(group.domain),
+    source_name: escapeHtml(sourceLabel),
+    source_url: group.sourceUrl,
+    source_accent: formatHexColor(colorFromString(group.domain, 0.4)),
+    quote_items: quoteItems,
+    cover_image: SOURCE_COVERS
+      ? escapeHtml(absoluteUrl(coverSitePath(group.domain, group.slug)))
+      : "",
+    cover_width: String(CARD_WIDTH),
+    cover_height: String(CARD_HEIGHT),
+    inline_css: inlineCss,
+    base_href: baseHref(),
   };
 }
 
-function buildSourceQuoteHtml(quote) {
+function buildSeriesNavHtml(nav) {
+  if (!nav) return "";
+
+  const parts = [];
+  parts.push('<nav class="series">');
+  parts.push(
+    `  <span>Part ${nav.position} of ${nav.total} in ${escapeHtml(nav.name)}</span>`,
+  );
+  if (nav.prevId) {
+    parts.push(
+      `  <a rel="prev" href="${escapeHtml(publicPath(wrapperPagePath(nav.prevId)))}">← Previous</a>`,
+    );
+  }
+  if (nav.nextId) {
+    parts.push(
+      `  <a rel="next" href="${escapeHtml(publicPath(wrapperPagePath(nav.nextId)))}">Next →</a>`,
+    );
+  }
+  parts.push("</nav>");
+  return parts.join("\n");
+}
+
+// Fills {author}/{article}/{domain}. A [bracketed] part is dropped when any
+// placeholder inside it is empty, so "[{author} on ]{domain}" degrades to
+// just the domain for anonymous quotes.
+function formatDescription(pattern, values) {
+  const placeholder = /\{(\w+)\}/g;
+  const withSections = pattern.replace(/\[([^\]]*)\]/g, (match, inner) => {
+    const keys = [...inner.matchAll(placeholder)].map((found) => found[1]);
+    return keys.every((key) => values[key]) ? inner : "";
+  });
+  return withSections
+    .replace(placeholder, (match, key) => values[key] ?? "")
+    .replace(/\s+/g, " ")
+    .trim();
+}
+
+// With MERGE_SOURCE_ITEMS, back-to-back quotes by the same author share one
+// block headed by the author's name, instead of naming them under each quote.
+function buildSourceItemsHtml(quotes) {
+  if (!MERGE_SOURCE_ITEMS) {
+    return quotes.map((quote) => buildSourceQuoteHtml(quote)).join("\n\n");
+  }
+
+  const runs = [];
+  for (const quote of quotes) {
+    const run = runs.at(-1);
+    if (run && quote.name && run[0].name === quote.name) {
+      run.push(quote);
+    } else {
+      runs.push([quote]);
+    }
+  }
+  return runs
+    .map((run) => {
+      if (run.length === 1) return buildSourceQuoteHtml(run[0]);
+      return [
+        '<div class="quote-run">',
+        `<cite>${escapeHtml(run[0].name)}</cite>`,
+        ...run.map((quote) => buildSourceQuoteHtml(quote, false)),
+        "</div>",
+      ].join("\n");
+    })
+    .join("\n\n");
+}
+
+function buildSourceQuoteHtml(quote, showName = true) {
+  const [open, close] = quoteMarks(quote);
   const parts = [];
   parts.push("<article>");
-  parts.push(`  <blockquote>“${escapeHtml(quote.quote)}”</blockquote>`);
-  parts.push(`  <cite>${escapeHtml(quote.name)}</cite>`);
+  parts.push(
+    `  <blockquote dir="${quoteDirection(quote)}">${open}${formatQuoteHtml(quote.quote)}${close}</blockquote>`,
+  );
+  if (quote.name && showName) {
+    parts.push(`  <cite>${escapeHtml(quote.name)}</cite>`);
+  }
   if (quote.bodyHtml) {
     parts.push(`  <div class="body">${quote.bodyHtml}</div>`);
   }
+  if (quote.tags.length) {
+    const items = quote.tags.map((tag) => {
+      const slug = slugify(tag, { lower: true, strict: true, trim: true });
+      return `<li><a href="${escapeHtml(`${BASE_PATH}/tags/${slug}/`)}">${escapeHtml(tag)}</a></li>`;
+    });
+    parts.push(`  <ul class="tags">${items.join("")}</ul>`);
+  }
   parts.push('  <div class="meta">');
   parts.push(
-    `    <span><a href="${escapeHtml(publicPath(`/q/${quote.id}/`))}">Quote page</a></span>`,
+    `    <span><a href="${escapeHtml(publicPath(wrapperPagePath(quote.id)))}">Quote page</a></span>`,
   );
   parts.push(
-    `    <span><a href="${escapeHtml(publicPath(`/cards/${quote.id}.jpg`))}">Download JPG</a></span>`,
+    `    <span><a href="${escapeHtml(publicPath(cardSitePath(quote.id)))}">Download ${CARD_FILES.extension.toUpperCase()}</a></span>`,
   );
+  for (const format of CARD_FORMATS) {
+    const href = publicPath(cardFormatSitePath(quote.id, format.name));
+    parts.push(
+      `    <span><a href="${escapeHtml(href)}">Download ${format.label}</a></span>`,
+    );
+  }
   parts.push("  </div>");
   parts.push("</article>");
   return parts.join("\n");
 }
 
+// Placeholder and section names in `template` missing from `knownKeys`, in
+// order of first use. Front-matter fields ("fm_…") vary per quote, so any of
+// them passes under CAPTURE_FRONT_MATTER.
+function findUnknownTemplateKeys(template, knownKeys) {
+  const known = new Set(knownKeys);
+  const unknown = new Set();
+  for (const [, key] of template.matchAll(/{{[#/]?(\w+)}}/g)) {
+    if (known.has(key)) continue;
+    if (CAPTURE_FRONT_MATTER && key.startsWith("fm_")) continue;
+    unknown.add(key);
+  }
+  return [...unknown];
+}
+
 function applyTemplate(template, data) {
   let output = template;
 
@@ -755,23 +3410,107 @@ function applyTemplate(template, data) {
   return output;
 }
 
-function buildArticleSlug(urlString) {
+// Stable id for quotes without one: a few words of the quote for readability
+// plus a short hash of the text and url so edits elsewhere don't shift it.
+function deriveQuoteId(quote, url) {
+  const words = String(quote).split(/\s+/).slice(0, 5).join(" ");
+  const prefix = slugify(words, { lower: true, strict: true, trim: true });
+  const digest = hashArray([quote, url || ""]).slice(0, 8);
+  return prefix ? `${prefix}-${digest}` : digest;
+}
+
+// A quote's url as written is its displayUrl, shown and linked everywhere;
+// this form, without fragment, query, or trailing slash, is only compared to
+// spot quotes from the same page. Returns null for an unparseable url.
+function normalizeQuoteUrl(value) {
+  try {
+    const url = new URL(value);
+    url.hash = "";
+    url.search = "";
+    return url.toString().replace(/\/$/, "");
+  } catch (err) {
+    return null;
+  }
+}
+
+// With a transliterator, path segments are percent-decoded and mapped to
+// ASCII before slugging; without one the encoded path is slugged as-is.
+function buildArticleSlug(urlString, transliterate = null) {
   try {
     const url = new URL(urlString);
-    const pathSegments = url.pathname.split("/").filter(Boolean);
+    let pathSegments = url.pathname.split("/").filter(Boolean);
     if (pathSegments.length === 0) return "index";
+    if (transliterate) {
+      pathSegments = pathSegments.map((segment) =>
+        String(transliterate(decodePathSegment(segment)) ?? ""),
+      );
+    }
     const raw = pathSegments.join("-");
     const slug = slugify(raw, {
       lower: true,
       strict: true,
       trim: true,
     });
-    return slug || "index";
+    if (slug || !transliterate) return slug || "index";
+    // Keep transliterated paths that still slug to nothing from sharing one
+    // page.
+    return `a-${hashString(url.pathname).slice(0, 8)}`;
   } catch (err) {
     return null;
   }
 }
 
+function decodePathSegment(segment) {
+  try {
+    return decodeURIComponent(segment);
+  } catch (err) {
+    return segment;
+  }
+}
+
+// "slugify" leans on slugify's own charmap; anything else is a module path
+// (relative to the repo root) whose default export maps text to ASCII.
+async function loadTransliterator(spec) {
+  if (!spec) return null;
+  if (spec === "slugify") return (text) => text;
+  const modulePath = path.resolve(ROOT_DIR, spec);
+  let mod;
+  try {
+    mod = await import(pathToFileURL(modulePath).href);
+  } catch (error) {
+    throw new Error(
+      `SLUG_TRANSLITERATOR could not load ${spec}: ${error.message}`,
+    );
+  }
+  if (typeof mod.default !== "function") {
+    throw new Error(
+      `SLUG_TRANSLITERATOR module ${spec} must export a default function.`,
+    );
+  }
+  return mod.default;
+}
+
+// Accepts a bare hostname or a pasted URL ("https://example.com/") and
+// returns just the hostname.
+function normalizeSourceDomain(value) {
+  const domain = stringOrNull(value);
+  if (!domain || !domain.includes("://")) return domain || null;
+  try {
+    return new URL(domain).hostname || domain;
+  } catch (err) {
+    return domain;
+  }
+}
+
+function isSafeSegment(value) {
+  return (
+    value !== "." &&
+    value !== ".." &&
+    !/[\/\\\0]/.test(value) &&
+    value.trim() === value
+  );
+}
+
 function stringOrNull(value) {
   if (value === undefined || value === null) return null;
   const str = String(value).trim();
@@ -794,19 +3533,168 @@ function escapeHtml(value) {
     .replace(/'/g, "&#39;");
 }
 
-function escapeForSatori(value) {
-  if (value === undefined || value === null) return "";
-  return String(value)
-    .replace(/&/g, "&amp;")
-    .replace(/</g, "&lt;")
-    .replace(/>/g, "&gt;");
+function formatQuoteHtml(text) {
+  const escaped = escapeHtml(text);
+  if (!PARSE_EMPHASIS) return escaped;
+  return escaped.replace(EMPHASIS_PATTERN, (match, strong, italic) =>
+    strong !== undefined ? `<strong>${strong}</strong>` : `<em>${italic}</em>`,
+  );
 }
 
-function publicPath(relativePath) {
-  const normalized = relativePath.startsWith("/")
-    ? relativePath
-    : `/${relativePath}`;
-  return `${BASE_PATH}${normalized}`;
+function parseEmphasis(text) {
+  const runs = [];
+  let lastIndex = 0;
+
+  for (const match of String(text).matchAll(EMPHASIS_PATTERN)) {
+    if (match.index > lastIndex) {
+      runs.push({
+        text: text.slice(lastIndex, match.index),
+        bold: false,
+        italic: false,
+      });
+    }
+    const bold = match[1] !== undefined;
+    runs.push({ text: bold ? match[1] : match[2], bold, italic: !bold });
+    lastIndex = match.index + match[0].length;
+  }
+
+  if (lastIndex < text.length) {
+    runs.push({ text: text.slice(lastIndex), bold: false, italic: false });
+  }
+
+  return runs;
+}
+
+// Splits card text into words, each a list of { text, bold, italic } segments
+// so a word can switch faces mid-way (e.g. "**un**likely").
+function buildCardWords(text) {
+  const sanitized = (text || "").replace(/\s+/g, " ").trim();
+  if (!sanitized) return [];
+
+  if (!PARSE_EMPHASIS) {
+    return sanitized
+      .split(" ")
+      .flatMap((word) =>
+        splitCjkWord([{ text: word, bold: false, italic: false }]),
+      );
+  }
+
+  const words = [];
+  let current = [];
+  for (const run of parseEmphasis(sanitized)) {
+    for (const piece of run.text.split(/(\s+)/)) {
+      if (!piece) continue;
+      if (/^\s+$/.test(piece)) {
+        if (current.length) words.push(current);
+        current = [];
+        continue;
+      }
+      current.push({ text: piece, bold: run.bold, italic: run.italic });
+    }
+  }
+  if (current.length) words.push(current);
+
+  return words.flatMap(splitCjkWord);
+}
+
+// CJK text has no spaces to break at, so each CJK character becomes a word of
+// its own, except that CJK_NO_BREAK_BEFORE characters join the one before.
+// Pieces after the first are marked `attached`: they follow the word before
+// them with no space, but a line may still break between the two.
+function splitCjkWord(segments) {
+  if (!segments.some((segment) => segment.text.match(CJK_CHARACTER))) {
+    return [segments];
+  }
+
+  const pieces = [];
+  let current = [];
+  const breakHere = () => {
+    if (current.length) pieces.push(current);
+    current = [];
+  };
+  let previousCjk = false;
+  for (const segment of segments) {
+    for (const part of segment.text.split(/(.)/u)) {
+      if (!part) continue;
+      const cjk = Boolean(part.match(CJK_CHARACTER));
+      if ((cjk || previousCjk) && !CJK_NO_BREAK_BEFORE.test(part)) {
+        breakHere();
+      }
+      const last = current.at(-1);
+      if (last?.bold === segment.bold && last?.italic === segment.italic) {
+        current[current.length - 1] = { ...last, text: last.text + part };
+      } else {
+        current.push({ ...segment, text: part });
+      }
+      previousCjk = cjk;
+    }
+  }
+  breakHere();
+
+  return pieces.map((piece, index) =>
+    index ? [{ ...piece[0], attached: true }, ...piece.slice(1)] : piece,
+  );
+}
+
+function escapeForSatori(value) {
+  if (value === undefined || value === null) return "";
+  return String(value)
+    .replace(/&/g, "&amp;")
+    .replace(/</g, "&lt;")
+    .replace(/>/g, "&gt;");
+}
+
+function publicPath(relativePath) {
+  const normalized = relativePath.startsWith("/")
+    ? relativePath
+    : `/${relativePath}`;
+  return `${BASE_PATH}${normalized}`;
+}
+
+function wrapperPagePath(id) {
+  return WRAPPER_STYLE === "flat" ? `/q/${id}.html` : `/q/${id}/`;
+}
+
+// A bare page at an old URL, of a renamed quote or a source page whose slug
+// changed, that sends readers, and crawlers via the canonical link, on to the
+// page now at `sitePath`.
+function buildRedirectHtml(sitePath) {
+  const target = escapeHtml(absoluteUrl(sitePath));
+  return `<!DOCTYPE html>
+<html lang="en">
+  <head>
+    <meta charset="utf-8" />
+    <title>Moved</title>
+    <meta name="robots" content="noindex" />
+    <link rel="canonical" href="${target}" />
+    <meta http-equiv="refresh" content="0; url=${target}" />
+  </head>
+  <body>
+    <p>This page has moved to <a href="${target}">${target}</a>.</p>
+  </body>
+</html>
+`;
+}
+
+// The copy is the JPEG when CARD_JPEG_FALLBACK is on, since og:image uses it.
+function wrapperCardPagePath(id, files = CARD_FILES) {
+  const extension = files.jpegFallback
+    ? IMAGE_EXTENSIONS.jpeg
+    : files.extension;
+  return WRAPPER_STYLE === "flat"
+    ? `/q/${id}.${extension}`
+    : `/q/${id}/card.${extension}`;
+}
+
+function wrapperDataPath(id) {
+  return WRAPPER_STYLE === "flat" ? `/q/${id}.json` : `/q/${id}/data.json`;
+}
+
+// Maps a site path such as "/q/<id>/" to the file the build writes for it.
+function toOutputPath(sitePath) {
+  const relative = sitePath.replace(/^\/+/, "");
+  const file = relative.endsWith("/") ? `${relative}index.html` : relative;
+  return path.join(ROOT_DIR, ...file.split("/"));
 }
 
 function absoluteUrl(relativePath) {
@@ -817,6 +3705,12 @@ function absoluteUrl(relativePath) {
   return `${SITE_ORIGIN}${pathWithBase}`;
 }
 
+// The site root as a <base href> under EMIT_BASE_HREF, so relative URLs in
+// injected CSS or markup resolve the same from every page depth.
+function baseHref() {
+  return EMIT_BASE_HREF ? escapeHtml(`${BASE_PATH}/`) : "";
+}
+
 function normalizeBasePath(input) {
   if (!input) return "";
   let result = input.trim();
@@ -834,45 +3728,432 @@ function normalizeOrigin(input) {
   return trimmed.replace(/\/$/, "");
 }
 
+function normalizeWhitespacePolicy(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "collapse";
+  if (["collapse", "trim", "none"].includes(value)) return value;
+  throw new Error(
+    `Unknown CARD_WHITESPACE "${input}". Use "collapse", "trim", or "none".`,
+  );
+}
+
+// CARD_SCALE is the pixel density of the main card: a whole number from 1
+// (the default) to 4.
+function parseCardScale(input) {
+  const value = String(input ?? "").trim().replace(/x$/i, "");
+  if (!value) return 1;
+  const scale = Number(value);
+  if (!Number.isInteger(scale) || scale < 1 || scale > 4) {
+    throw new Error(
+      `Invalid CARD_SCALE "${input}". Use a whole number from 1 to 4.`,
+    );
+  }
+  return scale;
+}
+
+// CARD_SCALES lists extra whole-number scales to render next to the main card,
+// e.g. "2,3" or "2x 3x". 1 is always rendered, as the main card in
+// CARD_IMAGE_FORMAT.
+function parseCardScales(input) {
+  const scales = new Set();
+  for (const entry of String(input || "").split(/[\s,]+/)) {
+    if (!entry) continue;
+    const scale = Number(entry.replace(/x$/i, ""));
+    if (!Number.isInteger(scale) || scale < 1 || scale > 4) {
+      throw new Error(
+        `Invalid CARD_SCALES entry "${entry}". Use whole numbers from 1 to 4.`,
+      );
+    }
+    if (scale > 1) scales.add(scale);
+  }
+  return [...scales].sort((a, b) => a - b);
+}
+
+// PRINT_CARD_SIZE is "<width>x<height>" in inches, e.g. "5x7" or "8.5x11".
+// Unset means no print card.
+function parsePrintSize(input) {
+  const value = String(input ?? "").trim();
+  if (!value) return null;
+  const match = value.match(
+    /^(\d+(?:\.\d+)?)\s*x\s*(\d+(?:\.\d+)?)(?:\s*in)?$/i,
+  );
+  const width = Number(match?.[1]);
+  const height = Number(match?.[2]);
+  if (!match || !width || !height) {
+    throw new Error(
+      `Invalid PRINT_CARD_SIZE "${input}". Use <width>x<height> in inches, e.g. 5x7.`,
+    );
+  }
+  return { width, height };
+}
+
+// A card for print at `widthInches` × `heightInches` and `dpi`. It is laid out
+// CARD_WIDTH wide, at the print's aspect ratio and with the screen card's
+// padding and font sizes, then rasterized at `scale` to reach the print's
+// pixels, so text and padding keep the same proportions as on screen. 5×7 at
+// 300 DPI is laid out at 1200×1680 and drawn at 1500×2100.
+function printLayout(widthInches, heightInches, dpi) {
+  const pixelWidth = Math.round(widthInches * dpi);
+  const pixelHeight = Math.round(heightInches * dpi);
+  const scale = pixelWidth / CARD_WIDTH;
+  return {
+    width: CARD_WIDTH,
+    height: Math.round(pixelHeight / scale),
+    padding: CARD_PADDING,
+    scale,
+  };
+}
+
+// CARD_SHARDING is how many hex digits of the id hash name the card's
+// subdirectory; 0 (the default) keeps cards/ flat.
+function parseCardSharding(input) {
+  const value = String(input ?? "").trim();
+  if (!value) return 0;
+  const digits = Number(value);
+  if (!Number.isInteger(digits) || digits < 0 || digits > 4) {
+    throw new Error(
+      `Invalid CARD_SHARDING "${input}". Use a whole number from 0 to 4.`,
+    );
+  }
+  return digits;
+}
+
+// MANIFEST_NAME is a path relative to the repo root, such as
+// ".cache/manifest.json". It may not leave the root or sit in a generated
+// directory, which a forced rebuild would wipe.
+function resolveManifestPath(input) {
+  const name = stringOrNull(input) || "build-manifest.json";
+  const resolved = path.resolve(ROOT_DIR, name);
+  const inside = (dir) => resolved.startsWith(`${dir}${path.sep}`);
+  if (!inside(ROOT_DIR)) {
+    throw new Error(`MANIFEST_NAME must stay inside the repo root: ${name}`);
+  }
+  const generated = [OUTPUT_CARD_DIR, OUTPUT_WRAPPER_DIR, OUTPUT_SOURCES_DIR];
+  if (generated.some(inside)) {
+    throw new Error(
+      `MANIFEST_NAME cannot live in a generated directory: ${name}`,
+    );
+  }
+  return resolved;
+}
+
+function parseIdList(input) {
+  const ids = String(input || "").split(/[\s,]+/);
+  return new Set(ids.filter(Boolean));
+}
+
+function normalizeImageFormat(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value || value === "jpeg" || value === "jpg") return "jpeg";
+  if (value === "png" || value === "webp" || value === "svg") return value;
+  throw new Error(
+    `Unknown CARD_IMAGE_FORMAT "${input}". Use "jpeg", "png", "webp", or "svg".`,
+  );
+}
+
+function normalizeCardTheme(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "light";
+  if (Object.hasOwn(CARD_THEMES, value)) return value;
+  const names = Object.keys(CARD_THEMES).map((name) => `"${name}"`);
+  throw new Error(`Unknown CARD_THEME "${input}". Use ${names.join(", ")}.`);
+}
+
+function normalizeCorner(setting, input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "bottom-right";
+  if (CARD_CORNERS.includes(value)) return value;
+  const names = CARD_CORNERS.map((name) => `"${name}"`);
+  throw new Error(`Unknown ${setting} "${input}". Use ${names.join(", ")}.`);
+}
+
+function normalizeQrTarget(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "wrapper";
+  if (value === "wrapper" || value === "source") return value;
+  throw new Error(
+    `Unknown CARD_QR_TARGET "${input}". Use "wrapper" or "source".`,
+  );
+}
+
+function normalizeOverflow(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "allow";
+  if (["allow", "shrink", "truncate"].includes(value)) return value;
+  throw new Error(
+    `Unknown CARD_OVERFLOW "${input}". Use "allow", "shrink", or "truncate".`,
+  );
+}
+
+function normalizeTextAlign(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "center";
+  if (Object.hasOwn(TEXT_ALIGNS, value)) return value;
+  throw new Error(
+    `Unknown CARD_TEXT_ALIGN "${input}". Use "left", "center", or "right".`,
+  );
+}
+
+function normalizeQuoteStyle(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "curly";
+  if (Object.hasOwn(QUOTE_STYLES, value)) return value;
+  throw new Error(
+    `Unknown QUOTE_STYLE "${input}". Use "curly", "straight", "guillemets", or "none".`,
+  );
+}
+
+function normalizeVerticalAlign(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "center";
+  if (Object.hasOwn(VERTICAL_ALIGNS, value)) return value;
+  throw new Error(
+    `Unknown CARD_VERTICAL_ALIGN "${input}". Use "top", "center", or "bottom".`,
+  );
+}
+
+function normalizeTextDirection(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value) return "auto";
+  if (TEXT_DIRECTIONS.includes(value)) return value;
+  throw new Error(
+    `Unknown TEXT_DIRECTION "${input}". Use "ltr", "rtl", or "auto".`,
+  );
+}
+
+function normalizeTagCase(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value || value === "preserve") return "preserve";
+  if (value === "lower") return "lower";
+  throw new Error(`Unknown TAG_CASE "${input}". Use "preserve" or "lower".`);
+}
+
+// Trims tags and drops duplicates in first-seen order. Tags differing only in
+// case are merged into the first spelling (or lowercased under TAG_CASE=lower)
+// with a warning, since they were probably meant to be the same tag.
+function normalizeTags(input, location, warnings) {
+  if (!Array.isArray(input)) return [];
+
+  const seen = new Map();
+  for (const entry of input) {
+    const tag = String(entry ?? "").trim();
+    if (!tag) continue;
+
+    const key = tag.toLowerCase();
+    const existing = seen.get(key);
+    if (existing === undefined) {
+      seen.set(key, tag);
+    } else if (existing !== tag) {
+      warnings.push(`${location}: merged tag "${tag}" into "${existing}".`);
+    }
+  }
+
+  const tags = [...seen.values()];
+  return TAG_CASE === "lower" ? tags.map((tag) => tag.toLowerCase()) : tags;
+}
+
+function normalizeWrapperStyle(input) {
+  const value = String(input).trim().toLowerCase();
+  if (!value || value === "directory") return "directory";
+  if (value === "flat") return "flat";
+  throw new Error(
+    `Unknown WRAPPER_STYLE "${input}". Use "directory" or "flat".`,
+  );
+}
+
 function normalizeCardVersion(input) {
   if (!input) return null;
   const trimmed = String(input).trim();
   return trimmed.length ? trimmed : null;
 }
 
-function calculateQuoteFontSize(text) {
-  const sanitized = (text || "").replace(/\s+/g, " ").trim();
-  const availableWidth = CARD_WIDTH - CARD_PADDING_X * 2;
-  const availableHeight = CARD_HEIGHT - CARD_PADDING_Y * 2;
+// Applies CARD_WHITESPACE to the text drawn on the card. "collapse" folds
+// every run of whitespace into one space, "trim" only strips the ends, and
+// "none" keeps the frontmatter string exactly (indentation included).
+function cardText(quote) {
+  const text = quote.rawQuote ?? quote.quote ?? "";
+  if (CARD_WHITESPACE === "none") return text;
+  if (CARD_WHITESPACE === "trim") return text.trim();
+  return text.replace(/\s+/g, " ").trim();
+}
 
-  if (!sanitized) {
+// `reservedHeight` is space below the quote taken by other lines, such as the
+// CARD_AUTHOR attribution.
+function calculateQuoteFontSize(
+  text,
+  reservedHeight = 0,
+  layout = CARD_LAYOUT,
+) {
+  const box = quoteBox(text, reservedHeight, layout);
+  const { paragraphs, availableWidth, availableHeight } = box;
+
+  if (paragraphs.every((words) => !words.length)) {
     return QUOTE_FONT_MAX;
   }
 
-  for (let size = QUOTE_FONT_MAX; size >= QUOTE_FONT_MIN; size -= 2) {
-    const lines = estimateLineCount(sanitized, size, availableWidth);
-    const quoteHeight = lines * size * QUOTE_LINE_HEIGHT;
+  const fontSize = bestFontSize((size) => quoteFits(box, size));
 
-    if (quoteHeight <= availableHeight) {
-      return size;
+  if (
+    CARD_MAXIMIZE_SHORT &&
+    paragraphs.length === 1 &&
+    text.trim().length <= SHORT_QUOTE_MAX_CHARS
+  ) {
+    return growShortQuote(
+      paragraphs[0],
+      fontSize,
+      availableWidth,
+      availableHeight,
+    );
+  }
+  return fontSize;
+}
+
+// The box a quote's own card is laid out in: CARD_LAYOUT, grown with
+// CARD_MAX_HEIGHT by just enough to fit the quote at QUOTE_FONT_TARGET. A
+// quote that needs more than the cap shrinks from there as usual.
+function cardLayout(quote) {
+  if (CARD_MAX_HEIGHT === null) return CARD_LAYOUT;
+  const author = buildCardAuthor(quote);
+  const box = quoteBox(cardText(quote), author?.height ?? 0);
+  if (quoteFits(box, QUOTE_FONT_TARGET)) return CARD_LAYOUT;
+  const needed =
+    countQuoteLines(box, QUOTE_FONT_TARGET) *
+    QUOTE_FONT_TARGET *
+    QUOTE_LINE_HEIGHT;
+  return {
+    ...CARD_LAYOUT,
+    height: Math.min(
+      CARD_MAX_HEIGHT,
+      Math.ceil(CARD_HEIGHT + needed - box.availableHeight),
+    ),
+  };
+}
+
+// The quote's words by paragraph and the room left for them on the card.
+function quoteBox(text, reservedHeight = 0, layout = CARD_LAYOUT) {
+  const { width, height, padding } = layout;
+  return {
+    paragraphs: text.split("\n").map((line) => buildCardWords(line)),
+    availableWidth: width - padding.left - padding.right,
+    availableHeight: height - padding.top - padding.bottom - reservedHeight,
+  };
+}
+
+function quoteFits(box, size) {
+  return (
+    countQuoteLines(box, size) * size * QUOTE_LINE_HEIGHT <=
+    box.availableHeight
+  );
+}
+
+function countQuoteLines({ paragraphs, availableWidth }, size) {
+  return paragraphs.reduce(
+    (total, words) => total + estimateLineCount(words, size, availableWidth),
+    0,
+  );
+}
+
+// The text and size actually drawn. A quote that does not fit even at
+// QUOTE_FONT_MIN is handled per CARD_OVERFLOW: "allow" draws it anyway, past
+// the padding; "shrink" keeps stepping the size down; "truncate" drops
+// trailing words behind CARD_TRUNCATION_MARKER. `overflow` says which
+// happened, or is null when the quote fits.
+function fitCardText(text, reservedHeight = 0, layout = CARD_LAYOUT) {
+  const fontSize = calculateQuoteFontSize(text, reservedHeight, layout);
+  const fits = (candidate, size) =>
+    quoteFits(quoteBox(candidate, reservedHeight, layout), size);
+  if (fits(text, fontSize)) return { text, fontSize, overflow: null };
+
+  if (CARD_OVERFLOW === "shrink") {
+    let size = fontSize;
+    while (size > FONT_SIZE_STEP && !fits(text, size)) {
+      size -= FONT_SIZE_STEP;
     }
+    return { text, fontSize: size, overflow: "shrunk" };
   }
 
-  return QUOTE_FONT_MIN;
+  if (CARD_OVERFLOW === "truncate") {
+    // The whitespace between words is kept. Leading whitespace splits off an
+    // empty first token, so words are found by content rather than position.
+    const tokens = text.split(/(\s+)/);
+    const wordEnds = [];
+    tokens.forEach((token, index) => {
+      if (/\S/.test(token)) wordEnds.push(index + 1);
+    });
+    const clipped = (count) =>
+      `${tokens.slice(0, wordEnds[count - 1]).join("")}${CARD_TRUNCATION_MARKER}`;
+    // One word is the floor; all of them never fit.
+    let low = 1;
+    let high = wordEnds.length;
+    while (high - low > 1) {
+      const middle = Math.floor((low + high) / 2);
+      if (fits(clipped(middle), fontSize)) {
+        low = middle;
+      } else {
+        high = middle;
+      }
+    }
+    return { text: clipped(low), fontSize, overflow: "truncated" };
+  }
+
+  return { text, fontSize, overflow: "overflow" };
+}
+
+// A short quote that fits on one line at `fontSize` keeps growing, in
+// FONT_SIZE_STEP increments, while it still fits on one line (curly quotes
+// included), so one or two words fill the card instead of sitting small in
+// the middle of it.
+function growShortQuote(words, fontSize, availableWidth, availableHeight) {
+  const spaces = words.filter((word, index) => index && !word[0].attached);
+  const lineWidth = (size) =>
+    estimateSegmentsWidth(words.flat(), size) +
+    spaces.length * size * SPACE_WIDTH_RATIO +
+    2 * size * CHAR_WIDTH_RATIO;
+  const fits = (size) =>
+    size <= QUOTE_FONT_MAX * SHORT_QUOTE_GROWTH_LIMIT &&
+    lineWidth(size) <= availableWidth &&
+    size * QUOTE_LINE_HEIGHT <= availableHeight;
+
+  if (!fits(fontSize)) return fontSize;
+  let size = fontSize;
+  while (fits(size + FONT_SIZE_STEP)) {
+    size += FONT_SIZE_STEP;
+  }
+  return size;
+}
+
+// Binary-searches the largest size, in FONT_SIZE_STEP increments between
+// QUOTE_FONT_MIN and QUOTE_FONT_MAX, for which `fits` holds. Falls back to the
+// minimum when nothing fits.
+function bestFontSize(fits) {
+  let low = 0;
+  let high = Math.floor((QUOTE_FONT_MAX - QUOTE_FONT_MIN) / FONT_SIZE_STEP);
+  const sizeAt = (step) => QUOTE_FONT_MIN + step * FONT_SIZE_STEP;
+
+  if (fits(sizeAt(high))) return sizeAt(high);
+
+  // sizeAt(high) never fits; sizeAt(low) fits or is the minimum fallback.
+  while (high - low > 1) {
+    const middle = Math.floor((low + high) / 2);
+    if (fits(sizeAt(middle))) {
+      low = middle;
+    } else {
+      high = middle;
+    }
+  }
+  return sizeAt(low);
 }
 
-function estimateLineCount(text, fontSize, maxWidth) {
-  const words = text.split(" ");
+function estimateLineCount(words, fontSize, maxWidth) {
   if (!words.length) return 1;
 
   const spaceWidth = fontSize * SPACE_WIDTH_RATIO;
   let lineWidth = 0;
   let lines = 1;
 
-  for (const word of words) {
-    if (!word) continue;
+  for (const word of breakLongWords(words, fontSize, maxWidth)) {
     const measuredWordWidth = Math.min(
-      estimateWordWidth(word, fontSize),
+      estimateSegmentsWidth(word, fontSize),
       maxWidth,
     );
 
@@ -881,51 +4162,947 @@ function estimateLineCount(text, fontSize, maxWidth) {
       continue;
     }
 
-    if (lineWidth + spaceWidth + measuredWordWidth > maxWidth) {
+    const gap = word[0].attached ? 0 : spaceWidth;
+    if (lineWidth + gap + measuredWordWidth > maxWidth) {
       lines += 1;
       lineWidth = measuredWordWidth;
     } else {
-      lineWidth += spaceWidth + measuredWordWidth;
+      lineWidth += gap + measuredWordWidth;
     }
   }
 
   return lines;
 }
 
+// Words too wide for a line on their own, such as URLs, are cut between
+// characters into pieces that each fit, every piece after the first attached
+// to the one before and, with CARD_BREAK_HYPHEN, all but the last ending in a
+// hyphen.
+function breakLongWords(words, fontSize, maxWidth) {
+  return words.flatMap((segments) =>
+    breakLongWord(segments, fontSize, maxWidth),
+  );
+}
+
+function breakLongWord(segments, fontSize, maxWidth) {
+  if (estimateSegmentsWidth(segments, fontSize) <= maxWidth) return [segments];
+
+  const hyphen = CARD_BREAK_HYPHEN ? "-" : "";
+  const hyphenWidth = estimateWordWidth(hyphen, fontSize);
+  const pieces = [];
+  let piece = [];
+  let pieceWidth = 0;
+  for (const segment of segments) {
+    for (const character of Array.from(segment.text)) {
+      const characterWidth = estimateSegmentsWidth(
+        [{ ...segment, text: character }],
+        fontSize,
+      );
+      const overflows =
+        pieceWidth + characterWidth + hyphenWidth > maxWidth;
+      if (piece.length && overflows) {
+        pieces.push(piece);
+        piece = [];
+        pieceWidth = 0;
+      }
+      const last = piece.at(-1);
+      if (last?.bold === segment.bold && last?.italic === segment.italic) {
+        piece[piece.length - 1] = { ...last, text: last.text + character };
+      } else {
+        piece.push({ ...segment, text: character });
+      }
+      pieceWidth += characterWidth;
+    }
+  }
+  pieces.push(piece);
+
+  return pieces.map((segments, index) => {
+    const broken = [...segments];
+    if (index) broken[0] = { ...broken[0], attached: true };
+    if (index < pieces.length - 1) {
+      const end = broken.length - 1;
+      broken[end] = { ...broken[end], text: broken[end].text + hyphen };
+    }
+    return broken;
+  });
+}
+
+// The plain text layout lets Satori break long words itself, but it adds no
+// hyphen, so with CARD_BREAK_HYPHEN they are cut here first.
+function hyphenateLongWords(text, fontSize, maxWidth) {
+  if (!CARD_BREAK_HYPHEN) return text;
+  return text.replace(/\S+/g, (token) =>
+    breakLongWords(buildCardWords(token), fontSize, maxWidth)
+      .map((segments) => segments.map((segment) => segment.text).join(""))
+      .join(""),
+  );
+}
+
+function estimateSegmentsWidth(segments, fontSize) {
+  const tracking = segments.reduce(
+    (total, segment) => total + segment.text.length * QUOTE_LETTER_SPACING,
+    0,
+  );
+  return segments.reduce((total, segment) => {
+    if (!CARD_TABULAR_FIGURES) {
+      const width = estimateWordWidth(segment.text, fontSize);
+      return total + (segment.bold ? width * BOLD_WIDTH_RATIO : width);
+    }
+
+    // Digit cells have the same width in either weight.
+    const digits = (segment.text.match(/\d/g) || []).length;
+    const rest = segment.text.replace(/\d/g, "");
+    const width = estimateWordWidth(rest, fontSize);
+    return (
+      total +
+      (segment.bold ? width * BOLD_WIDTH_RATIO : width) +
+      digits * fontSize * TABULAR_DIGIT_RATIO
+    );
+  }, tracking);
+}
+
 function estimateWordWidth(word, fontSize) {
   const length = word.length;
   if (!length) return 0;
 
   const wideCharacters = (word.match(/[MW@#&$%]/g) || []).length;
   const narrowCharacters = (word.match(/[il1']/g) || []).length;
-  const baseWidth = length * CHAR_WIDTH_RATIO;
+  const cjkCharacters = (word.match(CJK_CHARACTER) || []).length;
+  const baseWidth =
+    (length - cjkCharacters) * CHAR_WIDTH_RATIO +
+    cjkCharacters * CJK_WIDTH_RATIO;
   const widthAdjust =
     wideCharacters * WIDE_CHAR_BONUS_RATIO - narrowCharacters * 0.04;
   const estimated = Math.max(0.4, baseWidth + widthAdjust);
   return estimated * fontSize;
 }
 
-async function renderQuoteSvg(quote, fonts) {
-  const quoteFontSize = calculateQuoteFontSize(quote.quote);
+async function renderQuoteSvg(
+  quote,
+  fonts,
+  layout = CARD_LAYOUT,
+  images = {},
+) {
+  const { svg } = await renderQuoteSvgDetailed(quote, fonts, layout, images);
+  return svg;
+}
+
+// renderQuoteSvg plus how the quote was laid out: the card's height, the font
+// size, the estimated line count, and CARD_OVERFLOW's outcome (see
+// fitCardText).
+async function renderQuoteSvgDetailed(
+  quote,
+  fonts,
+  layout = CARD_LAYOUT,
+  images = {},
+) {
+  const { width, height, padding } = layout;
+  const author = buildCardAuthor(quote, layout);
+  const {
+    text,
+    fontSize: quoteFontSize,
+    overflow,
+  } = fitCardText(cardText(quote), author?.height ?? 0, layout);
+  const direction = quoteDirection(quote);
+  const availableWidth = width - padding.left - padding.right;
+  // Satori only lays text out left to right, so right-to-left quotes always
+  // take the word layout, which can run the other way.
+  const useWordLayout =
+    PARSE_EMPHASIS ||
+    (CARD_TABULAR_FIGURES && /\d/.test(text)) ||
+    direction === "rtl";
+  const [open, close] = quoteMarks(quote);
+  // Raw quotes are often code, so they take the mono face when it is there.
+  const face =
+    quote.raw && fonts.some((font) => font.name === MONO_FONT)
+      ? `font-family:'${MONO_FONT}';`
+      : "";
+  const quoteMarkup = useWordLayout
+    ? renderWordMarkup(text, quoteFontSize, {
+        direction,
+        maxWidth: availableWidth,
+        marks: [open, close],
+        style: face,
+      })
+    : `<div style="${face}font-size:${quoteFontSize}px;line-height:${QUOTE_LINE_HEIGHT};${letterSpacingStyle()}font-weight:400;text-align:${CARD_TEXT_ALIGN};white-space:pre-wrap;word-break:break-word;max-width:100%;">${open}${escapeForSatori(
+        hyphenateLongWords(text, quoteFontSize, availableWidth),
+      )}${close}</div>`;
+  // The author line stacks under the quote in a centred column.
+  const content = author
+    ? `<div style="display:flex;flex-direction:column;align-items:${TEXT_ALIGNS[CARD_TEXT_ALIGN]};max-width:100%;">${quoteMarkup}${author.markup}</div>`
+    : quoteMarkup;
+
+  const { background, color } = cardColors(
+    quote.theme ?? CARD_THEME,
+    cardBackground(quote),
+  );
 
   const body = `
-    <div style="display:flex;width:${CARD_WIDTH}px;height:${CARD_HEIGHT}px;background:#f7f4ec;color:#26211a;padding:${CARD_PADDING_Y}px ${CARD_PADDING_X}px;box-sizing:border-box;font-family:'Atkinson Hyperlegible';align-items:center;justify-content:center;">
-      <div style="font-size:${quoteFontSize}px;line-height:${QUOTE_LINE_HEIGHT};font-weight:400;text-align:center;white-space:pre-wrap;word-break:break-word;max-width:100%;">“${escapeForSatori(
-        quote.quote,
-      )}”</div>
+    <div style="display:flex;width:${width}px;height:${height}px;${background};color:${color};padding:${padding.top}px ${padding.right}px ${padding.bottom}px ${padding.left}px;box-sizing:border-box;font-family:'Atkinson Hyperlegible';${textStrokeStyle()}align-items:${VERTICAL_ALIGNS[CARD_VERTICAL_ALIGN]};justify-content:${TEXT_ALIGNS[CARD_TEXT_ALIGN]};">
+      ${renderBackgroundMarkup(images.background, width, height)}
+      ${content}
+      ${renderFooterMarkup(quote, layout)}
+      ${renderQrMarkup(quote)}
+      ${renderLogoMarkup(images.logo)}
+      ${renderWatermarkMarkup(width, height, color)}
     </div>
   `;
 
   const svg = await satori(parseHtml(body), {
+    width,
+    height,
+    fonts,
+  });
+
+  const box = quoteBox(text, author?.height ?? 0, layout);
+  return {
+    svg,
+    height,
+    fontSize: quoteFontSize,
+    lines: countQuoteLines(box, quoteFontSize),
+    overflow,
+  };
+}
+
+// What to tell the author about a fitCardText result whose text did not fit,
+// or null when it did.
+function describeCardOverflow({ overflow, fontSize }) {
+  if (overflow === "overflow") {
+    return "the quote does not fit the card even at QUOTE_FONT_MIN; shorten it or set CARD_OVERFLOW.";
+  }
+  if (overflow === "shrunk") {
+    return `the quote does not fit at QUOTE_FONT_MIN; drawing it at ${fontSize}px.`;
+  }
+  if (overflow === "truncated") {
+    return "the quote does not fit the card; it is cut short.";
+  }
+  return null;
+}
+
+// The print card is drawn larger than it is laid out, except as an SVG, which
+// any printer scales itself.
+function formatScale(format) {
+  return CARD_IMAGE_FORMAT === "svg" ? 1 : (format.scale ?? 1);
+}
+
+// Renders one quote's card, as the build would write it to cards/, straight
+// into a writable stream such as stdout or an HTTP response. resvg and the
+// encoders only hand back a finished image, so the card is built in memory;
+// it is written in chunks that wait for "drain" when the stream is full.
+async function writeCardTo(stream, quote, fonts, images = {}) {
+  const svg = await renderQuoteSvg(quote, fonts, cardLayout(quote), images);
+  const image = rasterizeCard(svg, CARD_SCALE);
+  for (let offset = 0; offset < image.length; offset += CARD_WRITE_CHUNK) {
+    const chunk = image.subarray(offset, offset + CARD_WRITE_CHUNK);
+    if (!stream.write(chunk)) await once(stream, "drain");
+  }
+}
+
+// Bytes handed to the stream per write in writeCardTo.
+const CARD_WRITE_CHUNK = 64 * 1024;
+
+// Re-reads a freshly written card and checks it is a complete image of the
+// configured format and size. Returns a description of the problem, or null
+// if valid.
+async function verifyCardFile(target, scale = 1, layout = CARD_LAYOUT) {
+  const data = await fs.readFile(target);
+  const readers = {
+    jpeg: readJpegSize,
+    png: readPngSize,
+    webp: readWebpSize,
+    svg: readSvgSize,
+  };
+  const size = readers[CARD_IMAGE_FORMAT](data);
+  if (!size) return `not a complete ${CARD_IMAGE_FORMAT.toUpperCase()}`;
+  const width = Math.round(layout.width * scale);
+  const height = Math.round(layout.height * scale);
+  if (size.width !== width || size.height !== height) {
+    return `expected ${width}×${height}, got ${size.width}×${size.height}`;
+  }
+  return null;
+}
+
+// Reads a JPEG's frame size from its SOF header without decoding the image.
+// Returns null unless the data starts with SOI, ends with EOI, and has a frame
+// header, which catches truncated or garbage writes.
+function readJpegSize(data) {
+  if (data.length < 4 || data[0] !== 0xff || data[1] !== 0xd8) return null;
+  if (data[data.length - 2] !== 0xff || data[data.length - 1] !== 0xd9) {
+    return null;
+  }
+
+  let offset = 2;
+  while (offset + 4 <= data.length) {
+    if (data[offset] !== 0xff) return null;
+    const marker = data[offset + 1];
+    if (marker === 0xff) {
+      offset += 1;
+      continue;
+    }
+
+    // SOF0–SOF15, except DHT (C4), JPG (C8), and DAC (CC).
+    const isFrame =
+      marker >= 0xc0 && marker <= 0xcf && ![0xc4, 0xc8, 0xcc].includes(marker);
+    if (isFrame) {
+      if (offset + 9 > data.length) return null;
+      return {
+        height: data.readUInt16BE(offset + 5),
+        width: data.readUInt16BE(offset + 7),
+      };
+    }
+    offset += 2 + data.readUInt16BE(offset + 2);
+  }
+  return null;
+}
+
+// Reads a PNG's size from its IHDR chunk. Returns null unless the data has the
+// PNG signature, starts with IHDR, and ends with an IEND chunk.
+function readPngSize(data) {
+  const signature = [0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a];
+  if (data.length < 45 || signature.some((byte, i) => data[i] !== byte)) {
+    return null;
+  }
+  if (data.toString("latin1", 12, 16) !== "IHDR") return null;
+  if (data.toString("latin1", data.length - 8, data.length - 4) !== "IEND") {
+    return null;
+  }
+  return { width: data.readUInt32BE(16), height: data.readUInt32BE(20) };
+}
+
+// Reads a lossless WebP's size from its VP8L header. Returns null unless the
+// RIFF size matches the data, which catches truncated writes.
+function readWebpSize(data) {
+  if (data.length < 25 || data.toString("latin1", 0, 4) !== "RIFF") {
+    return null;
+  }
+  if (data.toString("latin1", 8, 16) !== "WEBPVP8L" || data[20] !== 0x2f) {
+    return null;
+  }
+  if (data.readUInt32LE(4) !== data.length - 8) return null;
+  const bits = data.readUInt32LE(21);
+  return { width: (bits & 0x3fff) + 1, height: ((bits >>> 14) & 0x3fff) + 1 };
+}
+
+// Reads an SVG card's size from the root element's width and height. Returns
+// null unless the markup closes the root, which catches truncated writes.
+function readSvgSize(data) {
+  const text = data.toString("utf8");
+  const match = /^<svg\b[^>]*?\swidth="(\d+)"[^>]*?\sheight="(\d+)"/.exec(text);
+  if (!match || !text.trimEnd().endsWith("</svg>")) return null;
+  return { width: Number(match[1]), height: Number(match[2]) };
+}
+
+// Encodes as CARD_IMAGE_FORMAT; covers pass "jpeg" since they are always
+// cover.jpg. SVG cards are satori's markup as is: text is already outlined
+// into glyph paths, so no font is embedded or needed to view them, at the
+// cost of text that can't be selected.
+function rasterizeCard(
+  svg,
+  scale = 1,
+  width = CARD_WIDTH,
+  format = CARD_IMAGE_FORMAT,
+) {
+  if (format === "svg") return Buffer.from(svg);
+  const resvg = new Resvg(svg, {
+    fitTo: {
+      mode: "width",
+      value: width * scale,
+    },
+  });
+  const renderResult = resvg.render();
+  if (format === "png") return renderResult.asPng();
+  if (format === "webp") {
+    return encodeWebp({
+      data: unpremultiply(renderResult.pixels),
+      width: renderResult.width,
+      height: renderResult.height,
+    });
+  }
+  const jpeg = encodeJpeg(
+    {
+      data: renderResult.pixels,
+      width: renderResult.width,
+      height: renderResult.height,
+    },
+    CARD_JPEG_QUALITY,
+  );
+  return jpeg.data;
+}
+
+// resvg hands back premultiplied RGBA; WebP stores straight alpha. Opaque
+// pixels pass through unchanged.
+function unpremultiply(pixels) {
+  const data = Buffer.from(pixels);
+  for (let i = 0; i < data.length; i += 4) {
+    const alpha = data[i + 3];
+    if (alpha === 255 || alpha === 0) continue;
+    for (let channel = i; channel < i + 3; channel += 1) {
+      data[channel] = Math.min(255, Math.round((data[channel] * 255) / alpha));
+    }
+  }
+  return data;
+}
+
+// What a source's cover card shows: its title, how many quotes it holds, and
+// the newest quote as a sample (groups are sorted newest first).
+function buildCoverContent(group) {
+  return {
+    title: truncateText(
+      group.articleTitle || group.sourceName || group.domain,
+      COVER_TITLE_MAX_CHARS,
+    ),
+    count: group.quotes.length,
+    sample: truncateText(
+      cardText(group.quotes[0]).replace(/\s+/g, " "),
+      COVER_SAMPLE_MAX_CHARS,
+    ),
+  };
+}
+
+async function renderCoverSvg({ title, count, sample }, fonts, images = {}) {
+  const { background, color } = cardColors();
+  const label = `${count} ${count === 1 ? "quote" : "quotes"}`;
+
+  const body = `
+    <div style="display:flex;flex-direction:column;justify-content:space-between;width:${CARD_WIDTH}px;height:${CARD_HEIGHT}px;${background};color:${color};padding:${CARD_PADDING.top}px ${CARD_PADDING.right}px ${CARD_PADDING.bottom}px ${CARD_PADDING.left}px;box-sizing:border-box;font-family:'Atkinson Hyperlegible';${textStrokeStyle()}">
+      ${renderBackgroundMarkup(images.background, CARD_WIDTH, CARD_HEIGHT)}
+      <div style="display:flex;font-size:${COVER_TITLE_SIZE}px;font-weight:700;line-height:1.15;">${escapeForSatori(title)}</div>
+      <div style="display:flex;font-size:${COVER_SAMPLE_SIZE}px;font-weight:400;line-height:1.35;opacity:0.7;">${QUOTE_MARKS[0]}${escapeForSatori(sample)}${QUOTE_MARKS[1]}</div>
+      <div style="display:flex;font-size:${COVER_FOOTER_SIZE}px;font-weight:700;letter-spacing:2px;text-transform:uppercase;opacity:0.6;">${label}</div>
+      ${renderLogoMarkup(images.logo)}
+      ${renderWatermarkMarkup(CARD_WIDTH, CARD_HEIGHT, color)}
+    </div>
+  `;
+
+  return satori(parseHtml(body), {
     width: CARD_WIDTH,
     height: CARD_HEIGHT,
     fonts,
   });
+}
 
-  return svg;
+function truncateText(text, maxChars) {
+  const value = String(text).trim();
+  if (value.length <= maxChars) return value;
+  return `${value.slice(0, maxChars - 1).trimEnd()}…`;
+}
+
+// "— Name" drawn under the quote with CARD_AUTHOR, or null when it is off or
+// the quote has no author.
+function cardAuthorLine(quote) {
+  if (!CARD_AUTHOR || !quote.name) return null;
+  return `— ${quote.name.replace(/\s+/g, " ").trim()}`;
+}
+
+// Sizes the attribution to fit one line in the bold face, stepping down from
+// CARD_AUTHOR_FONT_MAX. Names too long even at the minimum wrap onto up to
+// CARD_AUTHOR_MAX_LINES lines, the last one truncated if need be. The height
+// returned covers every line, and the quote is sized to fit in what remains.
+function buildCardAuthor(quote, layout = CARD_LAYOUT) {
+  const line = cardAuthorLine(quote);
+  if (!line) return null;
+
+  const { width, padding } = layout;
+  const availableWidth = width - padding.left - padding.right;
+  const lineWidth = (text, size) =>
+    estimateWordWidth(text, size) * BOLD_WIDTH_RATIO;
+
+  let fontSize = CARD_AUTHOR_FONT_MAX;
+  while (
+    fontSize > CARD_AUTHOR_FONT_MIN &&
+    lineWidth(line, fontSize) > availableWidth
+  ) {
+    fontSize -= 1;
+  }
+
+  const lines = [];
+  for (const word of line.split(" ")) {
+    const last = lines.at(-1);
+    if (last && lineWidth(`${last} ${word}`, fontSize) <= availableWidth) {
+      lines[lines.length - 1] = `${last} ${word}`;
+    } else {
+      lines.push(word);
+    }
+  }
+  if (lines.length > CARD_AUTHOR_MAX_LINES) {
+    const rest = lines.splice(CARD_AUTHOR_MAX_LINES - 1);
+    lines.push(rest.join(" "));
+  }
+  const charWidth = fontSize * CHAR_WIDTH_RATIO * BOLD_WIDTH_RATIO;
+  const maxChars = Math.floor(availableWidth / charWidth);
+  const fitted = lines.map((text) =>
+    lineWidth(text, fontSize) > availableWidth
+      ? truncateText(text, maxChars)
+      : text,
+  );
+
+  // Explicit lines, so Satori cannot wrap differently from the estimate. A
+  // right-to-left name has each line's words laid out in visual order.
+  const rtl = detectDirection(quote.name) === "rtl";
+  const lineHeight = Math.ceil(fontSize * CARD_AUTHOR_LINE_HEIGHT);
+  const lineMarkup = fitted
+    .map((text) => {
+      const visual = rtl
+        ? text.split(" ").reverse().map(visualRtlText).join(" ")
+        : text;
+      return `<div style="display:flex;">${escapeForSatori(visual)}</div>`;
+    })
+    .join("");
+  return {
+    markup: `<div style="display:flex;flex-direction:column;align-items:${TEXT_ALIGNS[CARD_TEXT_ALIGN]};margin-top:${CARD_AUTHOR_GAP}px;font-size:${fontSize}px;line-height:${CARD_AUTHOR_LINE_HEIGHT};font-weight:700;">${lineMarkup}</div>`,
+    height: CARD_AUTHOR_GAP + fitted.length * lineHeight,
+  };
+}
+
+// The source domain drawn along the bottom with CARD_SOURCE_FOOTER, or null
+// when it is off or the domain is unknown.
+function cardFooterText(quote) {
+  if (!CARD_SOURCE_FOOTER) return null;
+  if (quote.sourceDomain === UNKNOWN_SOURCE_DOMAIN) return null;
+  return quote.sourceDomain || null;
+}
+
+function renderFooterMarkup(quote, layout = CARD_LAYOUT) {
+  const text = cardFooterText(quote);
+  if (!text) return "";
+
+  const { width, padding } = layout;
+  return `<div style="display:flex;position:absolute;left:0;bottom:0;width:${width}px;height:${padding.bottom}px;align-items:center;justify-content:center;font-size:${CARD_FOOTER_SIZE}px;font-weight:700;letter-spacing:1px;opacity:${CARD_FOOTER_OPACITY};">${escapeForSatori(text)}</div>`;
 }
 
-main().catch((error) => {
-  console.error(error.stack || error.message);
-  process.exitCode = 1;
-});
+// The URL encoded in the card's QR code: the quote's source under
+// CARD_QR_TARGET=source, otherwise its absolute permalink. Null when CARD_QR
+// is off, the quote has no source, or there is no SITE_ORIGIN to make the
+// permalink absolute.
+function cardQrUrl(quote) {
+  if (!CARD_QR) return null;
+  if (CARD_QR_TARGET === "source") return quote.displayUrl || null;
+  if (!SITE_ORIGIN) return null;
+  return absoluteUrl(wrapperPagePath(quote.id));
+}
+
+function renderQrMarkup(quote) {
+  const url = cardQrUrl(quote);
+  if (!url) return "";
+
+  const svg = qrToSvg(encodeQr(url), { dark: "#26211a", light: "#ffffff" });
+  const encoded = Buffer.from(svg).toString("base64");
+  const [vertical, horizontal] = CARD_QR_POSITION.split("-");
+  return `<img src="data:image/svg+xml;base64,${encoded}" width="${CARD_QR_SIZE}" height="${CARD_QR_SIZE}" style="position:absolute;${vertical}:${CARD_QR_MARGIN}px;${horizontal}:${CARD_QR_MARGIN}px;" />`;
+}
+
+// CARD_BACKGROUND_IMAGE scaled to cover the card, under the optional overlay
+// tint. Drawn first so the text paints over it; the theme background only
+// shows through transparent pixels.
+function renderBackgroundMarkup(image, width, height) {
+  if (!image) return "";
+
+  const box = `position:absolute;left:0;top:0;width:${width}px;height:${height}px;`;
+  const markup = `<img src="${image.uri}" width="${width}" height="${height}" style="${box}object-fit:cover;" />`;
+  if (!CARD_BACKGROUND_OVERLAY) return markup;
+  const { rgb, alpha } = CARD_BACKGROUND_OVERLAY;
+  return `${markup}<div style="display:flex;${box}background:rgba(${rgb.join(",")},${alpha});"></div>`;
+}
+
+// CARD_LOGO in its CARD_LOGO_POSITION corner, over the text but under the
+// watermark.
+function renderLogoMarkup(logo) {
+  if (!logo) return "";
+
+  const scale = Math.min(
+    1,
+    CARD_LOGO_MAX_SIZE / logo.width,
+    CARD_LOGO_MAX_SIZE / logo.height,
+  );
+  const width = Math.round(logo.width * scale);
+  const height = Math.round(logo.height * scale);
+  const [vertical, horizontal] = CARD_LOGO_POSITION.split("-");
+  return `<img src="${logo.uri}" width="${width}" height="${height}" style="position:absolute;${vertical}:${CARD_LOGO_MARGIN}px;${horizontal}:${CARD_LOGO_MARGIN}px;opacity:${CARD_LOGO_OPACITY};" />`;
+}
+
+// CARD_WATERMARK drawn last, faint and along the card's rising diagonal, so
+// preview builds cannot pass for production ones.
+function renderWatermarkMarkup(width, height, color) {
+  if (!CARD_WATERMARK) return "";
+
+  const diagonal = Math.hypot(width, height);
+  const angle = (-Math.atan2(height, width) * 180) / Math.PI;
+  const textWidth =
+    estimateWordWidth(CARD_WATERMARK, 100) * BOLD_WIDTH_RATIO;
+  const fontSize = Math.floor(
+    Math.min((100 * diagonal * CARD_WATERMARK_SPAN) / textWidth, height / 3),
+  );
+  return `<div style="display:flex;position:absolute;left:0;top:0;width:${width}px;height:${height}px;align-items:center;justify-content:center;"><div style="display:flex;font-size:${fontSize}px;font-weight:700;letter-spacing:4px;white-space:nowrap;color:${color};opacity:${CARD_WATERMARK_OPACITY};transform:rotate(${angle.toFixed(2)}deg);">${escapeForSatori(CARD_WATERMARK)}</div></div>`;
+}
+
+// Background declaration and text color for the card in the given theme.
+// CARD_GRADIENT overrides any theme; its text picks whichever of the usual ink
+// or paper colors contrasts with the midpoint. A per-quote card_bg color
+// overrides both, with its text picked the same way.
+// With CARD_AUTO_CONTRAST, text that falls below the WCAG AA contrast ratio
+// against the card's backdrop switches to whichever of ink or paper reads.
+function cardColors(themeName = CARD_THEME, cardBg = null) {
+  const colors = baseCardColors(themeName, cardBg);
+  if (!CARD_AUTO_CONTRAST) return colors;
+  const backdrop = cardBackdrop(themeName, cardBg);
+  if (
+    !backdrop ||
+    contrastRatio(parseHexColor(colors.color), backdrop) >= MIN_TEXT_CONTRAST
+  ) {
+    return colors;
+  }
+  return { ...colors, color: contrastingText(backdrop) };
+}
+
+// The color the text mostly sits on, or null when it cannot be known: a
+// transparent card, or a background image without an overlay. Under an
+// overlay the image is taken to be a mid-tone.
+function cardBackdrop(themeName, cardBg) {
+  if (CARD_BACKGROUND_IMAGE) {
+    if (!CARD_BACKGROUND_OVERLAY) return null;
+    const { rgb, alpha } = CARD_BACKGROUND_OVERLAY;
+    return rgb.map((channel) => channel * alpha + 128 * (1 - alpha));
+  }
+  if (cardBg) return parseHexColor(cardBg);
+  if (CARD_GRADIENT) {
+    const start = parseHexColor(CARD_GRADIENT.start);
+    const end = parseHexColor(CARD_GRADIENT.end);
+    return start.map((channel, i) => (channel + end[i]) / 2);
+  }
+  if (CARD_TRANSPARENT) return null;
+  return parseHexColor(CARD_THEMES[themeName].background);
+}
+
+// WCAG contrast ratio between two sRGB triples, from 1 to 21.
+function contrastRatio(a, b) {
+  const [light, dark] = [relativeLuminance(a), relativeLuminance(b)].sort(
+    (x, y) => y - x,
+  );
+  return (light + 0.05) / (dark + 0.05);
+}
+
+function baseCardColors(themeName, cardBg) {
+  if (cardBg) {
+    const text = contrastingText(parseHexColor(cardBg));
+    return { background: `background:${cardBg}`, color: text };
+  }
+  if (CARD_GRADIENT) {
+    const { start, end, angle, text } = CARD_GRADIENT;
+    return {
+      background: `background-image:linear-gradient(${angle}deg, ${start}, ${end})`,
+      color: text,
+    };
+  }
+  const theme = CARD_THEMES[themeName];
+  const background = CARD_TRANSPARENT ? "transparent" : theme.background;
+  return { background: `background:${background}`, color: theme.text };
+}
+
+// The quote's own card_bg, else with CARD_DOMAIN_TINT a pale color of its
+// source domain, else null for the theme's background.
+function cardBackground(quote) {
+  if (quote.cardBg) return quote.cardBg;
+  if (!CARD_DOMAIN_TINT) return null;
+  return formatHexColor(colorFromString(quote.sourceDomain));
+}
+
+// A stable color for `value`: the hue comes from its hash, while saturation
+// and lightness are fixed so every value gets an equally soft color.
+function colorFromString(value, lightness = 0.88) {
+  const hue = parseInt(hashString(value).slice(0, 8), 16) % 360;
+  return hslToRgb(hue, 0.55, lightness);
+}
+
+function hslToRgb(hue, saturation, lightness) {
+  const chroma = (1 - Math.abs(2 * lightness - 1)) * saturation;
+  const channel = (n) => {
+    const k = (n + hue / 30) % 12;
+    const value =
+      lightness - (chroma / 2) * Math.max(-1, Math.min(k - 3, 9 - k, 1));
+    return Math.round(value * 255);
+  };
+  return [channel(0), channel(8), channel(4)];
+}
+
+// Parses CARD_GRADIENT as "<start>,<end>[,<angle>]" with hex colors; the angle
+// is in degrees or a GRADIENT_DIRECTIONS name. The default 135deg runs from
+// the top-left corner to the bottom-right one.
+function parseGradient(input) {
+  const value = stringOrNull(input);
+  if (!value) return null;
+
+  const [start, end, angle, ...rest] = value.split(",").map((p) => p.trim());
+  const startRgb = parseHexColor(start);
+  const endRgb = parseHexColor(end);
+  const direction = angle?.toLowerCase();
+  let degrees = angle ? Number(angle) : GRADIENT_DIRECTIONS.diagonal;
+  if (Object.hasOwn(GRADIENT_DIRECTIONS, direction)) {
+    degrees = GRADIENT_DIRECTIONS[direction];
+  }
+  if (!startRgb || !endRgb || rest.length || !Number.isFinite(degrees)) {
+    throw new Error(
+      `Invalid CARD_GRADIENT "${input}". Use "<start>,<end>[,<angle>]", e.g. "#f7f4ec,#d9c7a3,135" or "#f7f4ec,#d9c7a3,vertical".`,
+    );
+  }
+
+  const midpoint = startRgb.map((channel, i) => (channel + endRgb[i]) / 2);
+  return {
+    start: formatHexColor(startRgb),
+    end: formatHexColor(endRgb),
+    angle: degrees,
+    text: contrastingText(midpoint),
+  };
+}
+
+// The usual paper color on dark backgrounds, ink on light ones.
+function contrastingText(rgb) {
+  return relativeLuminance(rgb) < 0.4 ? "#f7f4ec" : "#26211a";
+}
+
+// Parses CARD_TEXT_STROKE as "<color>[,<width>]" with a hex color and a
+// width in pixels (default 2).
+function parseTextStroke(input) {
+  const value = stringOrNull(input);
+  if (!value) return null;
+
+  const [color, width, ...rest] = value.split(",").map((p) => p.trim());
+  const rgb = parseHexColor(color);
+  const strokeWidth = width ? Number(width) : 2;
+  if (!rgb || rest.length || !(strokeWidth > 0 && strokeWidth <= 20)) {
+    throw new Error(
+      `Invalid CARD_TEXT_STROKE "${input}". Use "<color>[,<width>]" with a width up to 20px, e.g. "#000000,3".`,
+    );
+  }
+  return { color: formatHexColor(rgb), width: strokeWidth };
+}
+
+// Parses CARD_BACKGROUND_OVERLAY as "<color>[,<alpha>]" with a hex color and
+// an opacity from 0 to 1 (default 0.5).
+function parseOverlay(input) {
+  const value = stringOrNull(input);
+  if (!value) return null;
+
+  const [color, alpha, ...rest] = value.split(",").map((p) => p.trim());
+  const rgb = parseHexColor(color);
+  const opacity = alpha ? Number(alpha) : 0.5;
+  if (!rgb || rest.length || !(opacity >= 0 && opacity <= 1)) {
+    throw new Error(
+      `Invalid CARD_BACKGROUND_OVERLAY "${input}". Use "<color>[,<alpha>]", e.g. "#000000,0.45".`,
+    );
+  }
+  return { rgb, alpha: opacity };
+}
+
+function parseHexColor(value) {
+  const match = /^#?([0-9a-f]{3}|[0-9a-f]{6})$/i.exec(value || "");
+  if (!match) return null;
+  const hex =
+    match[1].length === 3 ? [...match[1]].map((c) => c + c).join("") : match[1];
+  return [0, 2, 4].map((offset) => parseInt(hex.slice(offset, offset + 2), 16));
+}
+
+function formatHexColor(rgb) {
+  const hex = rgb.map((channel) => channel.toString(16).padStart(2, "0"));
+  return `#${hex.join("")}`;
+}
+
+// WCAG relative luminance of an sRGB triple (0–255 channels).
+function relativeLuminance(rgb) {
+  const [r, g, b] = rgb.map((channel) => {
+    const c = channel / 255;
+    return c <= 0.03928 ? c / 12.92 : ((c + 0.055) / 1.055) ** 2.4;
+  });
+  return 0.2126 * r + 0.7152 * g + 0.0722 * b;
+}
+
+function quoteMarks(quote) {
+  return quote.raw ? ["", ""] : QUOTE_MARKS;
+}
+
+// Satori lays out mixed-weight text as flex items, so each word becomes its
+// own wrapping item and the gap stands in for the space between words.
+function renderWordMarkup(
+  text,
+  fontSize,
+  {
+    direction = "ltr",
+    maxWidth = Infinity,
+    marks = QUOTE_MARKS,
+    style = "",
+  } = {},
+) {
+  const [open, close] = marks;
+  // Under CARD_WHITESPACE=trim or none the quote's own line breaks are kept;
+  // spaces inside a line still fold, since words are separate flex items.
+  const lines = text.split("\n").map((line) => buildCardWords(line));
+  const filled = lines.filter((words) => words.length);
+  if (filled.length) {
+    const firstWord = filled[0][0];
+    firstWord[0] = { ...firstWord[0], text: `${open}${firstWord[0].text}` };
+    const lastLine = filled[filled.length - 1];
+    const lastWord = lastLine[lastLine.length - 1];
+    const lastIndex = lastWord.length - 1;
+    lastWord[lastIndex] = {
+      ...lastWord[lastIndex],
+      text: `${lastWord[lastIndex].text}${close}`,
+    };
+  }
+  // Flex items never wrap inside themselves, so over-wide words are cut here.
+  const lineWords = lines.map((words) =>
+    breakLongWords(words, fontSize, maxWidth),
+  );
+
+  const wordGap = Math.round(fontSize * EMPHASIS_WORD_GAP_RATIO);
+  const hasAttached = lineWords.some((words) =>
+    words.some((segments) => segments[0].attached),
+  );
+
+  // Right to left, words fill each line from the right and segments run the
+  // same way inside a word; the glyphs of RTL runs are pre-reversed because
+  // Satori still draws every run left to right.
+  const rtl = direction === "rtl";
+  const flow = rtl ? "row-reverse" : "row";
+  const renderLine = (words) =>
+    words
+      .map((segments) => {
+        const inner = segments
+          .map((segment) =>
+            renderSegmentMarkup(
+              rtl ? { ...segment, text: visualRtlText(segment.text) } : segment,
+              fontSize,
+            ),
+          )
+          .join("");
+        return { inner, attached: Boolean(segments[0].attached) };
+      })
+      .map(({ inner }, index, spans) => {
+        // With CJK pieces in the line, words carry their own trailing gap so
+        // attached pieces can sit flush against the one before.
+        const next = spans[index + 1];
+        const gap =
+          hasAttached && next && !next.attached
+            ? `margin-${rtl ? "left" : "right"}:${wordGap}px;`
+            : "";
+        return `<span style="display:flex;flex-direction:${flow};${gap}">${inner}</span>`;
+      })
+      .join("");
+  // A full-width item always takes a row of its own, so it ends the line; an
+  // empty line gets a line's height.
+  const wordMarkup = lineWords
+    .map((words, index) => {
+      if (!index) return renderLine(words);
+      const height = words.length ? 0 : fontSize * QUOTE_LINE_HEIGHT;
+      return `<span style="display:flex;width:100%;height:${height}px;"></span>${renderLine(words)}`;
+    })
+    .join("");
+  // A reversed row starts at the right, so left and right swap.
+  const align = rtl
+    ? { left: "right", center: "center", right: "left" }[CARD_TEXT_ALIGN]
+    : CARD_TEXT_ALIGN;
+
+  return `<div style="${style}display:flex;flex-direction:${flow};flex-wrap:wrap;justify-content:${TEXT_ALIGNS[align]};column-gap:${hasAttached ? 0 : wordGap}px;font-size:${fontSize}px;line-height:${QUOTE_LINE_HEIGHT};${letterSpacingStyle()}max-width:100%;">${wordMarkup}</div>`;
+}
+
+// "rtl" or "ltr" for the quote: its own `dir`, else TEXT_DIRECTION, with
+// "auto" going by whichever kind of letter the text has more of.
+function quoteDirection(quote) {
+  const direction = quote.dir ?? TEXT_DIRECTION;
+  return direction === "auto" ? detectDirection(quote.quote) : direction;
+}
+
+function detectDirection(text) {
+  const rtl = (String(text).match(RTL_CHARACTER) ?? []).length;
+  const letters = (String(text).match(/\p{L}/gu) ?? []).length;
+  return rtl > letters - rtl ? "rtl" : "ltr";
+}
+
+// A run as Satori must draw it to read right to left: RTL text has its
+// graphemes reversed, so combining marks stay on their letters; anything else
+// is left alone.
+function visualRtlText(text) {
+  if (!text.match(RTL_CHARACTER)) return text;
+  const segmenter = new Intl.Segmenter(undefined, { granularity: "grapheme" });
+  return Array.from(segmenter.segment(text), ({ segment }) => segment)
+    .reverse()
+    .join("");
+}
+
+// An outline around every glyph on cards and covers, for text over a busy
+// CARD_BACKGROUND_IMAGE. Satori paints the stroke under the fill, so only
+// its outer half shows.
+function textStrokeStyle() {
+  if (!CARD_TEXT_STROKE) return "";
+  const { color, width } = CARD_TEXT_STROKE;
+  return `-webkit-text-stroke:${width}px ${color};`;
+}
+
+// Left out at the default so cards render exactly as before the option.
+function letterSpacingStyle() {
+  if (!QUOTE_LETTER_SPACING) return "";
+  return `letter-spacing:${QUOTE_LETTER_SPACING}px;`;
+}
+
+// Satori cannot switch on the font's `tnum` feature, so under
+// CARD_TABULAR_FIGURES each digit is centred in a fixed-width cell instead.
+function renderSegmentMarkup(segment, fontSize) {
+  const weight = segment.bold ? 700 : 400;
+  const style = segment.italic ? "italic" : "normal";
+  const face = `font-weight:${weight};font-style:${style};`;
+  if (!CARD_TABULAR_FIGURES || !/\d/.test(segment.text)) {
+    return `<span style="${face}">${escapeForSatori(segment.text)}</span>`;
+  }
+
+  const cellWidth = Math.round(fontSize * TABULAR_DIGIT_RATIO);
+  const inner = segment.text
+    .split(/(\d)/)
+    .filter(Boolean)
+    .map((piece) =>
+      /^\d$/.test(piece)
+        ? `<span style="display:flex;justify-content:center;width:${cellWidth}px;">${piece}</span>`
+        : `<span>${escapeForSatori(piece)}</span>`,
+    )
+    .join("");
+  return `<span style="display:flex;${face}">${inner}</span>`;
+}
+
+// The card worker loads this module for its renderer, and build/test for its
+// helpers, without running the build.
+export {
+  renderCardImage,
+  writeCardTo,
+  planSourceRedirects,
+  renderWordMarkup,
+  formatQuoteHtml,
+  quoteBox,
+  countQuoteLines,
+  fitCardText,
+  validateCardSettings,
+  loadFonts,
+  loadCardImages,
+  renderQuoteSvg,
+  linkSeries,
+  cardText,
+  normalizeTags,
+  cardColors,
+  contrastRatio,
+  cardQrUrl,
+  buildCardHash,
+  buildWrapperHash,
+  buildGroupItemHash,
+  loadQuotes,
+  manifestsEqual,
+  buildWrapperPayload,
+  buildSourceQuoteHtml,
+  verifyCardFile,
+  buildArticleSlug,
+  buildCardAuthor,
+  colorFromString,
+  cardBackground,
+};
+
+if (isMainThread && path.resolve(process.argv[1] ?? "") === __filename) {
+  main().catch((error) => {
+    console.error(error.stack || error.message);
+    process.exitCode = 1;
+  });
+}
@@ -0,0 +1,1511 @@
+import test from "node:test";
+import assert from "node:assert/strict";
+import { createHash } from "crypto";
+import fs from "fs/promises";
+import path from "path";
+
+import { decode as decodeJpeg } from "jpeg-js";
+
+import { SOLID_PNGS, createSite, quoteFields } from "./helpers.mjs";
+
+test("an old slug gets a redirecting page at the old path", async (t) => {
+  const site = await createSite({
+    "moved.md": quoteFields("moved", {
+      url: "https://example.com/new-title",
+      old_slugs: ["old-title"],
+    }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const stub = "sources/example.com/old-title/index.html";
+  const html = await site.read(stub);
+  assert.match(html, /http-equiv="refresh"/);
+  assert.match(html, /url=\/sources\/example\.com\/new-title\//);
+
+  // An unchanged stub is not written again.
+  const past = new Date("2020-01-01T00:00:00Z");
+  await fs.utimes(site.path(stub), past, past);
+  await site.build();
+  const { mtime } = await fs.stat(site.path(stub));
+  assert.equal(mtime.getTime(), past.getTime());
+});
+
+test("CARD_UNDER_WRAPPER copies the card under the quote's path", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build();
+  // The copy duplicates the card, so toggling it re-renders no cards.
+  const on = await site.build({ CARD_UNDER_WRAPPER: "1" });
+  assert.match(on.stdout, /0 card\(s\) rendered/);
+  assert.deepEqual(
+    await site.readBytes("q/a/card.jpg"),
+    await site.readBytes("cards/a.jpg"),
+  );
+  assert.match(
+    await site.read("q/a/index.html"),
+    /property="og:image" content="[^"]*\/q\/a\/card\.jpg/,
+  );
+
+  // A re-rendered card refreshes its copy.
+  await site.writeQuote("a.md", quoteFields("a", { quote: "New words." }));
+  await site.build({ CARD_UNDER_WRAPPER: "1" });
+  assert.deepEqual(
+    await site.readBytes("q/a/card.jpg"),
+    await site.readBytes("cards/a.jpg"),
+  );
+
+  const off = await site.build();
+  assert.match(off.stdout, /0 card\(s\) rendered/);
+  assert.equal(await site.exists("q/a/card.jpg"), false);
+});
+
+test("the outcome file summarizes each source group", async (t) => {
+  const url = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url, article_title: "An Essay" }),
+    "b.md": quoteFields("b", { url, article_title: "An Essay" }),
+    "c.md": quoteFields("c", { url: "https://blog.example.org/post" }),
+  });
+  t.after(site.remove);
+
+  await site.build({}, ["--outcome=outcome.json"]);
+  const { sources } = JSON.parse(await site.read("outcome.json"));
+  const summary = sources.map((source) => ({
+    ...source,
+    quoteIds: [...source.quoteIds].sort(),
+  }));
+  assert.deepEqual(summary, [
+    {
+      domain: "blog.example.org",
+      slug: "post",
+      title: null,
+      sourceUrl: "https://blog.example.org/post",
+      quoteIds: ["c"],
+      count: 1,
+    },
+    {
+      domain: "example.com",
+      slug: "essay",
+      title: "An Essay",
+      sourceUrl: url,
+      quoteIds: ["a", "b"],
+      count: 2,
+    },
+  ]);
+});
+
+test("MANIFEST_BACKUPS keeps that many earlier manifests", async (t) => {
+  const site = await createSite();
+  t.after(site.remove);
+
+  const manifests = [];
+  for (const round of [1, 2, 3, 4]) {
+    await site.writeQuote(
+      "a.md",
+      quoteFields("a", { quote: `Round ${round}.` }),
+    );
+    await site.build({ MANIFEST_BACKUPS: "2" });
+    manifests.push(await site.read("build-manifest.json"));
+  }
+
+  assert.equal(await site.read("build-manifest.json.1"), manifests[2]);
+  assert.equal(await site.read("build-manifest.json.2"), manifests[1]);
+  assert.equal(await site.exists("build-manifest.json.3"), false);
+});
+
+test("WRAPPER_STYLE=flat writes <id>.html and links to it", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: "https://example.com/essay" }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  assert.equal(await site.exists("q/a/index.html"), true);
+
+  const { stdout } = await site.build({ WRAPPER_STYLE: "flat" });
+  assert.match(stdout, /0 card\(s\) rendered/);
+  assert.equal(await site.exists("q/a.html"), true);
+  assert.equal(await site.exists("q/a"), false);
+  const sourcePage = await site.read("sources/example.com/essay/index.html");
+  assert.match(sourcePage, /href="\/q\/a\.html"/);
+  assert.doesNotMatch(sourcePage, /href="\/q\/a\/"/);
+
+  // The CARD_UNDER_WRAPPER copy moves with the wrapper, still unrendered.
+  const env = { CARD_UNDER_WRAPPER: "1" };
+  await site.build({ ...env, WRAPPER_STYLE: "flat" });
+  assert.equal(await site.exists("q/a.jpg"), true);
+  const back = await site.build(env);
+  assert.match(back.stdout, /0 card\(s\) rendered/);
+  assert.equal(await site.exists("q/a.jpg"), false);
+  assert.deepEqual(
+    await site.readBytes("q/a/card.jpg"),
+    await site.readBytes("cards/a.jpg"),
+  );
+});
+
+test("AUTO_ID gives identical id-less quotes distinct ids", async (t) => {
+  const fields = {
+    quote: "Small changes compound into big ones.",
+    name: "Ada Lovelace",
+    url: "https://example.com/essay",
+  };
+  const site = await createSite({ "a.md": fields, "b.md": fields });
+  t.after(site.remove);
+
+  await assert.rejects(site.build(), (error) =>
+    /missing required field "id"/.test(error.stderr),
+  );
+
+  const { stderr } = await site.build({ AUTO_ID: "1" }, [
+    "--outcome=outcome.json",
+  ]);
+  assert.match(stderr, /using derived id/);
+  const [{ quoteIds }] = JSON.parse(await site.read("outcome.json")).sources;
+  const [first, second] = [...quoteIds].sort();
+  assert.match(first, /^small-changes-compound-into-big-[0-9a-f]{8}$/);
+  assert.equal(second, `${first}-2`);
+});
+
+test(
+  "FILE_MODE and DIR_MODE apply to what the build creates",
+  { skip: process.platform === "win32" && "POSIX modes only" },
+  async (t) => {
+    const site = await createSite({ "a.md": quoteFields("a") });
+    t.after(site.remove);
+    await fs.chmod(site.dir, 0o755);
+    await fs.chmod(site.path("quotes"), 0o755);
+
+    await site.build({ FILE_MODE: "0640", DIR_MODE: "0750" });
+    const mode = async (file) =>
+      (await fs.stat(site.path(file))).mode & 0o777;
+    assert.equal(await mode("cards/a.jpg"), 0o640);
+    assert.equal(await mode("q/a/index.html"), 0o640);
+    assert.equal(await mode("q/a"), 0o750);
+    assert.equal(await mode("cards"), 0o750);
+    // Directories that were there before the build keep their mode.
+    assert.equal(await mode("."), 0o755);
+    assert.equal(await mode("quotes"), 0o755);
+  },
+);
+
+test("--explain blames a wrapper template change for every quote", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const template = site.path("build", "templates", "wrapper.html");
+  await fs.appendFile(template, "<!-- changed -->\n");
+  const { stdout } = await site.build({}, ["--explain"]);
+  for (const id of ["a", "b"]) {
+    assert.match(stdout, new RegExp(`${id}: .*wrapper: template changed`));
+  }
+});
+
+test("body_file loads the body from quotes/ and nowhere else", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", {
+      url: "https://example.com/essay",
+      body_file: "a.body.md",
+    }),
+  });
+  t.after(site.remove);
+  await fs.writeFile(site.path("quotes", "a.body.md"), "Notes on the side.");
+
+  await site.build();
+  assert.match(
+    await site.read("sources/example.com/essay/index.html"),
+    /Notes on the side\./,
+  );
+
+  await fs.writeFile(site.path("secret.md"), "Not for publishing.");
+  await site.writeQuote(
+    "a.md",
+    quoteFields("a", { body_file: "../secret.md" }),
+  );
+  await assert.rejects(site.build(), (error) =>
+    /body_file "\.\.\/secret\.md" is outside the quotes directory/.test(
+      error.stderr,
+    ),
+  );
+});
+
+test("EMIT_ALL writes all.html with every quote", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: "https://example.com/one" }),
+    "b.md": quoteFields("b", { url: "https://example.com/two" }),
+    "c.md": quoteFields("c", { url: "https://example.org/three" }),
+  });
+  t.after(site.remove);
+
+  await site.build({ EMIT_ALL: "1" });
+  const html = await site.read("all.html");
+  for (const id of ["a", "b", "c"]) {
+    assert.ok(html.includes(`The words of quote ${id}.`), id);
+  }
+});
+
+test("ids and source domains that escape the output dirs are rejected", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("../../escaped"),
+    "b.md": quoteFields("b", { source_domain: "example.com/.." }),
+  });
+  t.after(site.remove);
+
+  await assert.rejects(site.build(), (error) => {
+    assert.match(
+      error.stderr,
+      /id "\.\.\/\.\.\/escaped" is not a safe path segment/,
+    );
+    assert.match(
+      error.stderr,
+      /source domain "example\.com\/\.\." is not a safe path segment/,
+    );
+    return true;
+  });
+  assert.equal(await site.exists("../escaped.jpg"), false);
+  assert.equal(await site.exists("cards"), false);
+});
+
+test("og:image dimensions match the card layout", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_WIDTH: "1080", CARD_HEIGHT: "1350" });
+  const html = await site.read("q/a/index.html");
+  assert.match(html, /property="og:image:width" content="1080"/);
+  assert.match(html, /property="og:image:height" content="1350"/);
+});
+
+test("DESCRIPTION_PATTERN drops bracketed parts with no author", async (t) => {
+  const article = { url: "https://example.com/essay", article_title: "Essay" };
+  const site = await createSite({
+    "a.md": quoteFields("a", article),
+    "b.md": { ...quoteFields("b", article), name: "" },
+  });
+  t.after(site.remove);
+
+  await site.build({
+    ALLOW_ANONYMOUS: "1",
+    DESCRIPTION_PATTERN: "[{author} in ]{article} on {domain}",
+  });
+  const description = async (id) =>
+    (await site.read(`q/${id}/index.html`)).match(
+      /property="og:description" content="([^"]*)"/,
+    )[1];
+  assert.equal(await description("a"), "Ada Lovelace in Essay on example.com");
+  assert.equal(await description("b"), "Essay on example.com");
+});
+
+test("an empty series_part is no part, not part 0", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { series: "Thread", series_part: 1 }),
+    "b.md": quoteFields("b", { series: "Thread", series_part: "" }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const wrapper = await site.read("q/b/index.html");
+  assert.match(wrapper, /Part 2 of 2 in Thread/);
+  assert.match(wrapper, /rel="prev" href="\/q\/a\/"/);
+});
+
+test("--plan lists exactly the files a build writes", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: "https://example.com/one" }),
+    "b.md": quoteFields("b", { url: "https://example.com/one" }),
+    "c.md": quoteFields("c", { url: "https://example.org/two" }),
+  });
+  t.after(site.remove);
+  const env = {
+    CARD_UNDER_WRAPPER: "1",
+    CARD_SCALES: "2",
+    SQUARE_CARDS: "1",
+    EMIT_QUOTE_JSON: "1",
+    EMIT_ALL: "1",
+    EMIT_HEADERS: "1",
+    EMIT_LLMS_TXT: "1",
+    EMIT_SEARCH_INDEX: "1",
+    EMIT_GRAPH_DOT: "1",
+  };
+
+  const { stdout } = await site.build(env, ["--plan"]);
+  assert.deepEqual(await site.listOutputs(), []);
+  await site.build(env);
+  assert.deepEqual(stdout.trim().split("\n"), await site.listOutputs());
+});
+
+test("CARDS_ONLY writes cards alone and a full build adds the pages", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARDS_ONLY: "1" });
+  assert.deepEqual(await site.listOutputs(), [
+    "build-manifest.json",
+    "cards/a.jpg",
+  ]);
+  const manifest = JSON.parse(await site.read("build-manifest.json"));
+  assert.equal(manifest.cardsOnly, true);
+  assert.deepEqual(Object.keys(manifest.quotes.a), [
+    "cardHash",
+    "formatHashes",
+    "scaleHashes",
+  ]);
+
+  // The card is current, so the full build only adds the pages around it.
+  const past = new Date("2020-01-01T00:00:00Z");
+  await fs.utimes(site.path("cards/a.jpg"), past, past);
+  await site.build();
+  assert.ok(await site.exists("q/a/index.html"));
+  assert.ok(await site.exists("sources/example.com/articles-a/index.html"));
+  const { mtime } = await fs.stat(site.path("cards/a.jpg"));
+  assert.equal(mtime.getTime(), past.getTime());
+});
+
+test("EMIT_HEADERS writes cache rules and is removed when off", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ EMIT_HEADERS: "1", EMIT_ALL: "1" });
+  assert.equal(
+    await site.read("_headers"),
+    [
+      "/cards/*\n  Cache-Control: public, max-age=86400",
+      "/q/*\n  Cache-Control: public, max-age=300, must-revalidate",
+      "/sources/*\n  Cache-Control: public, max-age=300, must-revalidate",
+      "/all.html\n  Cache-Control: public, max-age=300, must-revalidate",
+    ].join("\n\n") + "\n",
+  );
+
+  await site.build();
+  assert.equal(await site.exists("_headers"), false);
+});
+
+test("og_image replaces the social preview but not the card", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { og_image: "https://cdn.example/a.png" }),
+    "b.md": quoteFields("b", { og_image: "not an image" }),
+  });
+  t.after(site.remove);
+
+  const { stderr } = await site.build();
+  const a = await site.read("q/a/index.html");
+  const override = 'content="https://cdn.example/a.png"';
+  assert.ok(a.includes(`property="og:image" ${override}`));
+  assert.ok(a.includes(`name="twitter:image" ${override}`));
+  assert.doesNotMatch(a, /og:image:width/);
+  assert.ok(await site.exists("cards/a.jpg"));
+
+  assert.match(stderr, /og_image "not an image" is not an http\(s\) URL/);
+  const b = await site.read("q/b/index.html");
+  assert.match(b, /property="og:image" content="[^"]*\/cards\/b\.jpg/);
+});
+
+test("removing a domain's last quote removes its directory", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b", { url: "https://blog.example.org/post" }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  assert.ok(await site.exists("sources/blog.example.org/post/index.html"));
+  await site.removeQuote("b.md");
+  await site.build();
+  assert.equal(await site.exists("sources/blog.example.org"), false);
+  assert.ok(await site.exists("sources/example.com/articles-a/index.html"));
+});
+
+test("EXCLUDE_IDS builds as if the quotes were deleted", async (t) => {
+  const url = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url }),
+    "b.md": quoteFields("b", { url }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const sourcePage = "sources/example.com/essay/index.html";
+  assert.match(await site.read(sourcePage), /quote b\./);
+  const { stderr } = await site.build({ EXCLUDE_IDS: "b, missing" });
+  assert.equal(await site.exists("cards/b.jpg"), false);
+  assert.equal(await site.exists("q/b/index.html"), false);
+  assert.ok(await site.exists("q/a/index.html"));
+  assert.doesNotMatch(await site.read(sourcePage), /quote b\./);
+  assert.match(stderr, /EXCLUDE_IDS: no quote has id "missing"/);
+});
+
+test(
+  "an unwritable manifest fails with ManifestSaveError",
+  { skip: process.getuid?.() === 0 && "root can write to any directory" },
+  async (t) => {
+    const site = await createSite({ "a.md": quoteFields("a") });
+    t.after(site.remove);
+    await fs.mkdir(site.path("state"), { mode: 0o555 });
+
+    await assert.rejects(
+      site.build({ MANIFEST_NAME: "state/manifest.json" }),
+      (error) => {
+        assert.match(
+          error.stderr,
+          /ManifestSaveError: Cannot write build manifest state\/manifest\.json: permission denied \(EACCES\)/,
+        );
+        return true;
+      },
+    );
+    assert.ok(await site.exists("cards/a.jpg"));
+  },
+);
+
+test("SOURCE_COVERS re-renders a cover only when its source changes", async (t) => {
+  const url = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url, article_title: "An Essay" }),
+    "b.md": quoteFields("b", { url: "https://example.org/other" }),
+  });
+  t.after(site.remove);
+  const env = { SOURCE_COVERS: "1" };
+  const cover = "sources/example.com/essay/cover.jpg";
+  const coverTime = async () =>
+    (await fs.stat(site.path(cover))).mtime.getTime();
+
+  await site.build(env);
+  assert.match(
+    await site.read("sources/example.com/essay/index.html"),
+    /property="og:image" content="[^"]*\/sources\/example\.com\/essay\/cover\.jpg"/,
+  );
+
+  // A quote from another source leaves this cover alone.
+  const past = new Date("2020-01-01T00:00:00Z");
+  await fs.utimes(site.path(cover), past, past);
+  const other = { url: "https://example.org/more" };
+  await site.writeQuote("c.md", quoteFields("c", other));
+  await site.build(env);
+  assert.equal(await coverTime(), past.getTime());
+
+  // One more quote from this source changes its count.
+  await site.writeQuote("d.md", quoteFields("d", { url }));
+  await site.build(env);
+  assert.notEqual(await coverTime(), past.getTime());
+});
+
+test("a rebuild with no changes leaves the manifest file alone", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build();
+  const before = await site.read("build-manifest.json");
+  await site.build();
+  assert.equal(await site.read("build-manifest.json"), before);
+});
+
+test("EMIT_QUOTE_JSON writes a sidecar beside each wrapper", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", {
+      url: "https://example.com/essay",
+      article_title: "An Essay",
+      created_at: "2024-03-01",
+      tags: ["engines", "notes"],
+    }),
+  });
+  t.after(site.remove);
+  const env = { EMIT_QUOTE_JSON: "1", SITE_ORIGIN: "https://quotes.example" };
+
+  await site.build(env);
+  assert.deepEqual(JSON.parse(await site.read("q/a/data.json")), {
+    id: "a",
+    quote: "The words of quote a.",
+    author: "Ada Lovelace",
+    url: "https://example.com/essay",
+    articleTitle: "An Essay",
+    sourceDomain: "example.com",
+    sourceName: null,
+    articleSlug: "essay",
+    createdAt: "2024-03-01T00:00:00.000Z",
+    tags: ["engines", "notes"],
+    series: null,
+    pageUrl: "https://quotes.example/q/a/",
+    cardUrl: "https://quotes.example/cards/a.jpg",
+  });
+
+  await site.removeQuote("a.md");
+  await site.build(env);
+  assert.equal(await site.exists("q/a/data.json"), false);
+});
+
+test("hide_from_source keeps a quote off its source page only", async (t) => {
+  const url = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url }),
+    "b.md": quoteFields("b", { url, hide_from_source: true }),
+    "c.md": quoteFields("c", { hide_from_source: true }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const sourcePage = await site.read("sources/example.com/essay/index.html");
+  assert.match(sourcePage, /quote a\./);
+  assert.doesNotMatch(sourcePage, /quote b\./);
+  assert.ok(await site.exists("q/b/index.html"));
+  assert.ok(await site.exists("cards/b.jpg"));
+
+  // A source with only hidden quotes gets no page at all.
+  assert.ok(await site.exists("q/c/index.html"));
+  assert.equal(await site.exists("sources/example.com/articles-c"), false);
+});
+
+test("CARD_SCALES writes scaled cards and a matching srcset", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_SCALES: "2" });
+  assert.ok(await site.exists("cards/a@2x.jpg"));
+
+  // Adding a scale renders only the new copies.
+  const added = await site.build({ CARD_SCALES: "2,3" });
+  assert.match(added.stdout, /0 card\(s\) rendered/);
+  assert.match(added.stdout, /1 card\(s\) rendered at new scales/);
+  assert.ok(await site.exists("cards/a@2x.jpg"));
+  assert.ok(await site.exists("cards/a@3x.jpg"));
+  assert.match(
+    await site.read("q/a/index.html"),
+    /srcset="\/cards\/a\.jpg 1x, \/cards\/a@2x\.jpg 2x, \/cards\/a@3x\.jpg 3x"/,
+  );
+  const unchanged = await site.build({ CARD_SCALES: "2,3" });
+  assert.doesNotMatch(unchanged.stdout, /at new scales/);
+
+  const dropped = await site.build({ CARD_SCALES: "2" });
+  assert.match(dropped.stdout, /0 card\(s\) rendered/);
+  assert.ok(await site.exists("cards/a@2x.jpg"));
+  assert.equal(await site.exists("cards/a@3x.jpg"), false);
+});
+
+test("the outcome counts skipped outputs on an unchanged rebuild", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+  const outcome = async () => {
+    await site.build({}, ["--outcome=outcome.json"]);
+    const counts = JSON.parse(await site.read("outcome.json"));
+    return [
+      counts.cardsRendered,
+      counts.cardsSkipped,
+      counts.wrappersRendered,
+      counts.wrappersSkipped,
+      counts.sourcePagesRendered,
+      counts.sourcePagesSkipped,
+    ];
+  };
+
+  assert.deepEqual(await outcome(), [2, 0, 2, 0, 2, 0]);
+  assert.deepEqual(await outcome(), [0, 2, 0, 2, 0, 2]);
+  assert.match(
+    (await site.build()).stdout,
+    /2 card\(s\) unchanged 2 wrapper\(s\) unchanged 2 source page\(s\) unchanged/,
+  );
+});
+
+test("optional italic faces load when present and must be fonts", async (t) => {
+  const site = await createSite();
+  t.after(site.remove);
+  const fonts = site.path("assets", "fonts");
+  const faces = async () => {
+    const { loadFonts } = await site.importRender();
+    return (await loadFonts()).map((font) => `${font.weight} ${font.style}`);
+  };
+
+  assert.deepEqual(await faces(), ["400 normal", "700 normal"]);
+
+  await fs.copyFile(
+    path.join(fonts, "AtkinsonHyperlegible-Regular.ttf"),
+    path.join(fonts, "AtkinsonHyperlegible-Italic.ttf"),
+  );
+  assert.deepEqual(await faces(), ["400 normal", "700 normal", "400 italic"]);
+
+  await fs.writeFile(
+    path.join(fonts, "AtkinsonHyperlegible-BoldItalic.ttf"),
+    "not a font",
+  );
+  await assert.rejects(
+    faces(),
+    /AtkinsonHyperlegible-BoldItalic\.ttf is not a TrueType/,
+  );
+});
+
+test("INLINE_CSS is inlined into every page and regenerates them", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const env = { INLINE_CSS: "site.css", EMIT_ALL: "1" };
+  const pages = [
+    "q/a/index.html",
+    "sources/example.com/articles-a/index.html",
+    "all.html",
+  ];
+
+  await fs.writeFile(site.path("site.css"), "body { color: teal; }\n");
+  await site.build(env);
+  for (const page of pages) {
+    assert.match(await site.read(page), /<style>\s*body \{ color: teal; \}/);
+  }
+
+  // A stray closing tag can't end the block early.
+  await fs.writeFile(site.path("site.css"), "/* </style><script> */\n");
+  await site.build(env);
+  for (const page of pages) {
+    const html = await site.read(page);
+    assert.match(html, /\/\* <\\\/style><script> \*\//, page);
+    assert.doesNotMatch(html, /teal/, page);
+  }
+
+  await assert.rejects(site.build({ INLINE_CSS: "missing.css" }), (error) => {
+    assert.match(error.stderr, /INLINE_CSS file not found: missing\.css/);
+    return true;
+  });
+});
+
+test("CARD_SHARDING moves cards into hashed directories and back", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const shard = createHash("sha256").update("a").digest("hex").slice(0, 2);
+
+  await site.build({ CARD_SHARDING: "2" });
+  assert.ok(await site.exists(`cards/${shard}/a.jpg`));
+  assert.match(
+    await site.read("q/a/index.html"),
+    new RegExp(`/cards/${shard}/a\\.jpg`),
+  );
+
+  await site.build();
+  assert.ok(await site.exists("cards/a.jpg"));
+  assert.equal(await site.exists(`cards/${shard}`), false);
+});
+
+test("source_name shows a publication name but keeps domain paths", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", {
+      url: "https://theatlantic.com/essay",
+      source_name: "The Atlantic",
+    }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const sourcePage = await site.read(
+    "sources/theatlantic.com/essay/index.html",
+  );
+  assert.match(sourcePage, /<title>[^<]*The Atlantic/);
+  assert.match(sourcePage, /<h1>[^<]*The Atlantic/);
+  assert.match(
+    await site.read("q/a/index.html"),
+    /name="description" content="Ada Lovelace on The Atlantic"/,
+  );
+});
+
+test("a 1080×1350 card decodes at that size", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_WIDTH: "1080", CARD_HEIGHT: "1350" });
+  const { width, height } = decodeJpeg(await site.readBytes("cards/a.jpg"));
+  assert.deepEqual([width, height], [1080, 1350]);
+});
+
+test("EMIT_LLMS_TXT lists every quote by absolute URL, newest first", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { created_at: "2024-01-01" }),
+    "b.md": quoteFields("b", {
+      created_at: "2024-06-01",
+      article_title: "On [Engines]",
+    }),
+  });
+  t.after(site.remove);
+  const env = { EMIT_LLMS_TXT: "1", SITE_ORIGIN: "https://quotes.example" };
+
+  await site.build(env);
+  const links = (await site.read("llms.txt"))
+    .split("\n")
+    .filter((line) => line.startsWith("- "));
+  assert.deepEqual(links, [
+    "- [On \\[Engines\\]](https://quotes.example/q/b/): “The words of quote b.” — Ada Lovelace",
+    "- [example.com](https://quotes.example/q/a/): “The words of quote a.” — Ada Lovelace",
+  ]);
+
+  await site.removeQuote("a.md");
+  await site.removeQuote("b.md");
+  await site.build(env);
+  assert.equal(await site.exists("llms.txt"), false);
+});
+
+test("SQUARE_CARDS adds square cards tracked apart from the main one", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const env = { SQUARE_CARDS: "1" };
+
+  await site.build();
+  const past = new Date("2020-01-01T00:00:00Z");
+  await fs.utimes(site.path("cards/a.jpg"), past, past);
+
+  await site.build(env);
+  const square = decodeJpeg(await site.readBytes("cards/a-square.jpg"));
+  assert.deepEqual([square.width, square.height], [1080, 1080]);
+  const { mtime } = await fs.stat(site.path("cards/a.jpg"));
+  assert.equal(mtime.getTime(), past.getTime());
+  assert.match(
+    await site.read("sources/example.com/articles-a/index.html"),
+    /<a href="\/cards\/a-square\.jpg">Download square<\/a>/,
+  );
+
+  await site.build();
+  assert.equal(await site.exists("cards/a-square.jpg"), false);
+});
+
+test("STORY_CARDS adds a vertical card with its own manifest hash", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ STORY_CARDS: "1" });
+  const story = decodeJpeg(await site.readBytes("cards/a-story.jpg"));
+  assert.deepEqual([story.width, story.height], [1080, 1920]);
+  const manifest = JSON.parse(await site.read("build-manifest.json"));
+  assert.deepEqual(Object.keys(manifest.quotes.a.formatHashes), ["story"]);
+  assert.match(
+    await site.read("sources/example.com/articles-a/index.html"),
+    /<a href="\/cards\/a-story\.jpg">Download story<\/a>/,
+  );
+});
+
+test("MANIFEST_NAME moves the manifest and later builds find it", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const env = { MANIFEST_NAME: ".cache/quote-manifest.json" };
+
+  await site.build(env);
+  assert.ok(await site.exists(".cache/quote-manifest.json"));
+  assert.equal(await site.exists("build-manifest.json"), false);
+  const { stdout } = await site.build(env);
+  assert.match(stdout, /0 card\(s\) rendered/);
+
+  for (const name of ["../manifest.json", "cards/manifest.json"]) {
+    await assert.rejects(site.build({ MANIFEST_NAME: name }), (error) => {
+      assert.match(error.stderr, /MANIFEST_NAME (must stay|cannot live)/);
+      return true;
+    });
+  }
+});
+
+test("quotes without a source domain are warned about together", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: "mailto:ada@example.com" }),
+  });
+  t.after(site.remove);
+  const warning = /quotes have no source domain/;
+
+  assert.doesNotMatch((await site.build()).stderr, warning);
+
+  await site.writeQuote(
+    "b.md",
+    quoteFields("b", { url: "mailto:grace@example.com" }),
+  );
+  const { stderr } = await site.build();
+  assert.match(
+    stderr,
+    /2 quotes have no source domain and are grouped under "unknown-source": a, b\. Give each an http\(s\) url or set source_domain\./,
+  );
+});
+
+test("CARD_IMAGE_FORMAT=png writes PNG cards at the card size", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_IMAGE_FORMAT: "png" });
+  assert.equal(await site.exists("cards/a.jpg"), false);
+  assert.match(
+    await site.read("q/a/index.html"),
+    /property="og:image" content="[^"]*\/cards\/a\.png"/,
+  );
+
+  const png = await site.readBytes("cards/a.png");
+  assert.equal(png.toString("latin1", 1, 4), "PNG");
+  assert.equal(png.toString("latin1", 12, 16), "IHDR");
+  assert.deepEqual([png.readUInt32BE(16), png.readUInt32BE(20)], [1200, 628]);
+});
+
+test("CARD_WATERMARK re-renders every card with the stamp drawn", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build();
+  const plain = await site.readBytes("cards/a.jpg");
+  const { stdout } = await site.build({ CARD_WATERMARK: "DRAFT" });
+  assert.match(stdout, /1 card\(s\) rendered/);
+  assert.notDeepEqual(await site.readBytes("cards/a.jpg"), plain);
+
+  await site.build();
+  assert.deepEqual(await site.readBytes("cards/a.jpg"), plain);
+});
+
+test("grouping ignores the query but pages link the url as written", async (t) => {
+  const tracked = "https://example.com/essay?utm_source=feed&id=7#part-2";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: "https://example.com/essay" }),
+    "b.md": quoteFields("b", { url: tracked }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  const sourcePage = await site.read("sources/example.com/essay/index.html");
+  assert.match(sourcePage, /quote a\./);
+  assert.match(sourcePage, /quote b\./);
+  assert.ok((await site.read("q/b/index.html")).includes(`href="${tracked}"`));
+});
+
+test("EMIT_SEARCH_INDEX writes one document per quote, newest first", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { created_at: "2024-01-01", tags: ["engines"] }),
+    "b.md": quoteFields("b", {
+      created_at: "2024-06-01",
+      article_title: "Sketches",
+      source_name: "Example Press",
+    }),
+  });
+  t.after(site.remove);
+
+  await site.build({ EMIT_SEARCH_INDEX: "1", BASE_PATH: "/quotes" });
+  assert.deepEqual(JSON.parse(await site.read("search-index.json")), {
+    version: 1,
+    documents: [
+      {
+        id: "b",
+        url: "/quotes/q/b/",
+        quote: "The words of quote b.",
+        author: "Ada Lovelace",
+        title: "Sketches",
+        source: "Example Press",
+        tags: [],
+      },
+      {
+        id: "a",
+        url: "/quotes/q/a/",
+        quote: "The words of quote a.",
+        author: "Ada Lovelace",
+        title: null,
+        source: "example.com",
+        tags: ["engines"],
+      },
+    ],
+  });
+
+  await site.build();
+  assert.equal(await site.exists("search-index.json"), false);
+});
+
+test("ALLOW_ANONYMOUS builds a quote without a name", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { name: undefined }),
+  });
+  t.after(site.remove);
+
+  await assert.rejects(site.build(), (error) => {
+    assert.match(error.stderr, /quotes\/a\.md: missing required field "name"/);
+    return true;
+  });
+
+  const { stderr } = await site.build({ ALLOW_ANONYMOUS: "1" });
+  assert.match(stderr, /quotes\/a\.md: no "name"; building it as anonymous\./);
+  const wrapper = await site.read("q/a/index.html");
+  assert.match(
+    wrapper,
+    /name="description" content="Collected from example\.com"/,
+  );
+  assert.doesNotMatch(wrapper, /<cite/);
+});
+
+test("a quote's theme re-renders only its own card", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  await site.writeQuote("a.md", quoteFields("a", { theme: "dark" }));
+  const { stdout } = await site.build();
+  assert.match(stdout, /1 card\(s\) rendered/);
+
+  await site.writeQuote("b.md", quoteFields("b", { theme: "neon" }));
+  const { stderr } = await site.build();
+  assert.match(
+    stderr,
+    /quotes\/b\.md: unknown theme "neon"; using the default "light"\./,
+  );
+});
+
+test("EMIT_BASE_HREF adds a base element under BASE_PATH", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const pages = ["q/a/index.html", "sources/example.com/articles-a/index.html"];
+
+  await site.build({ EMIT_BASE_HREF: "1", BASE_PATH: "/quotes" });
+  for (const page of pages) {
+    assert.match(await site.read(page), /<base href="\/quotes\/" \/>/, page);
+  }
+
+  await site.build({ EMIT_BASE_HREF: "1" });
+  assert.match(await site.read(pages[0]), /<base href="\/" \/>/);
+
+  await site.build();
+  for (const page of pages) {
+    assert.doesNotMatch(await site.read(page), /<base /, page);
+  }
+});
+
+test("PAGES_ONLY rebuilds source pages and leaves cards and wrappers", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const past = new Date("2020-01-01T00:00:00Z");
+  const mtime = async (file) =>
+    (await fs.stat(site.path(file))).mtime.getTime();
+
+  await site.build();
+  for (const file of ["cards/a.jpg", "q/a/index.html"]) {
+    await fs.utimes(site.path(file), past, past);
+  }
+  await site.writeQuote("a.md", quoteFields("a", { quote: "New words." }));
+  await site.build({ PAGES_ONLY: "1" });
+  assert.equal(await mtime("cards/a.jpg"), past.getTime());
+  assert.equal(await mtime("q/a/index.html"), past.getTime());
+  assert.match(
+    await site.read("sources/example.com/articles-a/index.html"),
+    /New words\./,
+  );
+
+  // The next full build catches up on what PAGES_ONLY skipped.
+  const { stdout } = await site.build();
+  assert.match(stdout, /1 card\(s\) rendered 1 wrapper\(s\) updated/);
+
+  await assert.rejects(
+    site.build({ PAGES_ONLY: "1", CARDS_ONLY: "1" }),
+    (error) => {
+      assert.match(error.stderr, /CARDS_ONLY and PAGES_ONLY cannot be combined/);
+      return true;
+    },
+  );
+});
+
+test("CARD_SCALE=2 doubles the card's pixels and its og:image size", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_SCALE: "2" });
+  const card = decodeJpeg(await site.readBytes("cards/a.jpg"));
+  assert.deepEqual([card.width, card.height], [2400, 1256]);
+  const wrapper = await site.read("q/a/index.html");
+  assert.match(wrapper, /property="og:image:width" content="2400"/);
+  assert.match(wrapper, /property="og:image:height" content="1256"/);
+
+  await assert.rejects(site.build({ CARD_SCALE: "5" }), (error) => {
+    assert.match(error.stderr, /Invalid CARD_SCALE "5"/);
+    return true;
+  });
+});
+
+test("CARD_JPEG_QUALITY re-renders cards and is clamped to 1–100", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build();
+  const standard = await site.readBytes("cards/a.jpg");
+  const { stdout } = await site.build({ CARD_JPEG_QUALITY: "40" });
+  assert.match(stdout, /1 card\(s\) rendered/);
+  const lower = await site.readBytes("cards/a.jpg");
+  assert.ok(lower.length < standard.length, `${lower.length} bytes`);
+
+  const { stderr } = await site.build({ CARD_JPEG_QUALITY: "150" });
+  assert.match(stderr, /CARD_JPEG_QUALITY 150 is outside 1–100; using 100\./);
+});
+
+test("card_bg takes a hex color and ignores anything else", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { card_bg: "#1A2" }),
+    "b.md": quoteFields("b", { card_bg: "teal" }),
+  });
+  t.after(site.remove);
+
+  const render = await site.importRender();
+  const { quotes, warnings } = await render.loadQuotes();
+  const byId = Object.fromEntries(quotes.map((quote) => [quote.id, quote]));
+  assert.equal(byId.a.cardBg, "#11aa22");
+  assert.equal(byId.b.cardBg, null);
+  assert.deepEqual(warnings, [
+    'quotes/b.md: card_bg "teal" is not a hex color like "#102030"; using the theme background.',
+  ]);
+
+  // A dark background gets the light paper color for its text.
+  assert.deepEqual(render.cardColors("light", "#11aa22"), {
+    background: "background:#11aa22",
+    color: "#f7f4ec",
+  });
+});
+
+test("REDIRECT_ON_RENAME leaves a redirect at a renamed quote's old page", async (t) => {
+  const fields = quoteFields("old-id");
+  const site = await createSite({ "a.md": fields });
+  t.after(site.remove);
+  const env = { REDIRECT_ON_RENAME: "1" };
+
+  await site.build(env);
+  await site.writeQuote("a.md", { ...fields, id: "new-id" });
+  const { stderr } = await site.build(env);
+  assert.match(
+    stderr,
+    /Quote "old-id" looks renamed to "new-id"; redirecting its old page\./,
+  );
+  const stub = await site.read("q/old-id/index.html");
+  assert.match(stub, /http-equiv="refresh" content="0; url=\/q\/new-id\/"/);
+  assert.ok(await site.exists("q/new-id/index.html"));
+  assert.equal(await site.exists("cards/old-id.jpg"), false);
+
+  // Reusing the old id replaces the redirect with a real page.
+  await site.writeQuote("b.md", quoteFields("old-id"));
+  await site.build(env);
+  assert.doesNotMatch(await site.read("q/old-id/index.html"), /http-equiv/);
+});
+
+test("swapping the CARD_LOGO file re-renders every card", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+  const env = { CARD_LOGO: "logo.png" };
+
+  await fs.writeFile(site.path("logo.png"), SOLID_PNGS.red);
+  await site.build(env);
+  assert.match((await site.build(env)).stdout, /0 card\(s\) rendered/);
+
+  await fs.writeFile(site.path("logo.png"), SOLID_PNGS.blue);
+  assert.match((await site.build(env)).stdout, /2 card\(s\) rendered/);
+
+  await assert.rejects(
+    site.build({ ...env, CARD_QR: "1", CARD_QR_TARGET: "source" }),
+    (error) => {
+      assert.match(
+        error.stderr,
+        /CARD_LOGO cannot share the bottom-right corner/,
+      );
+      return true;
+    },
+  );
+});
+
+test("CAPTURE_FRONT_MATTER keeps custom front-matter keys", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { mood: "wry <ish>", spoken: false }),
+  });
+  t.after(site.remove);
+  const template = site.path("build", "templates", "wrapper.html");
+  const html = await fs.readFile(template, "utf8");
+  await fs.writeFile(
+    template,
+    html.replace(
+      "</body>",
+      '<p class="mood">{{fm_mood}}</p>{{#fm_spoken}}spoken{{/fm_spoken}}</body>',
+    ),
+  );
+
+  await site.build({ CAPTURE_FRONT_MATTER: "1", EMIT_QUOTE_JSON: "1" });
+  const data = JSON.parse(await site.read("q/a/data.json"));
+  assert.equal(data.frontMatter.mood, "wry <ish>");
+  assert.equal(data.frontMatter.spoken, false);
+  const page = await site.read("q/a/index.html");
+  assert.match(page, /<p class="mood">wry &lt;ish&gt;<\/p>/);
+  assert.doesNotMatch(page, /spoken<\/body>/);
+
+  await site.build({ EMIT_QUOTE_JSON: "1" });
+  assert.equal(
+    "frontMatter" in JSON.parse(await site.read("q/a/data.json")),
+    false,
+  );
+});
+
+test("TEXT_DIRECTION=auto goes by the quote's letters", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { quote: "שלום עולם, said Ada" }),
+    "b.md": quoteFields("b", { quote: "שלום עולם", dir: "ltr" }),
+    "c.md": quoteFields("c"),
+  });
+  t.after(site.remove);
+
+  await site.build({ TEXT_DIRECTION: "auto" });
+  assert.match(await site.read("q/a/index.html"), /<blockquote dir="rtl">/);
+  assert.match(await site.read("q/b/index.html"), /<blockquote dir="ltr">/);
+  assert.match(await site.read("q/c/index.html"), /<blockquote dir="ltr">/);
+});
+
+test("CARD_OVERFLOW=truncate warns about the cut quote", async (t) => {
+  const quote = Array.from({ length: 200 }, (_, i) => `word${i}`).join(" ");
+  const site = await createSite({ "a.md": quoteFields("a", { quote }) });
+  t.after(site.remove);
+
+  const { stderr } = await site.build({ CARD_OVERFLOW: "truncate" });
+  assert.match(
+    stderr,
+    /quotes\/a\.md: the quote does not fit the card; it is cut short\./,
+  );
+});
+
+test("templates warn about placeholders the build never fills", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const warnings = (stderr) =>
+    stderr.split("\n").filter((line) => /is not a field/.test(line));
+
+  assert.deepEqual(warnings((await site.build()).stderr), []);
+
+  const template = site.path("build", "templates", "wrapper.html");
+  const html = await fs.readFile(template, "utf8");
+  await fs.writeFile(
+    template,
+    html.replace(
+      "</body>",
+      "{{autor}} {{autor}} {{#fm_mood}}{{fm_mood}}{{/fm_mood}}</body>",
+    ),
+  );
+  assert.deepEqual(warnings((await site.build()).stderr), [
+    "⚠️  wrapper.html: {{autor}} is not a field the build fills, so it renders empty.",
+    "⚠️  wrapper.html: {{fm_mood}} is not a field the build fills, so it renders empty.",
+  ]);
+  const { stderr } = await site.build({ CAPTURE_FRONT_MATTER: "1" });
+  assert.equal(warnings(stderr).length, 1);
+  assert.match(warnings(stderr)[0], /{{autor}}/);
+});
+
+test("PRINT_CARD_SIZE renders a card at print resolution", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ PRINT_CARD_SIZE: "5x7" });
+  const print = decodeJpeg(await site.readBytes("cards/a-print.jpg"));
+  assert.deepEqual([print.width, print.height], [1500, 2100]);
+  const card = decodeJpeg(await site.readBytes("cards/a.jpg"));
+  assert.deepEqual([card.width, card.height], [1200, 628]);
+
+  await assert.rejects(
+    site.build({ PRINT_CARD_SIZE: "40x60", PRINT_CARD_DPI: "1200" }),
+    (error) => {
+      assert.match(error.stderr, /is 48000×72000 pixels/);
+      return true;
+    },
+  );
+});
+
+test("MERGE_SOURCE_ITEMS names back-to-back authors once", async (t) => {
+  const url = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url, created_at: "2024-04-01" }),
+    "b.md": quoteFields("b", { url, created_at: "2024-03-01" }),
+    "c.md": quoteFields("c", {
+      url,
+      created_at: "2024-02-01",
+      name: "Grace Hopper",
+    }),
+    "d.md": quoteFields("d", { url, created_at: "2024-01-01" }),
+  });
+  t.after(site.remove);
+  const page = "sources/example.com/essay/index.html";
+  const cites = (html) =>
+    [...html.matchAll(/<cite>([^<]*)<\/cite>/g)].map(([, name]) => name);
+
+  await site.build();
+  assert.deepEqual(cites(await site.read(page)), [
+    "Ada Lovelace",
+    "Ada Lovelace",
+    "Grace Hopper",
+    "Ada Lovelace",
+  ]);
+
+  await site.build({ MERGE_SOURCE_ITEMS: "1" });
+  const html = await site.read(page);
+  assert.deepEqual(cites(html), [
+    "Ada Lovelace",
+    "Grace Hopper",
+    "Ada Lovelace",
+  ]);
+  assert.equal(html.match(/<div class="quote-run">/g).length, 1);
+  assert.match(
+    html,
+    /<div class="quote-run">\n<cite>Ada Lovelace<\/cite>\n<article[\s\S]*quote a[\s\S]*quote b[\s\S]*?<\/div>/,
+  );
+});
+
+test("EMIT_GRAPH_DOT links each domain to its articles", async (t) => {
+  const essay = "https://example.com/essay";
+  const site = await createSite({
+    "a.md": quoteFields("a", { url: essay, article_title: 'An "Essay"' }),
+    "b.md": quoteFields("b", { url: essay }),
+    "c.md": quoteFields("c", { url: "https://example.com/aside" }),
+    "d.md": quoteFields("d", { url: "https://other.org/notes" }),
+    "e.md": quoteFields("e", {
+      url: "https://hidden.org/page",
+      hide_from_source: true,
+    }),
+  });
+  t.after(site.remove);
+
+  await site.build({ EMIT_GRAPH_DOT: "1" });
+  assert.equal(
+    await site.read("graph.dot"),
+    [
+      "digraph sources {",
+      "  rankdir=LR;",
+      '  node [fontname="Helvetica"];',
+      '  "domain:example.com" [label="example.com", shape=box];',
+      '  "article:example.com/aside" [label="aside"];',
+      '  "domain:example.com" -> "article:example.com/aside" [label="1"];',
+      '  "article:example.com/essay" [label="An \\"Essay\\""];',
+      '  "domain:example.com" -> "article:example.com/essay" [label="2"];',
+      '  "domain:other.org" [label="other.org", shape=box];',
+      '  "article:other.org/notes" [label="notes"];',
+      '  "domain:other.org" -> "article:other.org/notes" [label="1"];',
+      "}",
+      "",
+    ].join("\n"),
+  );
+
+  await site.build();
+  assert.equal(await site.exists("graph.dot"), false);
+});
+
+test("CARD_TIMEOUT_MS skips a stuck card until it renders", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "stuck.md": quoteFields("stuck"),
+  });
+  t.after(site.remove);
+  const env = { CARD_TIMEOUT_MS: "500" };
+  // A render that never returns, which only terminating the worker stops.
+  const worker = site.path("build", "card-worker.mjs");
+  const source = await fs.readFile(worker, "utf8");
+  await fs.writeFile(
+    worker,
+    source.replace("  try {\n", '  try {\n    while (quote.id === "stuck");\n'),
+  );
+
+  const { stdout, stderr } = await site.build(env);
+  assert.match(stdout, /1 card\(s\) rendered/);
+  assert.match(stdout, /1 card\(s\) timed out/);
+  assert.match(
+    stderr,
+    /quotes\/stuck\.md: the card took longer than CARD_TIMEOUT_MS \(500ms\); skipped\./,
+  );
+  assert.equal(await site.exists("cards/a.jpg"), true);
+  assert.equal(await site.exists("cards/stuck.jpg"), false);
+
+  await fs.writeFile(worker, source);
+  const retry = await site.build(env);
+  assert.match(retry.stdout, /1 card\(s\) rendered/);
+  assert.doesNotMatch(retry.stdout, /timed out/);
+  assert.equal(await site.exists("cards/stuck.jpg"), true);
+});
+
+test("the outcome reports cardMetrics for the cards rendered", async (t) => {
+  const long = Array.from({ length: 200 }, (_, i) => `word${i}`).join(" ");
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b", { quote: long }),
+  });
+  t.after(site.remove);
+  const env = { CARD_OVERFLOW: "truncate", CARD_SCALE: "2" };
+  const metrics = async () => {
+    await site.build(env, ["--outcome=outcome.json"]);
+    return JSON.parse(await site.read("outcome.json")).cardMetrics;
+  };
+
+  const { a, b } = await metrics();
+  assert.equal(a.truncated, false);
+  assert.equal(b.truncated, true);
+  assert.equal(b.fontSize, 36);
+  assert.ok(a.fontSize > b.fontSize);
+  assert.ok(a.lines >= 1 && b.lines > a.lines);
+  assert.deepEqual([a.width, a.height], [2400, 1256]);
+
+  await site.writeQuote("a.md", quoteFields("a", { quote: "Edited." }));
+  assert.deepEqual(Object.keys(await metrics()), ["a"]);
+});
+
+test("--stdout writes one card and nothing else", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+
+  const { stdout } = await site.build({}, ["--stdout=a"], {
+    encoding: "buffer",
+  });
+  assert.deepEqual(await site.listOutputs(), []);
+  const { width, height } = decodeJpeg(stdout);
+  assert.deepEqual([width, height], [1200, 628]);
+
+  await site.build();
+  assert.deepEqual(await site.readBytes("cards/a.jpg"), stdout);
+
+  await assert.rejects(site.build({}, ["--stdout=missing"]), (error) => {
+    assert.match(error.stderr, /--stdout: no quote has the id "missing"\./);
+    return true;
+  });
+});
+
+test("EMIT_DEPLOY_PLAN lists only what the build changed", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a"),
+    "b.md": quoteFields("b"),
+  });
+  t.after(site.remove);
+  const env = { EMIT_DEPLOY_PLAN: "1" };
+  const plan = async () => {
+    await site.build(env);
+    return JSON.parse(await site.read("deploy-plan.json"));
+  };
+
+  await site.build(env);
+  assert.deepEqual(await plan(), { upload: [], delete: [] });
+
+  // A new title leaves the card alone.
+  await site.writeQuote("a.md", quoteFields("a", { article_title: "Notes" }));
+  assert.deepEqual(await plan(), {
+    upload: ["q/a/index.html", "sources/example.com/articles-a/index.html"],
+    delete: [],
+  });
+
+  await site.removeQuote("b.md");
+  assert.deepEqual(await plan(), {
+    upload: [],
+    delete: [
+      "cards/b.jpg",
+      "q/b/index.html",
+      "sources/example.com/articles-b/index.html",
+    ],
+  });
+
+  await site.build();
+  assert.equal(await site.exists("deploy-plan.json"), false);
+});
+
+test("CARD_MAX_HEIGHT grows cards for long quotes, up to a cap", async (t) => {
+  const words = (count) =>
+    Array.from({ length: count }, (_, i) => `word${i}`).join(" ");
+  const site = await createSite({
+    "short.md": quoteFields("short"),
+    "long.md": quoteFields("long", { quote: words(15) }),
+    "huge.md": quoteFields("huge", { quote: words(400) }),
+  });
+  t.after(site.remove);
+  const height = async (id) =>
+    decodeJpeg(await site.readBytes(`cards/${id}.jpg`)).height;
+
+  await site.build({ CARD_MAX_HEIGHT: "1000" });
+  assert.equal(await height("short"), 628);
+  const grown = await height("long");
+  assert.ok(grown > 628 && grown < 1000, `long: ${grown}`);
+  assert.match(
+    await site.read("q/long/index.html"),
+    new RegExp(`<meta property="og:image:height" content="${grown}" />`),
+  );
+  assert.equal(await height("huge"), 1000);
+
+  await assert.rejects(site.build({ CARD_MAX_HEIGHT: "600" }), (error) => {
+    assert.match(error.stderr, /CARD_MAX_HEIGHT must be at least CARD_HEIGHT/);
+    return true;
+  });
+});
+
+test("fonts are read only to render, and bad ones are named", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const font = site.path("assets", "fonts", "AtkinsonHyperlegible-Regular.ttf");
+  const failsWith = (pattern) => (error) => {
+    assert.match(error.stderr, pattern);
+    return true;
+  };
+
+  await fs.writeFile(font, "<html>not a font</html>");
+  // Nothing is rendered, so the broken font goes unnoticed.
+  await site.build({}, ["--check"]);
+  await site.build({}, ["--plan"]);
+  await assert.rejects(
+    site.build(),
+    failsWith(
+      /Font file AtkinsonHyperlegible-Regular\.ttf is not a TrueType, OpenType, or WOFF font\./,
+    ),
+  );
+
+  await fs.rm(font);
+  await assert.rejects(
+    site.build(),
+    failsWith(/Font file missing: AtkinsonHyperlegible-Regular\.ttf\./),
+  );
+});
+
+test("CARD_QR_TARGET=source needs no SITE_ORIGIN", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+  const needsOrigin = /CARD_QR needs SITE_ORIGIN/;
+
+  const wrapper = await site.build({ CARD_QR: "1", SITE_ORIGIN: "" });
+  assert.match(wrapper.stderr, needsOrigin);
+
+  const source = await site.build({
+    CARD_QR: "1",
+    CARD_QR_TARGET: "source",
+    SITE_ORIGIN: "",
+  });
+  assert.doesNotMatch(source.stderr, needsOrigin);
+  assert.match(source.stdout, /1 card\(s\) rendered/);
+});
+
+test("CARD_IMAGE_FORMAT=svg writes vector cards with a JPEG copy", async (t) => {
+  const site = await createSite({ "a.md": quoteFields("a") });
+  t.after(site.remove);
+
+  await site.build({ CARD_IMAGE_FORMAT: "svg" });
+  const svg = await site.read("cards/a.svg");
+  assert.match(svg, /^<svg\b[^>]*\swidth="1200"[^>]*\sheight="628"/);
+  assert.doesNotMatch(svg, /<text\b/);
+  // Scrapers don't read SVG, so og:image points at the JPEG copy.
+  const jpeg = decodeJpeg(await site.readBytes("cards/a.jpg"));
+  assert.deepEqual([jpeg.width, jpeg.height], [1200, 628]);
+  assert.match(
+    await site.read("q/a/index.html"),
+    /property="og:image" content="[^"]*\/cards\/a\.jpg"/,
+  );
+
+  await assert.rejects(
+    site.build({ CARD_IMAGE_FORMAT: "svg", CARD_SCALE: "2" }),
+    (error) => {
+      assert.match(error.stderr, /CARD_SCALE/);
+      return true;
+    },
+  );
+
+  await site.build();
+  assert.equal(await site.exists("cards/a.svg"), false);
+  assert.equal(await site.exists("cards/a.jpg"), true);
+});
+
+test("a source_domain pasted as a URL is reduced to its host", async (t) => {
+  const site = await createSite({
+    "a.md": quoteFields("a", { source_domain: "https://100r.co/" }),
+  });
+  t.after(site.remove);
+
+  await site.build();
+  assert.ok(await site.exists("sources/100r.co/articles-a/index.html"));
+  assert.equal(await site.exists("sources/https:"), false);
+});
@@ -0,0 +1,695 @@
+import test from "node:test";
+import assert from "node:assert/strict";
+import fs from "fs/promises";
+import os from "os";
+import path from "path";
+import { Writable } from "stream";
+
+import {
+  SOLID_PNGS,
+  cardQuote,
+  importRender,
+  renderPixels,
+} from "./helpers.mjs";
+
+test("PARSE_EMPHASIS draws **phrases** bold without the asterisks", async () => {
+  const render = await importRender({ PARSE_EMPHASIS: "1" });
+  const markup = render.renderWordMarkup("an **unlikely** pair", 40);
+  assert.doesNotMatch(markup, /\*/);
+  assert.match(
+    markup,
+    /<span style="font-weight:700;font-style:normal;">unlikely<\/span>/,
+  );
+  assert.equal(
+    render.formatQuoteHtml("an **unlikely** pair"),
+    "an <strong>unlikely</strong> pair",
+  );
+});
+
+test("asymmetric padding bounds the quote's text region", async () => {
+  const render = await importRender({
+    CARD_PADDING_TOP: "40",
+    CARD_PADDING_RIGHT: "200",
+    CARD_PADDING_BOTTOM: "300",
+    CARD_PADDING_LEFT: "60",
+    QUOTE_LINE_HEIGHT: "1.2",
+  });
+  const text = "A sentence long enough to need a few lines. ".repeat(4).trim();
+  const box = render.quoteBox(text);
+  assert.equal(box.availableWidth, 1200 - 60 - 200);
+  assert.equal(box.availableHeight, 628 - 40 - 300);
+
+  const { fontSize } = render.fitCardText(text);
+  const lines = render.countQuoteLines(box, fontSize);
+  assert.ok(lines > 1);
+  assert.ok(lines * fontSize * 1.2 <= box.availableHeight);
+});
+
+test("CARD_TRANSPARENT leaves the background clear", async () => {
+  const render = await importRender({
+    CARD_TRANSPARENT: "1",
+    CARD_IMAGE_FORMAT: "png",
+  });
+  render.validateCardSettings();
+  const card = await renderPixels(render, cardQuote());
+  for (const [x, y] of [
+    [0, 0],
+    [card.width - 1, 0],
+    [0, card.height - 1],
+    [card.width - 1, card.height - 1],
+  ]) {
+    assert.equal(card.at(x, y)[3], 0, `alpha at ${x},${y}`);
+  }
+  assert.ok(card.some((r, g, b, alpha) => alpha > 0), "the text is drawn");
+});
+
+test("CARD_TRANSPARENT is refused for JPEG cards", async () => {
+  const render = await importRender({ CARD_TRANSPARENT: "1" });
+  assert.throws(() => render.validateCardSettings(), /CARD_TRANSPARENT needs/);
+});
+
+test("CARD_WHITESPACE decides what spacing reaches the card", async () => {
+  const spaced = "  First  line\n  second line  ";
+  const expected = {
+    collapse: "First line second line",
+    trim: "First  line\n  second line",
+    none: spaced,
+  };
+  for (const [policy, text] of Object.entries(expected)) {
+    const render = await importRender({ CARD_WHITESPACE: policy });
+    assert.equal(render.cardText(cardQuote({ quote: spaced })), text, policy);
+  }
+});
+
+test("the word layout keeps the quote's own line breaks", async () => {
+  const render = await importRender({
+    CARD_WHITESPACE: "trim",
+    PARSE_EMPHASIS: "1",
+  });
+  const breaks = (markup) => markup.split("width:100%;height:").length - 1;
+  assert.equal(breaks(render.renderWordMarkup("one\ntwo", 40)), 1);
+  assert.equal(breaks(render.renderWordMarkup("one two", 40)), 0);
+});
+
+test("CARD_TABULAR_FIGURES gives every digit the same cell", async () => {
+  const render = await importRender({ CARD_TABULAR_FIGURES: "1" });
+  render.validateCardSettings();
+  const markup = render.renderWordMarkup("In 1984", 40);
+  const cells = [...markup.matchAll(/width:(\d+)px;">(\d)<\/span>/g)];
+  assert.deepEqual(
+    cells.map(([, width, digit]) => [digit, width]),
+    [
+      ["1", "26"],
+      ["9", "26"],
+      ["8", "26"],
+      ["4", "26"],
+    ],
+  );
+});
+
+test("CARD_GRADIENT runs from the start color to the end color", async () => {
+  const render = await importRender({ CARD_GRADIENT: "#1d2b3a,#3c5a78" });
+  assert.deepEqual(render.cardColors(), {
+    background: "background-image:linear-gradient(135deg, #1d2b3a, #3c5a78)",
+    color: "#f7f4ec",
+  });
+
+  // The default diagonal puts the start at the top-left corner and the end at
+  // the bottom-right one.
+  const card = await renderPixels(render, cardQuote());
+  const near = (actual, expected) =>
+    expected.every((channel, i) => Math.abs(actual[i] - channel) <= 8);
+  assert.ok(near(card.at(0, 0), [0x1d, 0x2b, 0x3a]), "top-left");
+  assert.ok(
+    near(card.at(card.width - 1, card.height - 1), [0x3c, 0x5a, 0x78]),
+    "bottom-right",
+  );
+});
+
+test("an invalid CARD_GRADIENT stops the build", async () => {
+  await assert.rejects(
+    importRender({ CARD_GRADIENT: "#1d2b3a" }),
+    /Invalid CARD_GRADIENT "#1d2b3a"/,
+  );
+});
+
+test("CARD_QR links the permalink, which needs SITE_ORIGIN", async () => {
+  const quote = cardQuote({ id: "a" });
+  const withOrigin = await importRender({
+    CARD_QR: "1",
+    SITE_ORIGIN: "https://quotes.example",
+  });
+  assert.equal(withOrigin.cardQrUrl(quote), "https://quotes.example/q/a/");
+
+  const withoutOrigin = await importRender({ CARD_QR: "1", SITE_ORIGIN: "" });
+  assert.equal(withoutOrigin.cardQrUrl(quote), null);
+
+  const off = await importRender({ SITE_ORIGIN: "https://quotes.example" });
+  assert.equal(off.cardQrUrl(quote), null);
+});
+
+test("the quote gets the largest font size step that fits", async () => {
+  const render = await importRender();
+  const fits = (box, size) =>
+    render.countQuoteLines(box, size) * size * 1.32 <= box.availableHeight;
+  for (const words of [15, 25, 35]) {
+    const text = Array.from({ length: words }, (_, i) => `word${i}`).join(" ");
+    const box = render.quoteBox(text);
+    const { fontSize } = render.fitCardText(text);
+    assert.ok(fontSize > 36 && fontSize < 72, `${words} words: ${fontSize}`);
+    assert.equal(fontSize % 0.5, 0);
+    assert.ok(fits(box, fontSize), `${words} words fit at ${fontSize}`);
+    assert.ok(!fits(box, fontSize + 0.5), `${words} words overflow above`);
+  }
+});
+
+// The markers readJpegSize looks at: SOI, a JFIF segment, a baseline frame
+// header of the given size, and EOI.
+function jpegHeader(width, height) {
+  const frame = Buffer.alloc(19);
+  frame.writeUInt16BE(0xffc0, 0);
+  frame.writeUInt16BE(17, 2);
+  frame[4] = 8;
+  frame.writeUInt16BE(height, 5);
+  frame.writeUInt16BE(width, 7);
+  return Buffer.concat([
+    Buffer.from([0xff, 0xd8, 0xff, 0xe0, 0x00, 0x04, 0x00, 0x00]),
+    frame,
+    Buffer.from([0xff, 0xd9]),
+  ]);
+}
+
+test("VERIFY_OUTPUT catches truncated and mis-sized cards", async (t) => {
+  const render = await importRender({ VERIFY_OUTPUT: "1" });
+  const dir = await fs.mkdtemp(path.join(os.tmpdir(), "quote-card-verify-"));
+  t.after(() => fs.rm(dir, { recursive: true, force: true }));
+  const verify = async (data) => {
+    const target = path.join(dir, "card.jpg");
+    await fs.writeFile(target, data);
+    return render.verifyCardFile(target);
+  };
+
+  const card = jpegHeader(1200, 628);
+  assert.equal(await verify(card), null);
+  assert.equal(
+    await verify(card.subarray(0, card.length - 2)),
+    "not a complete JPEG",
+  );
+  assert.equal(
+    await verify(jpegHeader(600, 314)),
+    "expected 1200×628, got 600×314",
+  );
+});
+
+test("PARSE_ITALIC draws *phrases* in the italic face", async () => {
+  const render = await importRender({ PARSE_EMPHASIS: "1", PARSE_ITALIC: "1" });
+  const markup = render.renderWordMarkup("a *quiet* **loud** word", 40);
+  assert.doesNotMatch(markup, /\*/);
+  assert.match(
+    markup,
+    /<span style="font-weight:400;font-style:italic;">quiet<\/span>/,
+  );
+  assert.match(
+    markup,
+    /<span style="font-weight:700;font-style:normal;">loud<\/span>/,
+  );
+  assert.equal(
+    render.formatQuoteHtml("a *quiet* **loud** word"),
+    "a <em>quiet</em> <strong>loud</strong> word",
+  );
+
+  // Without PARSE_ITALIC single asterisks stay as typed.
+  const bold = await importRender({ PARSE_EMPHASIS: "1" });
+  assert.match(bold.renderWordMarkup("a *quiet* word", 40), /\*quiet\*/);
+});
+
+test("CARD_AUTHOR sizes the attribution apart from the quote", async () => {
+  const render = await importRender({ CARD_AUTHOR: "1" });
+  const fontSize = (author) =>
+    Number(/font-size:(\d+)px/.exec(author.markup)[1]);
+
+  const short = render.buildCardAuthor(cardQuote({ name: "Ada Lovelace" }));
+  assert.match(short.markup, /font-weight:700;/);
+  assert.match(short.markup, />— Ada Lovelace</);
+  assert.equal(fontSize(short), 36);
+
+  const long = render.buildCardAuthor(
+    cardQuote({ name: "Augusta Ada King, Countess of Lovelace ".repeat(2) }),
+  );
+  assert.ok(fontSize(long) < 36 && fontSize(long) >= 22);
+
+  assert.equal(render.buildCardAuthor(cardQuote({ name: null })), null);
+  const off = await importRender();
+  assert.equal(off.buildCardAuthor(cardQuote()), null);
+});
+
+test("CARD_MAXIMIZE_SHORT grows a two-word quote past the maximum", async () => {
+  const plain = await importRender();
+  assert.equal(plain.fitCardText("Be bold.").fontSize, 72);
+
+  const render = await importRender({ CARD_MAXIMIZE_SHORT: "1" });
+  const { fontSize } = render.fitCardText("Be bold.");
+  assert.ok(fontSize > 72 && fontSize <= 144, `font size ${fontSize}`);
+  const box = render.quoteBox("Be bold.");
+  assert.equal(render.countQuoteLines(box, fontSize), 1);
+
+  const sentence = "A sentence well past the short quote limit.";
+  assert.equal(
+    render.fitCardText(sentence).fontSize,
+    plain.fitCardText(sentence).fontSize,
+  );
+});
+
+test("CARD_THEME=dark draws light text on a dark card", async () => {
+  const render = await importRender({ CARD_THEME: "dark" });
+  assert.deepEqual(render.cardColors(), {
+    background: "background:#161513",
+    color: "#ede8dc",
+  });
+
+  const card = await renderPixels(render, cardQuote());
+  assert.deepEqual(card.at(0, 0).slice(0, 3), [0x16, 0x15, 0x13]);
+  assert.ok(
+    card.some((r, g, b) => r > 0xc0 && g > 0xc0 && b > 0xc0),
+    "light text is drawn",
+  );
+});
+
+test("an unknown CARD_THEME stops the build", async () => {
+  await assert.rejects(
+    importRender({ CARD_THEME: "neon" }),
+    /Unknown CARD_THEME "neon"\. Use "light", "dark", "sepia"\./,
+  );
+});
+
+test("named CARD_GRADIENT directions set the gradient's angle", async () => {
+  for (const [direction, angle] of [
+    ["vertical", 180],
+    ["horizontal", 90],
+    ["diagonal", 135],
+    ["45", 45],
+  ]) {
+    const render = await importRender({
+      CARD_GRADIENT: `#ffffff,#000000,${direction}`,
+    });
+    assert.match(
+      render.cardColors().background,
+      new RegExp(`linear-gradient\\(${angle}deg, `),
+      direction,
+    );
+  }
+
+  // Top to bottom: rows change, columns don't.
+  const render = await importRender({
+    CARD_GRADIENT: "#ffffff,#000000,vertical",
+  });
+  const card = await renderPixels(render, cardQuote());
+  const [top] = card.at(0, 0);
+  const [bottom] = card.at(0, card.height - 1);
+  const [topRight] = card.at(card.width - 1, 0);
+  assert.ok(top > 240 && bottom < 15, `top ${top}, bottom ${bottom}`);
+  assert.ok(Math.abs(top - topRight) <= 2, "same color along the top");
+});
+
+test("CARD_BACKGROUND_IMAGE is drawn behind the text", async (t) => {
+  const dir = await fs.mkdtemp(path.join(os.tmpdir(), "quote-card-bg-"));
+  t.after(() => fs.rm(dir, { recursive: true, force: true }));
+  const image = path.join(dir, "red.png");
+  await fs.writeFile(image, SOLID_PNGS.red);
+
+  const render = await importRender({ CARD_BACKGROUND_IMAGE: image });
+  const { background } = await render.loadCardImages();
+  assert.deepEqual([background.width, background.height], [8, 4]);
+
+  const text = path.join(dir, "notes.txt");
+  await fs.writeFile(text, "not an image");
+  const wrong = await importRender({ CARD_BACKGROUND_IMAGE: text });
+  await assert.rejects(
+    wrong.loadCardImages(),
+    /CARD_BACKGROUND_IMAGE must be a PNG or JPEG/,
+  );
+
+  const card = await renderPixels(render, cardQuote());
+  const [r, g, b] = card.at(card.width - 1, card.height - 1);
+  assert.ok(r > 230 && g < 30 && b < 30, `corner ${r},${g},${b}`);
+});
+
+test("a long quote leaves room for its attribution", async () => {
+  const render = await importRender({ CARD_AUTHOR: "1" });
+  const text = "Words that run on and on across the card. ".repeat(5).trim();
+  const quote = cardQuote({
+    quote: text,
+    rawQuote: text,
+    name: "Augusta Ada King, Countess of Lovelace, with a long byline",
+  });
+  const author = render.buildCardAuthor(quote);
+  const box = render.quoteBox(text);
+  const height = (fontSize) =>
+    render.countQuoteLines(box, fontSize) * fontSize * 1.32 + author.height;
+
+  // Sized as if the card held only the quote, the pair would overflow.
+  const alone = render.fitCardText(text).fontSize;
+  assert.ok(height(alone) > box.availableHeight);
+
+  const { fontSize, overflow } = render.fitCardText(text, author.height);
+  assert.equal(overflow, null);
+  assert.ok(fontSize < alone);
+  assert.ok(height(fontSize) <= box.availableHeight);
+});
+
+test("RTL quotes fill lines from the right with reversed glyphs", async () => {
+  const render = await importRender();
+  const rtl = render.renderWordMarkup("שלום עולם", 40, {
+    direction: "rtl",
+    marks: ["", ""],
+  });
+  assert.match(rtl, /flex-direction:row-reverse/);
+  assert.match(rtl, />םולש</);
+  assert.match(rtl, />םלוע</);
+
+  const ltr = render.renderWordMarkup("hello world", 40, { marks: ["", ""] });
+  assert.doesNotMatch(ltr, /row-reverse/);
+  assert.match(ltr, />hello</);
+});
+
+test("CARD_OVERFLOW handles a quote too long to fit", async () => {
+  const text = Array.from({ length: 200 }, (_, i) => `word${i}`).join(" ");
+  const fits = (render, candidate, size) =>
+    render.countQuoteLines(render.quoteBox(candidate), size) * size * 1.32 <=
+    render.quoteBox(candidate).availableHeight;
+
+  const allow = await importRender({ CARD_OVERFLOW: "allow" });
+  assert.deepEqual(allow.fitCardText(text), {
+    text,
+    fontSize: 36,
+    overflow: "overflow",
+  });
+
+  const shrink = await importRender({ CARD_OVERFLOW: "shrink" });
+  const shrunk = shrink.fitCardText(text);
+  assert.equal(shrunk.overflow, "shrunk");
+  assert.equal(shrunk.text, text);
+  assert.ok(shrunk.fontSize < 36);
+  assert.ok(fits(shrink, text, shrunk.fontSize));
+
+  const truncate = await importRender({ CARD_OVERFLOW: "truncate" });
+  const cut = truncate.fitCardText(text);
+  assert.equal(cut.overflow, "truncated");
+  assert.equal(cut.fontSize, 36);
+  assert.match(cut.text, /^word0 word1 .* word\d+…$/);
+  assert.ok(fits(truncate, cut.text, 36));
+  const words = cut.text.split(" ").length;
+  const longer = text.split(" ").slice(0, words + 1).join(" ");
+  assert.ok(!fits(truncate, `${longer}…`, 36));
+
+  // Leading whitespace doesn't shift which tokens count as words.
+  const indented = truncate.fitCardText(` ${text}`);
+  assert.equal(indented.overflow, "truncated");
+  assert.match(indented.text, /^ word0 word1 .* word\d+…$/);
+  assert.equal(indented.text.trim(), cut.text);
+});
+
+test("CARD_SOURCE_FOOTER prints the domain in the bottom padding", async () => {
+  // Dark pixels in the bottom 120px, the default padding.
+  const footerInk = (card) => {
+    let count = 0;
+    for (let y = card.height - 120; y < card.height; y += 1) {
+      for (let x = 0; x < card.width; x += 1) {
+        if (card.at(x, y)[0] < 0x80) count += 1;
+      }
+    }
+    return count;
+  };
+
+  const plain = await importRender();
+  assert.equal(footerInk(await renderPixels(plain, cardQuote())), 0);
+
+  const render = await importRender({ CARD_SOURCE_FOOTER: "1" });
+  assert.ok(footerInk(await renderPixels(render, cardQuote())) > 0);
+  const unknown = cardQuote({ sourceDomain: "unknown-source" });
+  assert.equal(footerInk(await renderPixels(render, unknown)), 0);
+});
+
+test("QUOTE_LETTER_SPACING and QUOTE_LINE_HEIGHT feed the fit", async () => {
+  const text = Array.from({ length: 25 }, (_, i) => `word${i}`).join(" ");
+  const plain = await importRender();
+  const base = plain.fitCardText(text).fontSize;
+  assert.doesNotMatch(plain.renderWordMarkup(text, 40), /letter-spacing/);
+  assert.match(plain.renderWordMarkup(text, 40), /line-height:1\.32;/);
+
+  const spaced = await importRender({ QUOTE_LETTER_SPACING: "6" });
+  assert.match(spaced.renderWordMarkup(text, 40), /letter-spacing:6px;/);
+  assert.ok(spaced.fitCardText(text).fontSize < base);
+
+  const tall = await importRender({ QUOTE_LINE_HEIGHT: "1.8" });
+  assert.match(tall.renderWordMarkup(text, 40), /line-height:1\.8;/);
+  const { fontSize } = tall.fitCardText(text);
+  assert.ok(fontSize < base);
+  const box = tall.quoteBox(text);
+  assert.ok(
+    tall.countQuoteLines(box, fontSize) * fontSize * 1.8 <= box.availableHeight,
+  );
+});
+
+test("CARD_TRUNCATION_MARKER ends a truncated quote", async () => {
+  const text = Array.from({ length: 200 }, (_, i) => `word${i}`).join(" ");
+  const env = { CARD_OVERFLOW: "truncate" };
+
+  const bracketed = await importRender({
+    ...env,
+    CARD_TRUNCATION_MARKER: " [...]",
+  });
+  const cut = bracketed.fitCardText(text).text;
+  assert.match(cut, /word\d+ \[\.\.\.\]$/);
+  assert.match(
+    bracketed.renderWordMarkup(cut, 36),
+    />\[\.\.\.\]”<\/span><\/span><\/div>$/,
+  );
+
+  const hard = await importRender({ ...env, CARD_TRUNCATION_MARKER: "" });
+  assert.match(hard.fitCardText(text).text, /word\d+$/);
+});
+
+test("CARD_VERTICAL_ALIGN moves the quote block up and down", async () => {
+  const ink = async (align) => {
+    const render = await importRender({ CARD_VERTICAL_ALIGN: align });
+    const card = await renderPixels(render, cardQuote({ quote: "Brief." }));
+    return card.bounds((r) => r < 0x80);
+  };
+  const top = await ink("top");
+  const center = await ink("center");
+  const bottom = await ink("bottom");
+
+  assert.ok(top.top >= 120 && top.top < 200, `top starts at ${top.top}`);
+  assert.ok(top.top < center.top && center.top < bottom.top);
+  assert.ok(bottom.bottom <= 628 - 120 && bottom.bottom > 628 - 200);
+
+  await assert.rejects(
+    importRender({ CARD_VERTICAL_ALIGN: "middle" }),
+    /Unknown CARD_VERTICAL_ALIGN "middle"/,
+  );
+});
+
+test("CARD_TEXT_ALIGN lines the quote up against a side", async () => {
+  const render = await importRender({ CARD_TEXT_ALIGN: "left" });
+  const justify = (direction) =>
+    render
+      .renderWordMarkup("a b", 40, { direction })
+      .match(/justify-content:([\w-]+)/)[1];
+  // Right to left, the row runs backwards, so the ends swap.
+  assert.equal(justify("ltr"), "flex-start");
+  assert.equal(justify("rtl"), "flex-end");
+
+  const ink = async (align) => {
+    const aligned = await importRender({ CARD_TEXT_ALIGN: align });
+    const quote = cardQuote({ quote: "Brief." });
+    return (await renderPixels(aligned, quote)).bounds((r) => r < 0x80);
+  };
+  const left = await ink("left");
+  const center = await ink("center");
+  const right = await ink("right");
+  assert.ok(left.left >= 150 && left.left < 180, `left at ${left.left}`);
+  assert.ok(
+    right.right <= 1050 && right.right > 1020,
+    `right at ${right.right}`,
+  );
+  assert.ok(left.left < center.left && center.left < right.left);
+});
+
+test("Japanese quotes wrap between characters", async () => {
+  const render = await importRender();
+  const text =
+    "吾輩は猫である。名前はまだ無い。どこで生れたかとんと見当がつかぬ。何でも薄暗いじめじめした所でニャーニャー泣いていた事だけは記憶している。";
+  const { fontSize, overflow } = render.fitCardText(text);
+  assert.equal(overflow, null);
+  assert.ok(fontSize < 72, `drawn at ${fontSize}`);
+  assert.ok(render.countQuoteLines(render.quoteBox(text), fontSize) > 1);
+
+  const words = [
+    ...render
+      .renderWordMarkup("猫である。ニャー", 40, { marks: ["", ""] })
+      .matchAll(/font-style:normal;">([^<]*)</g),
+  ].map(([, word]) => word);
+  // Closing punctuation, small kana, and the long-vowel mark never start a
+  // line.
+  assert.deepEqual(words, ["猫", "で", "あ", "る。", "ニャー"]);
+});
+
+test("a word wider than the card is cut between characters", async () => {
+  const word = "abcdefghij".repeat(20);
+  const pieces = (render) =>
+    [
+      ...render
+        .renderWordMarkup(word, 40, { maxWidth: 900, marks: ["", ""] })
+        .matchAll(/font-style:normal;">([^<]*)</g),
+    ].map(([, piece]) => piece);
+
+  const render = await importRender();
+  const cut = pieces(render);
+  assert.ok(cut.length > 1);
+  assert.equal(cut.join(""), word);
+  const { fontSize, overflow } = render.fitCardText(word);
+  assert.equal(overflow, null);
+  assert.ok(render.countQuoteLines(render.quoteBox(word), fontSize) > 1);
+
+  const hyphenated = pieces(await importRender({ CARD_BREAK_HYPHEN: "1" }));
+  assert.ok(hyphenated.length > 1);
+  assert.ok(hyphenated.slice(0, -1).every((piece) => piece.endsWith("-")));
+  assert.equal(hyphenated.join("").replaceAll("-", ""), word);
+});
+
+test("CARD_DOMAIN_TINT gives each domain a stable pale background", async () => {
+  const plain = await importRender();
+  assert.equal(plain.cardBackground(cardQuote()), null);
+
+  const render = await importRender({ CARD_DOMAIN_TINT: "1" });
+  // Pinned: a domain's tint must not shift between builds or releases.
+  assert.deepEqual(render.colorFromString("example.com"), [211, 208, 241]);
+  assert.deepEqual(render.colorFromString("other.org"), [241, 210, 208]);
+  assert.deepEqual(
+    render.colorFromString("example.com"),
+    plain.colorFromString("example.com"),
+  );
+  for (const domain of ["a.org", "b.net", "c.io", "d.co.uk"]) {
+    const rgb = render.colorFromString(domain);
+    assert.ok(rgb.every((channel) => channel >= 200), `${domain}: ${rgb}`);
+  }
+
+  assert.equal(render.cardBackground(cardQuote()), "#d3d0f1");
+  assert.equal(
+    render.cardBackground(cardQuote({ cardBg: "#112233" })),
+    "#112233",
+  );
+});
+
+test("writeCardTo waits for a slow stream to drain", async () => {
+  const render = await importRender();
+  const [fonts, images] = await Promise.all([
+    render.loadFonts(),
+    render.loadCardImages(),
+  ]);
+  const chunks = [];
+  const stream = new Writable({
+    highWaterMark: 1024,
+    write(chunk, encoding, callback) {
+      chunks.push(chunk);
+      setTimeout(callback, 1);
+    },
+  });
+  // Nothing is written while the stream is over its high-water mark.
+  const write = stream.write.bind(stream);
+  stream.write = (chunk) => {
+    assert.ok(stream.writableLength < 1024, `${stream.writableLength} queued`);
+    return write(chunk);
+  };
+
+  const quote = cardQuote();
+  await render.writeCardTo(stream, quote, fonts, images);
+  await new Promise((resolve) => stream.end(resolve));
+  assert.ok(chunks.every((chunk) => chunk.length <= 64 * 1024));
+  const layout = {
+    width: 1200,
+    height: 628,
+    padding: { top: 120, right: 150, bottom: 120, left: 150 },
+  };
+  const { image } = await render.renderCardImage(
+    quote,
+    fonts,
+    layout,
+    images,
+    1,
+  );
+  assert.deepEqual(Buffer.concat(chunks), image);
+});
+
+test("CARD_AUTO_CONTRAST switches text that would not read", async () => {
+  const plain = await importRender();
+  const white = [255, 255, 255];
+  const black = [0, 0, 0];
+  assert.equal(plain.contrastRatio(black, white), 21);
+  assert.equal(plain.contrastRatio(white, black), 21);
+  assert.equal(plain.contrastRatio(white, white), 1);
+  for (const theme of ["light", "dark", "sepia"]) {
+    const { background, color } = plain.cardColors(theme);
+    const paper = background.match(/#[0-9a-f]{6}/)[0];
+    const ratio = plain.contrastRatio(
+      [1, 3, 5].map((i) => parseInt(paper.slice(i, i + 2), 16)),
+      [1, 3, 5].map((i) => parseInt(color.slice(i, i + 2), 16)),
+    );
+    assert.ok(ratio >= 4.5, `${theme}: ${ratio}`);
+  }
+
+  // Ink on an image under a dark overlay.
+  const env = {
+    CARD_BACKGROUND_IMAGE: "photo.jpg",
+    CARD_BACKGROUND_OVERLAY: "#000000,0.8",
+  };
+  const dim = await importRender(env);
+  assert.equal(dim.cardColors("light").color, "#26211a");
+  const fixed = await importRender({ ...env, CARD_AUTO_CONTRAST: "1" });
+  assert.equal(fixed.cardColors("light").color, "#f7f4ec");
+  assert.equal(fixed.cardColors("dark").color, "#ede8dc");
+
+  // Without an overlay the backdrop is unknown, so the theme's text stays.
+  const bare = await importRender({
+    CARD_BACKGROUND_IMAGE: "photo.jpg",
+    CARD_AUTO_CONTRAST: "1",
+  });
+  assert.equal(bare.cardColors("light").color, "#26211a");
+});
+
+test("CARD_TEXT_STROKE outlines the text in its color", async () => {
+  const red = (r, g, b) => r > 0xc0 && g < 0x60 && b < 0x60;
+  const plain = await importRender();
+  assert.equal((await renderPixels(plain, cardQuote())).some(red), false);
+
+  const render = await importRender({ CARD_TEXT_STROKE: "#ff0000,4" });
+  assert.ok((await renderPixels(render, cardQuote())).some(red));
+
+  for (const value of ["red", "#ff0000,0", "#ff0000,21", "#ff0000,2,3"]) {
+    await assert.rejects(
+      importRender({ CARD_TEXT_STROKE: value }),
+      /Invalid CARD_TEXT_STROKE/,
+      value,
+    );
+  }
+});
+
+test("CARD_QR_TARGET=source links the quote's source instead", async () => {
+  const quote = cardQuote({ id: "a" });
+  const render = await importRender({
+    CARD_QR: "1",
+    CARD_QR_TARGET: "source",
+    SITE_ORIGIN: "",
+  });
+  assert.equal(render.cardQrUrl(quote), "https://example.com/essay");
+  assert.equal(render.cardQrUrl(cardQuote({ displayUrl: null })), null);
+  // The code is drawn on the card, so a new source re-renders it.
+  const moved = { ...quote, displayUrl: "https://example.com/moved" };
+  assert.notEqual(render.buildCardHash(moved), render.buildCardHash(quote));
+
+  await assert.rejects(
+    importRender({ CARD_QR_TARGET: "article" }),
+    /Unknown CARD_QR_TARGET "article"\. Use "wrapper" or "source"\./,
+  );
+});
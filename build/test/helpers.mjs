@@ -0,0 +1,218 @@
+import fs from "fs/promises";
+import os from "os";
+import path from "path";
+import { execFile } from "child_process";
+import { promisify } from "util";
+import { fileURLToPath, pathToFileURL } from "url";
+import { Resvg } from "@resvg/resvg-js";
+
+const execFileAsync = promisify(execFile);
+const REPO_DIR = path.resolve(
+  path.dirname(fileURLToPath(import.meta.url)),
+  "..",
+  "..",
+);
+
+let renderImports = 0;
+
+// Opaque 8×4 PNGs of a single color, for image settings.
+export const SOLID_PNGS = {
+  red: Buffer.from(
+    "iVBORw0KGgoAAAANSUhEUgAAAAgAAAAECAIAAAA8r+mnAAAAEUlEQVR42mP4z8CAFTFQTwIAWl4f4Q122OMAAAAASUVORK5CYII=",
+    "base64",
+  ),
+  blue: Buffer.from(
+    "iVBORw0KGgoAAAANSUhEUgAAAAgAAAAECAIAAAA8r+mnAAAAEElEQVR42mNgYPiPA1FNAgAanh/h6S0j9AAAAABJRU5ErkJggg==",
+    "base64",
+  ),
+};
+
+// render.mjs reads its settings from the environment as it loads, so each
+// call evaluates a fresh copy of the module with `env` applied on top of the
+// current environment.
+export async function importRender(env = {}) {
+  const saved = {};
+  for (const [key, value] of Object.entries(env)) {
+    saved[key] = process.env[key];
+    process.env[key] = String(value);
+  }
+  try {
+    renderImports += 1;
+    return await import(`../render.mjs?copy=${renderImports}`);
+  } finally {
+    for (const [key, value] of Object.entries(saved)) {
+      if (value === undefined) {
+        delete process.env[key];
+      } else {
+        process.env[key] = value;
+      }
+    }
+  }
+}
+
+// Front matter for a quote with every required field, overridable per test.
+export function quoteFields(id, overrides = {}) {
+  return {
+    id,
+    quote: `The words of quote ${id}.`,
+    name: "Ada Lovelace",
+    url: `https://example.com/articles/${id}`,
+    ...overrides,
+  };
+}
+
+// A quote record shaped like the ones loadQuotes returns, for rendering a
+// card without going through quotes/.
+export function cardQuote(overrides = {}) {
+  const quote = overrides.quote ?? "A quote that sits on the card.";
+  return {
+    id: "card",
+    quote,
+    rawQuote: quote,
+    name: "Ada Lovelace",
+    displayUrl: "https://example.com/essay",
+    normalizedUrl: "https://example.com/essay",
+    articleTitle: null,
+    sourceDomain: "example.com",
+    sourceName: null,
+    articleSlug: "essay",
+    oldSlugs: [],
+    createdAt: null,
+    tags: [],
+    series: null,
+    seriesPart: null,
+    seriesNav: null,
+    ogImage: null,
+    theme: null,
+    dir: null,
+    cardBg: null,
+    raw: false,
+    hideFromSource: false,
+    frontMatter: null,
+    bodyHtml: "",
+    location: "quotes/card.md",
+    ...overrides,
+  };
+}
+
+// Draws `quote`'s card with `render`, a module from importRender, straight to
+// RGBA pixels so tests can sample colors without decoding an image file.
+export async function renderPixels(render, quote, layout) {
+  const [fonts, images] = await Promise.all([
+    render.loadFonts(),
+    render.loadCardImages(),
+  ]);
+  const svg = await render.renderQuoteSvg(quote, fonts, layout, images);
+  const { pixels, width, height } = new Resvg(svg).render();
+  return {
+    width,
+    height,
+    at(x, y) {
+      const offset = (y * width + x) * 4;
+      return [...pixels.subarray(offset, offset + 4)];
+    },
+    // Whether any pixel passes `test(r, g, b, a)`.
+    some(test) {
+      for (let offset = 0; offset < pixels.length; offset += 4) {
+        if (test(...pixels.subarray(offset, offset + 4))) return true;
+      }
+      return false;
+    },
+    // The smallest box holding every pixel that passes `test(r, g, b, a)`,
+    // or null when none does.
+    bounds(test) {
+      let box = null;
+      for (let y = 0; y < height; y += 1) {
+        for (let x = 0; x < width; x += 1) {
+          const offset = (y * width + x) * 4;
+          if (!test(...pixels.subarray(offset, offset + 4))) continue;
+          box ??= { top: y, right: x, bottom: y, left: x };
+          box.right = Math.max(box.right, x);
+          box.bottom = y;
+          box.left = Math.min(box.left, x);
+        }
+      }
+      return box;
+    },
+  };
+}
+
+// A scratch copy of the build scripts and assets with its own quotes/ and
+// outputs, so tests can run real builds without touching the checkout.
+// `quotes` maps file names under quotes/ to their front matter.
+export async function createSite(quotes = {}) {
+  const dir = await fs.mkdtemp(path.join(os.tmpdir(), "quote-card-"));
+  await fs.cp(path.join(REPO_DIR, "build"), path.join(dir, "build"), {
+    recursive: true,
+    filter: (source) => source !== path.join(REPO_DIR, "build", "pages"),
+  });
+  await fs.cp(path.join(REPO_DIR, "assets"), path.join(dir, "assets"), {
+    recursive: true,
+  });
+  await fs.symlink(
+    await fs.realpath(path.join(REPO_DIR, "node_modules")),
+    path.join(dir, "node_modules"),
+    "dir",
+  );
+
+  const site = {
+    dir,
+    path: (...parts) => path.join(dir, ...parts),
+    // Fields set to undefined are left out, e.g. to drop a required one.
+    async writeQuote(file, fields, body = "") {
+      const lines = Object.entries(fields)
+        .filter(([, value]) => value !== undefined)
+        .map(([key, value]) => `${key}: ${JSON.stringify(value)}`);
+      const target = site.path("quotes", file);
+      await fs.mkdir(path.dirname(target), { recursive: true });
+      await fs.writeFile(target, `---\n${lines.join("\n")}\n---\n${body}`);
+    },
+    removeQuote: (file) => fs.rm(site.path("quotes", file)),
+    // Runs build/render.mjs; rejects with stdout and stderr attached when the
+    // build exits non-zero. `options` go to execFile, e.g. an encoding.
+    build: (env = {}, args = [], options = {}) =>
+      execFileAsync(process.execPath, ["build/render.mjs", ...args], {
+        cwd: dir,
+        env: { ...process.env, ...env },
+        ...options,
+      }),
+    // The site's own copy of render.mjs, which reads the site's quotes/.
+    importRender: () =>
+      import(pathToFileURL(site.path("build", "render.mjs")).href),
+    read: (file) => fs.readFile(site.path(file), "utf8"),
+    readBytes: (file) => fs.readFile(site.path(file)),
+    exists: (file) =>
+      fs.access(site.path(file)).then(
+        () => true,
+        () => false,
+      ),
+    // Every file outside the inputs (build/, assets/, quotes/), relative to
+    // the site and sorted.
+    async listOutputs() {
+      const inputs = new Set(["build", "assets", "quotes", "node_modules"]);
+      const files = [];
+      const walk = async (relative) => {
+        const entries = await fs.readdir(site.path(relative), {
+          withFileTypes: true,
+        });
+        for (const entry of entries) {
+          const child = relative ? `${relative}/${entry.name}` : entry.name;
+          if (!relative && inputs.has(entry.name)) continue;
+          if (entry.isDirectory()) {
+            await walk(child);
+          } else {
+            files.push(child);
+          }
+        }
+      };
+      await walk("");
+      return files.sort();
+    },
+    remove: () => fs.rm(dir, { recursive: true, force: true }),
+  };
+
+  for (const [file, fields] of Object.entries(quotes)) {
+    await site.writeQuote(file, fields);
+  }
+  return site;
+}
@@ -0,0 +1,266 @@
+import test from "node:test";
+import assert from "node:assert/strict";
+
+import { cardQuote, importRender } from "./helpers.mjs";
+
+const render = await importRender();
+
+test("an old slug redirects to its source's current page", () => {
+  const groups = new Map([
+    [
+      "example.com__new-title",
+      {
+        domain: "example.com",
+        slug: "new-title",
+        quotes: [{ location: "quotes/a.md", oldSlugs: ["old-title"] }],
+      },
+    ],
+  ]);
+  assert.deepEqual(render.planSourceRedirects(groups), {
+    "example.com/old-title": "example.com/new-title",
+  });
+});
+
+test("an old slug that is a live source page gets no redirect", () => {
+  const groups = new Map([
+    [
+      "example.com__new-title",
+      {
+        domain: "example.com",
+        slug: "new-title",
+        quotes: [{ location: "quotes/a.md", oldSlugs: ["other"] }],
+      },
+    ],
+    [
+      "example.com__other",
+      { domain: "example.com", slug: "other", quotes: [] },
+    ],
+  ]);
+  assert.deepEqual(render.planSourceRedirects(groups), {});
+});
+
+test("series members link to their neighbours by part", () => {
+  const quotes = [
+    { id: "b", series: "Thread", seriesPart: 2, createdAt: null },
+    { id: "a", series: "Thread", seriesPart: 1, createdAt: null },
+    { id: "c", series: "Thread", seriesPart: 3, createdAt: null },
+    { id: "solo", series: null, seriesPart: null, createdAt: null },
+  ];
+  const warnings = [];
+  render.linkSeries(quotes, warnings);
+
+  const nav = Object.fromEntries(
+    quotes.map((quote) => [quote.id, quote.seriesNav]),
+  );
+  assert.deepEqual(nav.a, {
+    name: "Thread",
+    position: 1,
+    total: 3,
+    prevId: null,
+    nextId: "b",
+  });
+  assert.equal(nav.b.prevId, "a");
+  assert.equal(nav.b.nextId, "c");
+  assert.equal(nav.c.prevId, "b");
+  assert.equal(nav.c.nextId, null);
+  assert.equal(nav.solo, undefined);
+  assert.deepEqual(warnings, []);
+});
+
+test("a repeated series part is warned about", () => {
+  const warnings = [];
+  render.linkSeries(
+    [
+      { id: "a", series: "Thread", seriesPart: 1, createdAt: null },
+      { id: "b", series: "Thread", seriesPart: 1, createdAt: null },
+    ],
+    warnings,
+  );
+  assert.deepEqual(warnings, [
+    'Series "Thread" has more than one part 1: a, b',
+  ]);
+});
+
+test("tags are trimmed and merged case-insensitively", async () => {
+  const warnings = [];
+  assert.deepEqual(
+    render.normalizeTags(
+      [" Go ", "go", "GO", "", "Rust", "rust "],
+      "quotes/a.md",
+      warnings,
+    ),
+    ["Go", "Rust"],
+  );
+  assert.deepEqual(warnings, [
+    'quotes/a.md: merged tag "go" into "Go".',
+    'quotes/a.md: merged tag "GO" into "Go".',
+    'quotes/a.md: merged tag "rust" into "Rust".',
+  ]);
+
+  const lower = await importRender({ TAG_CASE: "lower" });
+  assert.deepEqual(
+    lower.normalizeTags(["Go", "go", "Rust"], "quotes/a.md", []),
+    ["go", "rust"],
+  );
+});
+
+test("each field change dirties only the outputs that show it", async () => {
+  const quote = cardQuote({ name: "Ada Lovelace", articleTitle: "Notes" });
+  const hashes = (render, q) => ({
+    card: render.buildCardHash(q),
+    wrapper: render.buildWrapperHash(q, null),
+    group: render.buildGroupItemHash(q),
+  });
+  const changed = (render, overrides) => {
+    const before = hashes(render, quote);
+    const after = hashes(render, { ...quote, ...overrides });
+    return Object.keys(before).filter((key) => before[key] !== after[key]);
+  };
+
+  const cases = [
+    [
+      { quote: "Other words.", rawQuote: "Other words." },
+      ["card", "wrapper", "group"],
+    ],
+    [{ name: "Grace Hopper" }, ["wrapper", "group"]],
+    [{ articleTitle: "Sketches" }, ["wrapper", "group"]],
+    [{ tags: ["engines"] }, ["group"]],
+    [{ createdAt: new Date("2024-01-01") }, ["group"]],
+    [{ hideFromSource: true }, ["group"]],
+    [{ ogImage: "https://example.com/og.png" }, ["wrapper"]],
+    [{ theme: "dark" }, ["card"]],
+  ];
+  for (const [overrides, expected] of cases) {
+    const field = Object.keys(overrides)[0];
+    assert.deepEqual(changed(render, overrides), expected, field);
+  }
+
+  // The card only shows the author under CARD_AUTHOR.
+  const withAuthor = await importRender({ CARD_AUTHOR: "1" });
+  assert.deepEqual(changed(withAuthor, { name: "Grace Hopper" }), [
+    "card",
+    "wrapper",
+    "group",
+  ]);
+});
+
+test("manifests differing only in generatedAt or key order are equal", () => {
+  const manifest = {
+    version: 1,
+    generatedAt: "2024-01-01T00:00:00.000Z",
+    quotes: { a: { cardHash: "1", formatHashes: null } },
+  };
+  assert.ok(
+    render.manifestsEqual(manifest, {
+      quotes: { a: { formatHashes: null, cardHash: "1" } },
+      generatedAt: "2025-06-01T12:00:00.000Z",
+      version: 1,
+    }),
+  );
+  assert.ok(
+    !render.manifestsEqual(manifest, {
+      ...manifest,
+      quotes: { a: { cardHash: "2", formatHashes: null } },
+    }),
+  );
+  assert.ok(!render.manifestsEqual(null, manifest));
+});
+
+test("descriptions drop the title's closing punctuation", async () => {
+  const quote = cardQuote({ articleTitle: "Why Not?" });
+
+  const payload = render.buildWrapperPayload(quote, null);
+  assert.equal(payload.meta_description, "From Why Not by Ada Lovelace");
+  assert.equal(payload.page_title, "Why Not?");
+
+  // A pattern's own trailing period goes too.
+  const patterned = await importRender({
+    DESCRIPTION_PATTERN: "{author} asks {article}.",
+  });
+  assert.equal(
+    patterned.buildWrapperPayload(quote, null).meta_description,
+    "Ada Lovelace asks Why Not",
+  );
+});
+
+test("source page tags link to their tag pages, escaped", () => {
+  const html = render.buildSourceQuoteHtml(
+    cardQuote({ tags: ["machine learning", "<notes>"] }),
+  );
+  assert.match(
+    html,
+    /<ul class="tags"><li><a href="\/tags\/machine-learning\/">machine learning<\/a><\/li><li><a href="\/tags\/notes\/">&lt;notes&gt;<\/a><\/li><\/ul>/,
+  );
+  assert.doesNotMatch(render.buildSourceQuoteHtml(cardQuote()), /class="tags"/);
+});
+
+test("a transliterator turns non-Latin paths into distinct slugs", () => {
+  const letters = {
+    а: "a",
+    в: "v",
+    и: "i",
+    й: "y",
+    м: "m",
+    н: "n",
+    о: "o",
+    р: "r",
+  };
+  const transliterate = (text) =>
+    [...text].map((char) => letters[char] ?? char).join("");
+  assert.equal(
+    render.buildArticleSlug("https://example.ru/война-и-мир", transliterate),
+    "voyna-i-mir",
+  );
+
+  // Paths it can't spell still get a page each.
+  const nothing = () => "";
+  const first = render.buildArticleSlug("https://example.jp/一", nothing);
+  const second = render.buildArticleSlug("https://example.jp/二", nothing);
+  assert.match(first, /^a-[0-9a-f]{8}$/);
+  assert.notEqual(first, second);
+});
+
+test("raw quotes are shown without quotation marks", () => {
+  const blockquote = (quote) =>
+    render
+      .buildSourceQuoteHtml(quote)
+      .match(/<blockquote[^>]*>(.*)<\/blockquote>/)[1];
+  assert.equal(blockquote(cardQuote({ quote: "ls -la" })), "“ls -la”");
+  assert.equal(blockquote(cardQuote({ quote: "ls -la", raw: true })), "ls -la");
+
+  const quote = cardQuote({ quote: "ls -la" });
+  const raw = { ...quote, raw: true };
+  assert.notEqual(render.buildCardHash(raw), render.buildCardHash(quote));
+  assert.notEqual(
+    render.buildWrapperHash(raw, null),
+    render.buildWrapperHash(quote, null),
+  );
+  assert.notEqual(
+    render.buildGroupItemHash(raw),
+    render.buildGroupItemHash(quote),
+  );
+});
+
+test("QUOTE_STYLE picks the quotation marks everywhere", async () => {
+  const quote = cardQuote({ quote: "Words." });
+  const marks = async (style) => {
+    const styled = await importRender({ QUOTE_STYLE: style });
+    const { quote_open, quote_close } = styled.buildWrapperPayload(quote, null);
+    const source = styled.buildSourceQuoteHtml(quote);
+    const card = styled.renderWordMarkup(quote.quote, 40);
+    return [
+      source.match(/<blockquote[^>]*>([^<]*)</)[1],
+      `${quote_open}Words.${quote_close}`,
+      card.match(/font-style:normal;">([^<]*)</)[1],
+    ];
+  };
+
+  assert.deepEqual(await marks("curly"), Array(3).fill("“Words.”"));
+  assert.deepEqual(await marks("guillemets"), Array(3).fill("«Words.»"));
+  assert.deepEqual(await marks("straight"), Array(3).fill('"Words."'));
+  assert.deepEqual(await marks("none"), Array(3).fill("Words."));
+  await assert.rejects(
+    importRender({ QUOTE_STYLE: "fancy" }),
+    /Unknown QUOTE_STYLE "fancy"/,
+  );
+});
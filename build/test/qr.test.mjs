@@ -0,0 +1,79 @@
+import test from "node:test";
+import assert from "node:assert/strict";
+
+import { encodeQr, qrToSvg } from "../qr.mjs";
+
+// The 15 format bits beside the top-left finder and their copy split between
+// the other two, least significant first.
+function formatBits({ size, modules }) {
+  const at = (x, y) => (modules[y][x] ? 1 : 0);
+  const first = [];
+  const second = [];
+  for (let i = 0; i <= 5; i += 1) first.push(at(8, i));
+  first.push(at(8, 7), at(8, 8), at(7, 8));
+  for (let i = 9; i < 15; i += 1) first.push(at(14 - i, 8));
+  for (let i = 0; i < 8; i += 1) second.push(at(size - 1 - i, 8));
+  for (let i = 8; i < 15; i += 1) second.push(at(8, size - 15 + i));
+  const value = (bits) => bits.reduce((sum, bit, i) => sum | (bit << i), 0);
+  return [value(first), value(second)];
+}
+
+test("a short URL fits a small code with its fixed patterns", () => {
+  const qr = encodeQr("https://example.com/q/a/");
+  assert.equal(qr.size, 25);
+  assert.equal(qr.modules.length, qr.size);
+
+  // Each finder is a dark ring around a light ring around a dark 3×3 core.
+  const finder = [
+    "#######",
+    "#.....#",
+    "#.###.#",
+    "#.###.#",
+    "#.###.#",
+    "#.....#",
+    "#######",
+  ];
+  for (const [left, top] of [
+    [0, 0],
+    [qr.size - 7, 0],
+    [0, qr.size - 7],
+  ]) {
+    const drawn = finder.map((row, y) =>
+      [...row]
+        .map((_, x) => (qr.modules[top + y][left + x] ? "#" : "."))
+        .join(""),
+    );
+    assert.deepEqual(drawn, finder, `finder at ${left},${top}`);
+  }
+  for (let i = 8; i < qr.size - 8; i += 1) {
+    assert.equal(qr.modules[6][i], i % 2 === 0, `timing at ${i}`);
+  }
+  assert.equal(qr.modules[qr.size - 8][8], true, "dark module");
+});
+
+test("both copies of the format bits encode level M", () => {
+  const [first, second] = formatBits(encodeQr("https://example.com/q/a/"));
+  assert.equal(first, second);
+
+  const format = first ^ 0x5412;
+  assert.equal(format >>> 13, 0, "error correction level M");
+  let remainder = format >>> 10;
+  for (let i = 0; i < 10; i += 1) {
+    remainder = (remainder << 1) ^ ((remainder >>> 9) * 0x537);
+  }
+  assert.equal(remainder, format & 0x3ff, "BCH check bits");
+});
+
+test("longer text moves to a larger version", () => {
+  assert.equal(encodeQr("x".repeat(100)).size, 4 * 6 + 17);
+  assert.throws(() => encodeQr("x".repeat(3000)), /too long for a QR code/);
+});
+
+test("the SVG draws one square per dark module", () => {
+  const qr = encodeQr("https://example.com/");
+  const svg = qrToSvg(qr, { dark: "#26211a" });
+  const dark = qr.modules.flat().filter(Boolean).length;
+  assert.equal(svg.match(/h1v1h-1z/g).length, dark);
+  const side = qr.size + 8;
+  assert.ok(svg.includes(`viewBox="0 0 ${side} ${side}"`), "quiet zone");
+});
@@ -0,0 +1,40 @@
+import test from "node:test";
+import assert from "node:assert/strict";
+
+import { encodeWebp } from "../webp.mjs";
+
+function image(width, height, alpha = 255) {
+  const data = Buffer.alloc(width * height * 4);
+  for (let i = 0; i < width * height; i += 1) {
+    data.set([(i * 7) % 256, (i * 13) % 256, (i * 29) % 256, alpha], i * 4);
+  }
+  return { data, width, height };
+}
+
+test("the file is a lossless WebP with the image's size", () => {
+  const webp = encodeWebp(image(300, 157));
+  assert.equal(webp.toString("latin1", 0, 4), "RIFF");
+  assert.equal(webp.readUInt32LE(4), webp.length - 8);
+  assert.equal(webp.toString("latin1", 8, 16), "WEBPVP8L");
+  assert.equal(webp.readUInt32LE(16), webp.length - 20);
+  assert.equal(webp[20], 0x2f);
+
+  const bits = webp.readUInt32LE(21);
+  assert.equal((bits & 0x3fff) + 1, 300);
+  assert.equal(((bits >>> 14) & 0x3fff) + 1, 157);
+  assert.equal((bits >>> 28) & 1, 0, "no alpha");
+  assert.equal(bits >>> 29, 0, "version 0");
+});
+
+test("the alpha flag follows the pixels", () => {
+  const bits = encodeWebp(image(8, 8, 0)).readUInt32LE(21);
+  assert.equal((bits >>> 28) & 1, 1);
+});
+
+test("sizes WebP cannot hold are refused", () => {
+  assert.throws(() => encodeWebp(image(0, 8)), /WebP cannot hold a 0×8 image/);
+  assert.throws(
+    () => encodeWebp({ data: Buffer.alloc(0), width: 16385, height: 1 }),
+    /WebP cannot hold/,
+  );
+});
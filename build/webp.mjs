@@ -0,0 +1,482 @@
+// Minimal lossless WebP (VP8L) encoder for cards: subtract-green and
+// predictor transforms, backward references to the left and upper pixel, and
+// one set of length-limited prefix codes for the whole image. Takes straight
+// (non-premultiplied) RGBA like jpeg-js and returns the RIFF file as a Buffer.
+
+const SUBTRACT_GREEN = 2;
+const PREDICTOR = 0;
+// Predictor blocks are 2^bits pixels square.
+const PREDICTOR_BITS = 4;
+// Predictor modes tried per block: left, top, and select.
+const PREDICTOR_MODES = [1, 2, 11];
+
+const NUM_LITERAL_CODES = 256;
+const NUM_LENGTH_CODES = 24;
+const NUM_DISTANCE_CODES = 40;
+const MAX_MATCH_LENGTH = 4096;
+const MIN_MATCH_LENGTH = 4;
+// Distance codes 1 and 2 stand for the pixel above and the pixel to the left.
+const DISTANCE_CODE_ABOVE = 1;
+const DISTANCE_CODE_LEFT = 2;
+
+const MAX_CODE_LENGTH = 15;
+const MAX_CODE_LENGTH_CODE_LENGTH = 7;
+const CODE_LENGTH_ORDER = [
+  17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+];
+
+export function encodeWebp({ data, width, height }) {
+  if (width < 1 || height < 1 || width > 16384 || height > 16384) {
+    throw new Error(`WebP cannot hold a ${width}×${height} image.`);
+  }
+  const argb = new Uint32Array(width * height);
+  let hasAlpha = false;
+  for (let i = 0; i < argb.length; i += 1) {
+    const alpha = data[i * 4 + 3];
+    if (alpha !== 255) hasAlpha = true;
+    argb[i] =
+      ((alpha << 24) |
+        (data[i * 4] << 16) |
+        (data[i * 4 + 1] << 8) |
+        data[i * 4 + 2]) >>>
+      0;
+  }
+
+  const writer = new BitWriter();
+  writer.write(0x2f, 8);
+  writer.write(width - 1, 14);
+  writer.write(height - 1, 14);
+  writer.write(hasAlpha ? 1 : 0, 1);
+  writer.write(0, 3);
+
+  writer.write(1, 1);
+  writer.write(SUBTRACT_GREEN, 2);
+  subtractGreen(argb);
+
+  writer.write(1, 1);
+  writer.write(PREDICTOR, 2);
+  writer.write(PREDICTOR_BITS - 2, 3);
+  const { modes, modesWidth } = choosePredictorModes(argb, width, height);
+  writeImageData(writer, modes, modesWidth, false);
+  const residuals = applyPredictor(argb, width, height, modes, modesWidth);
+
+  writer.write(0, 1);
+  writeImageData(writer, residuals, width, true);
+
+  const payload = writer.finish();
+  const padding = payload.length % 2;
+  const file = Buffer.alloc(20 + payload.length + padding);
+  file.write("RIFF", 0, "latin1");
+  file.writeUInt32LE(file.length - 8, 4);
+  file.write("WEBP", 8, "latin1");
+  file.write("VP8L", 12, "latin1");
+  file.writeUInt32LE(payload.length, 16);
+  payload.copy(file, 20);
+  return file;
+}
+
+class BitWriter {
+  constructor() {
+    this.bytes = [];
+    this.value = 0;
+    this.count = 0;
+  }
+
+  // Bits go out least significant first, as VP8L reads them.
+  write(value, bits) {
+    for (let i = 0; i < bits; i += 1) {
+      this.value |= ((value >>> i) & 1) << this.count;
+      this.count += 1;
+      if (this.count === 8) {
+        this.bytes.push(this.value);
+        this.value = 0;
+        this.count = 0;
+      }
+    }
+  }
+
+  finish() {
+    if (this.count) this.bytes.push(this.value);
+    return Buffer.from(this.bytes);
+  }
+}
+
+function subtractGreen(argb) {
+  for (let i = 0; i < argb.length; i += 1) {
+    const pixel = argb[i];
+    const green = (pixel >>> 8) & 0xff;
+    const red = (((pixel >>> 16) & 0xff) - green) & 0xff;
+    const blue = ((pixel & 0xff) - green) & 0xff;
+    argb[i] = ((pixel & 0xff00ff00) | (red << 16) | blue) >>> 0;
+  }
+}
+
+// Picks, per block, the mode whose residuals are smallest. Modes are stored
+// in the green channel of a sub-image one pixel per block.
+function choosePredictorModes(argb, width, height) {
+  const blockSize = 1 << PREDICTOR_BITS;
+  const modesWidth = Math.ceil(width / blockSize);
+  const modesHeight = Math.ceil(height / blockSize);
+  const modes = new Uint32Array(modesWidth * modesHeight);
+  for (let by = 0; by < modesHeight; by += 1) {
+    for (let bx = 0; bx < modesWidth; bx += 1) {
+      let bestMode = PREDICTOR_MODES[0];
+      let bestCost = Infinity;
+      for (const mode of PREDICTOR_MODES) {
+        let cost = 0;
+        const yEnd = Math.min((by + 1) * blockSize, height);
+        const xEnd = Math.min((bx + 1) * blockSize, width);
+        for (let y = by * blockSize; y < yEnd; y += 1) {
+          for (let x = bx * blockSize; x < xEnd; x += 1) {
+            const residual = subtractPixels(
+              argb[y * width + x],
+              predict(argb, width, x, y, mode),
+            );
+            cost += residualCost(residual);
+          }
+        }
+        if (cost < bestCost) {
+          bestCost = cost;
+          bestMode = mode;
+        }
+      }
+      modes[by * modesWidth + bx] = (0xff000000 | (bestMode << 8)) >>> 0;
+    }
+  }
+  return { modes, modesWidth };
+}
+
+function applyPredictor(argb, width, height, modes, modesWidth) {
+  const residuals = new Uint32Array(argb.length);
+  for (let y = 0; y < height; y += 1) {
+    for (let x = 0; x < width; x += 1) {
+      const block =
+        (y >> PREDICTOR_BITS) * modesWidth + (x >> PREDICTOR_BITS);
+      const mode = (modes[block] >>> 8) & 0xf;
+      residuals[y * width + x] = subtractPixels(
+        argb[y * width + x],
+        predict(argb, width, x, y, mode),
+      );
+    }
+  }
+  return residuals;
+}
+
+// The top-left pixel predicts opaque black, the rest of the top row its left
+// neighbour, and the left column the pixel above, whatever the block's mode.
+function predict(argb, width, x, y, mode) {
+  if (x === 0 && y === 0) return 0xff000000;
+  if (y === 0) return argb[x - 1];
+  if (x === 0) return argb[(y - 1) * width];
+  const left = argb[y * width + x - 1];
+  const top = argb[(y - 1) * width + x];
+  if (mode === 1) return left;
+  if (mode === 2) return top;
+  const topLeft = argb[(y - 1) * width + x - 1];
+  let distanceLeft = 0;
+  let distanceTop = 0;
+  for (let shift = 0; shift < 32; shift += 8) {
+    const l = (left >>> shift) & 0xff;
+    const t = (top >>> shift) & 0xff;
+    const tl = (topLeft >>> shift) & 0xff;
+    distanceLeft += Math.abs(t - tl);
+    distanceTop += Math.abs(l - tl);
+  }
+  return distanceLeft < distanceTop ? left : top;
+}
+
+function subtractPixels(a, b) {
+  let result = 0;
+  for (let shift = 0; shift < 32; shift += 8) {
+    const channel = (((a >>> shift) & 0xff) - ((b >>> shift) & 0xff)) & 0xff;
+    result |= channel << shift;
+  }
+  return result >>> 0;
+}
+
+function residualCost(residual) {
+  let cost = 0;
+  for (let shift = 0; shift < 32; shift += 8) {
+    const channel = (residual >>> shift) & 0xff;
+    cost += channel < 128 ? channel : 256 - channel;
+  }
+  return cost;
+}
+
+// Entropy-coded image: greedy matches against the left and upper pixel, then
+// one prefix code group. Only the main image carries the meta prefix bit.
+function writeImageData(writer, argb, width, isMain) {
+  const tokens = findMatches(argb, width);
+
+  const histograms = {
+    green: new Uint32Array(NUM_LITERAL_CODES + NUM_LENGTH_CODES),
+    red: new Uint32Array(NUM_LITERAL_CODES),
+    blue: new Uint32Array(NUM_LITERAL_CODES),
+    alpha: new Uint32Array(NUM_LITERAL_CODES),
+    distance: new Uint32Array(NUM_DISTANCE_CODES),
+  };
+  for (const token of tokens) {
+    if (token.length) {
+      histograms.green[NUM_LITERAL_CODES + prefixOf(token.length).code] += 1;
+      histograms.distance[prefixOf(token.distanceCode).code] += 1;
+    } else {
+      const pixel = token.pixel;
+      histograms.green[(pixel >>> 8) & 0xff] += 1;
+      histograms.red[(pixel >>> 16) & 0xff] += 1;
+      histograms.blue[pixel & 0xff] += 1;
+      histograms.alpha[pixel >>> 24] += 1;
+    }
+  }
+
+  writer.write(0, 1);
+  if (isMain) writer.write(0, 1);
+  const codes = {};
+  for (const name of ["green", "red", "blue", "alpha", "distance"]) {
+    codes[name] = writePrefixCode(writer, histograms[name]);
+  }
+
+  for (const token of tokens) {
+    if (token.length) {
+      const length = prefixOf(token.length);
+      writeSymbol(writer, codes.green, NUM_LITERAL_CODES + length.code);
+      writer.write(length.extraValue, length.extraBits);
+      const distance = prefixOf(token.distanceCode);
+      writeSymbol(writer, codes.distance, distance.code);
+      writer.write(distance.extraValue, distance.extraBits);
+    } else {
+      const pixel = token.pixel;
+      writeSymbol(writer, codes.green, (pixel >>> 8) & 0xff);
+      writeSymbol(writer, codes.red, (pixel >>> 16) & 0xff);
+      writeSymbol(writer, codes.blue, pixel & 0xff);
+      writeSymbol(writer, codes.alpha, pixel >>> 24);
+    }
+  }
+}
+
+function findMatches(argb, width) {
+  const tokens = [];
+  let i = 0;
+  while (i < argb.length) {
+    const left = matchLength(argb, i, 1);
+    const above = i >= width ? matchLength(argb, i, width) : 0;
+    const length = Math.max(left, above);
+    if (length >= MIN_MATCH_LENGTH) {
+      const distanceCode =
+        left >= above ? DISTANCE_CODE_LEFT : DISTANCE_CODE_ABOVE;
+      tokens.push({ length, distanceCode });
+      i += length;
+    } else {
+      tokens.push({ length: 0, pixel: argb[i] });
+      i += 1;
+    }
+  }
+  return tokens;
+}
+
+function matchLength(argb, start, distance) {
+  if (start < distance) return 0;
+  const limit = Math.min(argb.length - start, MAX_MATCH_LENGTH);
+  let length = 0;
+  while (
+    length < limit &&
+    argb[start + length] === argb[start + length - distance]
+  ) {
+    length += 1;
+  }
+  return length;
+}
+
+// Splits a length or distance code into a prefix symbol and extra bits.
+function prefixOf(value) {
+  if (value <= 4) return { code: value - 1, extraBits: 0, extraValue: 0 };
+  const offset = value - 1;
+  const highestBit = 31 - Math.clz32(offset);
+  const secondBit = (offset >>> (highestBit - 1)) & 1;
+  const extraBits = highestBit - 1;
+  return {
+    code: 2 * highestBit + secondBit,
+    extraBits,
+    extraValue: offset & ((1 << extraBits) - 1),
+  };
+}
+
+// Writes the code for one histogram and returns its bit patterns, reversed so
+// they can be written least significant bit first. Up to two small symbols use
+// the short "simple" form; a single symbol then costs no bits per use.
+function writePrefixCode(writer, histogram) {
+  const used = [];
+  for (let symbol = 0; symbol < histogram.length; symbol += 1) {
+    if (histogram[symbol]) used.push(symbol);
+  }
+  if (used.length === 0) used.push(0);
+
+  if (used.length <= 2 && used.every((symbol) => symbol < 256)) {
+    writer.write(1, 1);
+    writer.write(used.length - 1, 1);
+    const wide = used[0] > 1;
+    writer.write(wide ? 1 : 0, 1);
+    writer.write(used[0], wide ? 8 : 1);
+    if (used.length === 2) writer.write(used[1], 8);
+    const lengths = new Uint8Array(histogram.length);
+    if (used.length === 2) used.forEach((symbol) => (lengths[symbol] = 1));
+    return canonicalCodes(lengths);
+  }
+
+  const counts = Uint32Array.from(histogram);
+  // A lone wide symbol still needs a partner for a two-leaf tree.
+  if (used.length === 1) counts[used[0] === 0 ? 1 : 0] = 1;
+  const lengths = buildCodeLengths(counts, MAX_CODE_LENGTH);
+  writer.write(0, 1);
+  writeCodeLengths(writer, lengths);
+  return canonicalCodes(lengths);
+}
+
+function writeCodeLengths(writer, lengths) {
+  const tokens = runLengthTokens(lengths);
+  const histogram = new Uint32Array(19);
+  for (const token of tokens) histogram[token.symbol] += 1;
+  const nonZero = histogram.filter(Boolean).length;
+  // The code-length code needs two leaves to be decodable by every reader.
+  if (nonZero === 1) histogram[histogram[0] ? 1 : 0] = 1;
+  const codeLengthLengths = buildCodeLengths(
+    histogram,
+    MAX_CODE_LENGTH_CODE_LENGTH,
+  );
+  const codeLengthCodes = canonicalCodes(codeLengthLengths);
+
+  let count = CODE_LENGTH_ORDER.length;
+  while (count > 4 && !codeLengthLengths[CODE_LENGTH_ORDER[count - 1]]) {
+    count -= 1;
+  }
+  writer.write(count - 4, 4);
+  for (let i = 0; i < count; i += 1) {
+    writer.write(codeLengthLengths[CODE_LENGTH_ORDER[i]], 3);
+  }
+
+  writer.write(0, 1);
+  for (const token of tokens) {
+    writeSymbol(writer, codeLengthCodes, token.symbol);
+    if (token.extraBits) writer.write(token.extraValue, token.extraBits);
+  }
+}
+
+// Code lengths as symbols 0–15, with 16 repeating the previous non-zero
+// length 3–6 times and 17/18 standing for 3–10 and 11–138 zeros.
+function runLengthTokens(lengths) {
+  const tokens = [];
+  let previous = 8;
+  let i = 0;
+  while (i < lengths.length) {
+    const value = lengths[i];
+    let run = 1;
+    while (i + run < lengths.length && lengths[i + run] === value) run += 1;
+    i += run;
+    if (value === 0) {
+      while (run >= 3) {
+        if (run >= 11) {
+          const repeat = Math.min(run, 138);
+          tokens.push({ symbol: 18, extraBits: 7, extraValue: repeat - 11 });
+          run -= repeat;
+        } else {
+          const repeat = Math.min(run, 10);
+          tokens.push({ symbol: 17, extraBits: 3, extraValue: repeat - 3 });
+          run -= repeat;
+        }
+      }
+      for (; run > 0; run -= 1) tokens.push({ symbol: 0, extraBits: 0 });
+      continue;
+    }
+    if (value !== previous) {
+      tokens.push({ symbol: value, extraBits: 0 });
+      previous = value;
+      run -= 1;
+    }
+    while (run >= 3) {
+      const repeat = Math.min(run, 6);
+      tokens.push({ symbol: 16, extraBits: 2, extraValue: repeat - 3 });
+      run -= repeat;
+    }
+    for (; run > 0; run -= 1) tokens.push({ symbol: value, extraBits: 0 });
+  }
+  return tokens;
+}
+
+// Huffman code lengths no longer than maxLength. When the tree comes out too
+// deep, rare symbols are counted as more common and the tree is rebuilt.
+function buildCodeLengths(counts, maxLength) {
+  let floor = 1;
+  for (;;) {
+    const lengths = huffmanLengths(counts, floor);
+    if (lengths.every((length) => length <= maxLength)) return lengths;
+    floor *= 2;
+  }
+}
+
+function huffmanLengths(counts, floor) {
+  const nodes = [];
+  for (let symbol = 0; symbol < counts.length; symbol += 1) {
+    if (counts[symbol]) {
+      nodes.push({ weight: Math.max(counts[symbol], floor), symbol });
+    }
+  }
+  const lengths = new Uint8Array(counts.length);
+  if (nodes.length === 1) {
+    lengths[nodes[0].symbol] = 1;
+    return lengths;
+  }
+  const heap = nodes.slice().sort((a, b) => a.weight - b.weight);
+  while (heap.length > 1) {
+    const a = heap.shift();
+    const b = heap.shift();
+    const parent = { weight: a.weight + b.weight, children: [a, b] };
+    let index = heap.findIndex((node) => node.weight > parent.weight);
+    if (index === -1) index = heap.length;
+    heap.splice(index, 0, parent);
+  }
+  const stack = [{ node: heap[0], depth: 0 }];
+  while (stack.length) {
+    const { node, depth } = stack.pop();
+    if (node.children) {
+      for (const child of node.children) {
+        stack.push({ node: child, depth: depth + 1 });
+      }
+    } else {
+      lengths[node.symbol] = depth;
+    }
+  }
+  return lengths;
+}
+
+// Canonical codes from lengths, each stored bit-reversed with its length.
+function canonicalCodes(lengths) {
+  const maxLength = Math.max(0, ...lengths);
+  const lengthCounts = new Uint32Array(maxLength + 1);
+  for (const length of lengths) if (length) lengthCounts[length] += 1;
+  const nextCode = new Uint32Array(maxLength + 2);
+  let code = 0;
+  for (let length = 1; length <= maxLength; length += 1) {
+    code = (code + lengthCounts[length - 1]) << 1;
+    nextCode[length] = code;
+  }
+  const codes = [];
+  for (let symbol = 0; symbol < lengths.length; symbol += 1) {
+    const length = lengths[symbol];
+    if (!length) continue;
+    codes[symbol] = { bits: reverseBits(nextCode[length], length), length };
+    nextCode[length] += 1;
+  }
+  return codes;
+}
+
+function reverseBits(value, length) {
+  let result = 0;
+  for (let i = 0; i < length; i += 1) {
+    result = (result << 1) | ((value >>> i) & 1);
+  }
+  return result;
+}
+
+function writeSymbol(writer, codes, symbol) {
+  const code = codes[symbol];
+  if (code) writer.write(code.bits, code.length);
+}